@@ -0,0 +1,54 @@
+package pk
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// Tells whether a field with type t and tag options o
+// is a slice of booleans to be stored as a single bitset blob.
+func isBitset(t reflect.Type, o options) bool {
+	return o.Bitset && t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Bool
+}
+
+// Stores the booleans in slice v as a bitset:
+// a byte giving the number of unused (high) bits in the last byte,
+// followed by the bits, eight per byte, least significant first.
+// An empty slice is stored as the empty blob.
+func (e *Encoder) encodeBitset(ctx context.Context, v reflect.Value) (blob.Ref, error) {
+	n := v.Len()
+	var buf []byte
+	if n > 0 {
+		buf = make([]byte, 1+(n+7)/8)
+		buf[0] = byte(len(buf)*8 - 8 - n)
+		for i := 0; i < n; i++ {
+			if v.Index(i).Bool() {
+				buf[1+i/8] |= 1 << (i % 8)
+			}
+		}
+	}
+	sref, err := e.receiveString(ctx, string(buf))
+	return sref.Ref, errors.Wrap(err, "storing bitset")
+}
+
+// Parses s, a bitset, into a new slice of type t.
+// An empty blob parses as a nil slice.
+func parseBitset(s []byte, t reflect.Type) (reflect.Value, error) {
+	if len(s) == 0 {
+		return reflect.Zero(t), nil
+	}
+	if len(s) < 2 || s[0] > 7 {
+		return reflect.Value{}, errors.Errorf("invalid bitset of %d bytes with %d unused bits", len(s), s[0])
+	}
+	n := (len(s)-1)*8 - int(s[0])
+	result := reflect.MakeSlice(t, n, n)
+	for i := 0; i < n; i++ {
+		if s[1+i/8]&(1<<(i%8)) != 0 {
+			result.Index(i).SetBool(true)
+		}
+	}
+	return result, nil
+}
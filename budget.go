@@ -0,0 +1,62 @@
+package pk
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrOperationBudget is produced when decoding needs more blob fetches
+// than a Decoder allows.
+// See Decoder.SetMaxOperations.
+var ErrOperationBudget = errors.New("operation budget exceeded")
+
+// budgetKey is the context key for the number of operations
+// remaining to a single call of a Decoder method.
+type budgetKey struct{}
+
+// SetMaxOperations limits the number of blobs
+// that a single call to Decode
+// (or to DecodeMapValue, DecodeRefMap, RawField, or Replay)
+// may fetch,
+// to bound the total work that a maliciously crafted tree could cause.
+// Every fetch counts,
+// including repeated fetches of the same blob
+// and fetches satisfied by the cache (see SetFetchCache).
+// The count is shared by the whole call,
+// including nested calls made with its context,
+// such as by an UnmarshalerWithDecoder;
+// an Unmarshaler that fetches blobs itself is not counted.
+// Once the limit is reached, decoding fails with ErrOperationBudget,
+// even in Collect mode (see SetErrorMode).
+//
+// This complements SetMaxRefArrayLen,
+// which limits the size of each slice, array, and map
+// but not how many there are or how deeply they nest.
+// With n less than 1,
+// and by default,
+// there is no limit.
+func (d *Decoder) SetMaxOperations(n int) {
+	d.maxOps = n
+}
+
+// Returns a context carrying a new operation budget for one call,
+// unless ctx already carries one
+// or the Decoder has no limit.
+func (d *Decoder) withBudget(ctx context.Context) context.Context {
+	if d.maxOps < 1 || ctx.Value(budgetKey{}) != nil {
+		return ctx
+	}
+	n := int64(d.maxOps)
+	return context.WithValue(ctx, budgetKey{}, &n)
+}
+
+// Charges one operation to the budget in ctx, if any.
+func spend(ctx context.Context) error {
+	n, _ := ctx.Value(budgetKey{}).(*int64)
+	if n != nil && atomic.AddInt64(n, -1) < 0 {
+		return ErrOperationBudget
+	}
+	return nil
+}
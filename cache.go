@@ -0,0 +1,149 @@
+package pk
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"perkeep.org/pkg/blob"
+)
+
+// CacheStats reports the effectiveness of a cache.
+// See Encoder.SetDedupCache and Decoder.SetFetchCache.
+type CacheStats struct {
+	// Hits and Misses count lookups since the cache was created.
+	Hits, Misses uint64
+
+	// Entries is the number of items currently in the cache.
+	Entries int
+}
+
+// lruCache is a concurrency-safe cache of up to max items keyed by ref,
+// evicting the least recently used.
+type lruCache[V any] struct {
+	// Accessed atomically; first for 64-bit alignment.
+	hits, misses uint64
+
+	mu    sync.Mutex
+	max   int
+	ll    *list.List // of *lruEntry[V], most recent first
+	items map[blob.Ref]*list.Element
+}
+
+type lruEntry[V any] struct {
+	ref blob.Ref
+	val V
+}
+
+// Returns nil (a disabled cache) if max is less than 1.
+func newLRUCache[V any](max int) *lruCache[V] {
+	if max < 1 {
+		return nil
+	}
+	return &lruCache[V]{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[blob.Ref]*list.Element),
+	}
+}
+
+func (c *lruCache[V]) get(ref blob.Ref) (V, bool) {
+	c.mu.Lock()
+	el, ok := c.items[ref]
+	if ok {
+		c.ll.MoveToFront(el)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		var zero V
+		return zero, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return el.Value.(*lruEntry[V]).val, true
+}
+
+func (c *lruCache[V]) add(ref blob.Ref, val V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[ref]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*lruEntry[V]).val = val
+		return
+	}
+	c.items[ref] = c.ll.PushFront(&lruEntry[V]{ref: ref, val: val})
+	for c.ll.Len() > c.max {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*lruEntry[V]).ref)
+	}
+}
+
+// A nil cache reports zero stats.
+func (c *lruCache[V]) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	n := c.ll.Len()
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: n,
+	}
+}
+
+// SetDedupCache makes the Encoder remember the refs of up to n blobs it has stored
+// (the n most recently used),
+// and skip sending any of them again.
+// This saves redundant writes when the same values recur,
+// within one object or across calls to Encode.
+// It assumes that blobs are never removed from the Encoder's BlobReceiver.
+// See CacheStats for measuring its effectiveness.
+// Calling SetDedupCache replaces any existing cache and its stats.
+// By default, and with n less than 1, there is no dedup cache.
+func (e *Encoder) SetDedupCache(n int) {
+	e.dedup = newLRUCache[struct{}](n)
+}
+
+// SetKnownRefs gives the Encoder a set of blobs already present in its BlobReceiver,
+// such as those listed in the manifest of an earlier run (see EncodeWithManifest),
+// and makes it skip sending any blob whose ref is in the set.
+// Unlike the dedup cache (see SetDedupCache),
+// this lets a fresh process avoid rewriting unchanged subtrees,
+// without asking the server which blobs it has.
+// The set is only read, never updated,
+// and must not be modified while the Encoder is in use.
+// A nil set (the default) skips nothing.
+func (e *Encoder) SetKnownRefs(refs map[blob.Ref]bool) {
+	e.knownRefs = refs
+}
+
+// CacheStats reports the hits, misses, and entries of the Encoder's dedup cache
+// (see SetDedupCache).
+// A hit is a blob write that was skipped.
+func (e *Encoder) CacheStats() CacheStats {
+	return e.dedup.stats()
+}
+
+// SetFetchCache makes the Decoder keep the contents of up to n fetched blobs
+// (the n most recently used)
+// for reuse when they are needed again,
+// as happens when the same value recurs within one object
+// or across calls to Decode.
+// See CacheStats for measuring its effectiveness.
+// Calling SetFetchCache replaces any existing cache and its stats.
+// By default, and with n less than 1, there is no fetch cache.
+func (d *Decoder) SetFetchCache(n int) {
+	d.cache = newLRUCache[[]byte](n)
+}
+
+// CacheStats reports the hits, misses, and entries of the Decoder's fetch cache
+// (see SetFetchCache).
+// A hit is a blob fetch that was avoided.
+func (d *Decoder) CacheStats() CacheStats {
+	return d.cache.stats()
+}
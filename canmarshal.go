@@ -0,0 +1,272 @@
+package pk
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCycle is produced by CanMarshal when a value refers, through pointers, maps, slices, or interfaces, to itself.
+// Marshaling such a value would never finish.
+var ErrCycle = errors.New("cycle")
+
+// CanMarshal reports whether obj can be marshaled,
+// without writing anything.
+// It walks obj the way Marshal would
+// (with a default Encoder, but checking tags strictly as with Encoder.SetStrictTags),
+// and returns the first problem it finds:
+// a value of an unsupported type (such as a channel or function),
+// an interface holding an unregistered type,
+// an unsupported map key type,
+// a struct with invalid pk tags or defaults,
+// an invalid json.Number,
+// or a cycle, reported as ErrCycle.
+// The error gives the path of the offending value,
+// in the form reported by PathFromContext,
+// and errors.Cause recovers the underlying error.
+//
+// Values that implement Marshaler are assumed to be marshalable.
+// Computed fields (with the "compute" option) are computed.
+// Unlike a dry run (see Encoder.SetDryRun),
+// CanMarshal computes no blobrefs.
+func CanMarshal(obj interface{}) error {
+	c := &marshalChecker{active: make(map[visit]bool)}
+	return c.check(reflect.ValueOf(obj), nil)
+}
+
+// marshalChecker holds the state of a CanMarshal traversal.
+type marshalChecker struct {
+	// The pointers, maps, and slices being walked,
+	// i.e. the ancestors of the current value.
+	active map[visit]bool
+}
+
+// visit identifies a pointer, map, or slice for cycle detection.
+// Slices that share a backing array but differ in length are distinct.
+type visit struct {
+	ptr unsafe.Pointer
+	t   reflect.Type
+	len int
+}
+
+func (c *marshalChecker) check(v reflect.Value, path *pathElem) error {
+	err := c.checkValue(v, path)
+	if err != nil {
+		if _, ok := err.(pathError); ok {
+			return err
+		}
+		return pathError{path: path.String(), err: err}
+	}
+	return nil
+}
+
+// pathError is an error from CanMarshal together with its location.
+type pathError struct {
+	path string
+	err  error
+}
+
+func (e pathError) Error() string {
+	if e.path == "" {
+		return e.err.Error()
+	}
+	return "at " + e.path + ": " + e.err.Error()
+}
+
+// Cause allows errors.Cause to find the underlying error.
+func (e pathError) Cause() error {
+	return e.err
+}
+
+func (c *marshalChecker) checkValue(v reflect.Value, path *pathElem) error {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Kind() == reflect.Interface {
+		return c.checkInterface(v, path)
+	}
+	if v.CanInterface() {
+		if isMarshaler(v.Type()) || isMarshaler(reflect.PtrTo(v.Type())) {
+			return nil
+		}
+	}
+
+	t := v.Type()
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		key := visit{ptr: unsafe.Pointer(v.Pointer()), t: t}
+		if t.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		if c.active[key] {
+			return ErrCycle
+		}
+		c.active[key] = true
+		defer delete(c.active, key)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return nil
+
+	case reflect.String:
+		if t == numberType && !isJSONNumber(v.String()) {
+			return errors.Errorf("invalid json.Number %q", v.String())
+		}
+		return nil
+
+	case reflect.Ptr:
+		return c.check(v.Elem(), path)
+
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			err := c.check(v.Index(i), &pathElem{parent: path, step: "[" + strconv.Itoa(i) + "]"})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		if !isMapKeyType(t.Key()) {
+			return ErrUnsupportedType{Name: t.Key().String()}
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			err := c.check(iter.Value(), &pathElem{parent: path, step: fmt.Sprintf("[%v]", iter.Key())})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Struct:
+		return c.checkStruct(v, path)
+	}
+
+	return ErrUnsupportedType{Name: t.String()}
+}
+
+func (c *marshalChecker) checkInterface(v reflect.Value, path *pathElem) error {
+	if v.IsNil() {
+		return nil
+	}
+	el := v.Elem()
+	if el.Type() == reftype {
+		return nil
+	}
+	if _, ok := registeredName(el.Type()); !ok {
+		return ErrUnregisteredType{Name: el.Type().String()}
+	}
+	return c.check(el, path)
+}
+
+func (c *marshalChecker) checkStruct(v reflect.Value, path *pathElem) error {
+	t := v.Type()
+
+	if v.CanInterface() {
+		if om, ok := v.Interface().(orderedMapEncoder); ok {
+			keys, vals := om.pkOrderedPairs()
+			for i, val := range vals {
+				if err := c.check(val, &pathElem{parent: path, step: fmt.Sprintf("[%v]", keys[i])}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if isRefType(t) || t == timeType || isNetipType(t) {
+		return nil
+	}
+
+	if err := checkTags(t); err != nil {
+		return err
+	}
+	if _, err := defaultsFor(t); err != nil {
+		return err
+	}
+	if _, err := refOfFields(t); err != nil {
+		return err
+	}
+	if _, err := selfFields(t); err != nil {
+		return err
+	}
+
+	extra := extraMapField(t)
+
+	for i := 0; i < v.NumField(); i++ {
+		tf := t.Field(i)
+		name, o := parseTag(tf)
+		if o.Omit || o.Self || i == extra {
+			continue
+		}
+		fpath := &pathElem{parent: path, step: name, field: true}
+		vf := v.Field(i)
+		if o.Compute {
+			var err error
+			vf, err = computeField(v, i)
+			if err != nil {
+				return pathError{path: fpath.String(), err: err}
+			}
+		}
+		if o.OmitEmpty && vf.IsZero() {
+			continue
+		}
+		if o.Encrypt && o.Inline {
+			return pathError{
+				path: fpath.String(),
+				err:  errors.Errorf("field %s of struct type %s cannot be both inline and encrypted", name, t),
+			}
+		}
+		if o.Uintptr && tf.Type.Kind() == reflect.Uintptr {
+			continue
+		}
+		if isMoney(tf.Type, o) {
+			if _, err := formatMoney(vf); err != nil {
+				return pathError{path: fpath.String(), err: err}
+			}
+			continue
+		}
+		if isZonedTime(tf.Type, o) || isCompactTimes(tf.Type, o) || isPacked(tf.Type, o) || isBitset(tf.Type, o) {
+			continue
+		}
+		if o.Inline {
+			if !vf.CanInterface() {
+				continue
+			}
+			if _, err := json.Marshal(vf.Interface()); err != nil {
+				return pathError{path: fpath.String(), err: errors.Wrapf(err, "JSON-encoding inline field %s of struct type %s", name, t)}
+			}
+			continue
+		}
+		if err := c.check(vf, fpath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tells whether t can be the key type of a marshaled map,
+// following the encoding/json rules for object keys.
+func isMapKeyType(t reflect.Type) bool {
+	if t.Kind() == reflect.String || t.Implements(textMarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package pk
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SetCaseSensitiveFields tells whether the keys of a struct blob
+// must match the stored names of the struct's fields exactly.
+// By default, as in encoding/json,
+// a key that matches a field's name only when case is ignored
+// (such as "id" for a field named ID)
+// is used for that field when no key matches exactly.
+// With val true such a key is not used for the field
+// (though it can still be collected by a catch-all inline map field).
+func (d *Decoder) SetCaseSensitiveFields(val bool) {
+	d.caseSensitive = val
+}
+
+// Removes from s, the JSON object for a struct of type t,
+// each key that is not the stored name of a field of t
+// but matches one when case is ignored,
+// so that encoding/json will not use it.
+func dropCaseFoldedKeys(s []byte, t reflect.Type) ([]byte, error) {
+	declared := declaredNames(t, -1)
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(s, &m); err != nil {
+		return nil, errors.Wrap(err, "JSON-decoding struct")
+	}
+	var changed bool
+	for k := range m {
+		if declared[k] {
+			continue
+		}
+		for name := range declared {
+			if strings.EqualFold(k, name) {
+				delete(m, k)
+				changed = true
+				break
+			}
+		}
+	}
+	if !changed {
+		return s, nil
+	}
+	return json.Marshal(m)
+}
@@ -0,0 +1,185 @@
+package pk
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// chainLink connects a node of a linked list of structs
+// to the next node,
+// when the list is encoded or decoded iteratively.
+// See chainField.
+type chainLink struct {
+	field int      // index of the field pointing to the next node
+	next  blob.Ref // ref of the next node
+}
+
+// Caches the result of chainField by struct type.
+var chainCache sync.Map // reflect.Type -> int
+
+// Returns the index of the field of struct type t
+// that makes t a linked-list node,
+// or -1 if there is none.
+// A node type has exactly one field of type *t,
+// with no pk options other than omitempty,
+// and neither it nor its pointer type is a Marshaler or Unmarshaler.
+//
+// Lists of such nodes (like "type Node struct { V int; Next *Node }")
+// are encoded and decoded with a loop rather than with recursion,
+// so that a very long list needs neither a deep stack
+// nor a deep chain of contexts.
+// Their blobs are the same either way.
+func chainField(t reflect.Type) int {
+	if f, ok := chainCache.Load(t); ok {
+		return f.(int)
+	}
+	f := findChainField(t)
+	chainCache.Store(t, f)
+	return f
+}
+
+func findChainField(t reflect.Type) int {
+	pt := reflect.PtrTo(t)
+	if isMarshaler(t) || isMarshaler(pt) || isUnmarshaler(pt) {
+		return -1
+	}
+	result := -1
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		if tf.Type != pt {
+			continue
+		}
+		_, o := parseTag(tf)
+		if o.Omit {
+			continue
+		}
+		if result >= 0 {
+			// More than one: a tree, not a list.
+			return -1
+		}
+		o.OmitEmpty = false
+		if !reflect.DeepEqual(o, options{}) {
+			return -1
+		}
+		result = i
+	}
+	return result
+}
+
+// Encodes the linked list of structs starting at v,
+// where field f of each node points to the next.
+// The nodes are collected first,
+// then encoded from the tail back to the head,
+// each given the ref of the one after it.
+func (e *Encoder) encodeChain(ctx context.Context, v reflect.Value, f int, isRoot bool) (blob.Ref, error) {
+	t := v.Type()
+	name, _ := parseTag(t.Field(f))
+	_, isDelta := ctx.Value(deltaKey{}).(*Decoder)
+
+	var (
+		nodes []reflect.Value
+		ctxs  []context.Context
+		seen  = make(map[uintptr]bool)
+		path  = pathFrom(ctx)
+		nctx  = ctx
+	)
+	for node := v; ; {
+		nodes = append(nodes, node)
+		ctxs = append(ctxs, nctx)
+		next := node.Field(f)
+		if next.IsNil() {
+			break
+		}
+		if seen[next.Pointer()] {
+			return blob.Ref{}, errors.Errorf("cycle in linked list of %s", t)
+		}
+		seen[next.Pointer()] = true
+
+		var prev blob.Ref
+		if isDelta {
+			fields, err := prevFields(nctx, t)
+			if err != nil {
+				return blob.Ref{}, err
+			}
+			prev = refFromJSON(fields[name])
+		}
+		path = &pathElem{parent: path, step: name, field: true}
+		nctx = withPrev(withPath(ctx, path), prev)
+		node = next.Elem()
+	}
+
+	var ref blob.Ref
+	for i := len(nodes) - 1; i >= 0; i-- {
+		var link *chainLink
+		if i < len(nodes)-1 {
+			link = &chainLink{field: f, next: ref}
+		}
+		var err error
+		ref, err = e.encodeStruct(ctxs[i], nodes[i], isRoot && i == 0, link)
+		if err != nil {
+			if i > 0 {
+				err = errors.Wrapf(err, "storing field %s of struct type %s", name, t)
+			}
+			return blob.Ref{}, err
+		}
+	}
+	return ref, nil
+}
+
+// Decodes the linked list of structs whose head is the blob s, with ref ref,
+// into structVal,
+// where field f of each node points to the next.
+// The self fields (see selfFields) of each node are set to that node's ref.
+func (d *Decoder) decodeChain(ctx context.Context, ref blob.Ref, s []byte, structVal reflect.Value, f int, selfs []int) error {
+	t := structVal.Type()
+	name, _ := parseTag(t.Field(f))
+
+	var (
+		path = pathFrom(ctx)
+		nctx = ctx
+	)
+	for {
+		link := &chainLink{field: f}
+		var err error
+		if vs := d.versions[t]; vs != nil {
+			err = d.decodeVersioned(nctx, s, structVal, vs, link)
+		} else {
+			err = d.decodeStruct(nctx, s, structVal, link)
+		}
+		if err != nil {
+			return err
+		}
+		setSelfRefs(structVal, selfs, ref)
+		if !link.next.Valid() {
+			return nil
+		}
+
+		ref = link.next
+		field := structVal.Field(f)
+		path = &pathElem{parent: path, step: name, field: true}
+		nctx = withPath(ctx, path)
+		s, err = d.fetchStructure(nctx, ref)
+		if err != nil {
+			// Let Decode handle (or report) the failure.
+			err = d.Decode(nctx, ref, field.Addr().Interface())
+			return errors.Wrapf(err, "decoding ref %s for field %s", ref, name)
+		}
+		if len(s) == 0 {
+			// A nil pointer ends the list.
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		if field.IsNil() {
+			p, err := newValue(t)
+			if err != nil {
+				return err
+			}
+			field.Set(p)
+		}
+		structVal = field.Elem()
+	}
+}
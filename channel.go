@@ -0,0 +1,73 @@
+package pk
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// EncodeChannel receives values from ch,
+// which must be a channel of some type T that permits receiving,
+// until it is closed,
+// then marshals them, in order, as a []T
+// and returns the ref of the slice.
+// It blocks until ch is closed or ctx is canceled;
+// in the latter case it returns the context's error
+// and nothing is written.
+// The result unmarshals as a slice
+// (channels themselves are not marshalable).
+func (e *Encoder) EncodeChannel(ctx context.Context, ch interface{}) (blob.Ref, error) {
+	cv := reflect.ValueOf(ch)
+	if cv.Kind() != reflect.Chan || cv.Type().ChanDir()&reflect.RecvDir == 0 {
+		return blob.Ref{}, errors.Errorf("EncodeChannel requires a receivable channel, not %T", ch)
+	}
+
+	var (
+		slice = reflect.MakeSlice(reflect.SliceOf(cv.Type().Elem()), 0, 0)
+		cases = []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: cv},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		}
+	)
+	for {
+		chosen, val, ok := reflect.Select(cases)
+		if chosen == 1 {
+			return blob.Ref{}, ctx.Err()
+		}
+		if !ok {
+			break
+		}
+		slice = reflect.Append(slice, val)
+	}
+	return e.Encode(ctx, slice.Interface())
+}
+
+// EncodeSeq drains seq,
+// an iterator in the form of iter.Seq[T]
+// (any iter.Seq[T] may be passed),
+// then marshals the values it yields, in order, as a []T
+// and returns the ref of the slice,
+// as EncodeChannel does for channels.
+// If ctx is canceled while seq is running,
+// EncodeSeq stops the iteration and returns the context's error,
+// and nothing is written.
+// The result unmarshals as a slice.
+//
+// EncodeSeq is a function rather than an Encoder method
+// because Go methods cannot have type parameters.
+func EncodeSeq[T any](ctx context.Context, e *Encoder, seq func(yield func(T) bool)) (blob.Ref, error) {
+	slice := []T{}
+	seq(func(val T) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		slice = append(slice, val)
+		return true
+	})
+	if err := ctx.Err(); err != nil {
+		return blob.Ref{}, err
+	}
+	return e.Encode(ctx, slice)
+}
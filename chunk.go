@@ -0,0 +1,156 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// chunkIndex is an interior node in the tree of blobs
+// that a large ref array is split into
+// when chunking is enabled (see Encoder.SetChunkFanout).
+// Each of its chunks is either another chunkIndex
+// or a plain JSON array of element refs.
+type chunkIndex struct {
+	// Len is the total number of element refs beneath this node.
+	Len    int        `json:"len"`
+	Chunks []blob.Ref `json:"chunks"`
+}
+
+// SetChunkFanout enables the chunking of large ref arrays.
+// Normally a slice or array is stored as a single JSON array of blobrefs,
+// which for millions of elements becomes an enormous blob.
+// With a fanout n of 2 or more,
+// a slice or array with more than n elements
+// is instead stored as a balanced tree:
+// its element refs are split into plain ref-array blobs of at most n refs each,
+// and those are gathered (recursively, as needed)
+// into index blobs of the form {"len": N, "chunks": [ref,ref,...]}
+// having at most n chunks each,
+// where N is the number of element refs beneath the index.
+// No single blob then grows without bound,
+// and parts of the collection can be read without fetching it all.
+//
+// Chunking applies to slices and arrays stored as blobs of their own:
+// top-level values, members of other containers,
+// and struct fields with the "external" option.
+// It does not apply to the blobref lists that struct fields hold by default.
+//
+// Decoding detects and walks chunked trees regardless of this setting.
+// By default (and with n less than 2) chunking is disabled.
+func (e *Encoder) SetChunkFanout(n int) {
+	e.chunkFanout = n
+}
+
+// Stores refs as a JSON array,
+// or as a tree of chunks if it is large and chunking is enabled.
+func (e *Encoder) storeRefArray(ctx context.Context, refs []blob.Ref) (blob.Ref, error) {
+	n := e.chunkFanout
+	if n < 2 || len(refs) <= n {
+		sref, err := e.receiveJSON(ctx, refs)
+		return sref.Ref, errors.Wrap(err, "storing ref array")
+	}
+
+	// Leaves: plain ref arrays.
+	var (
+		level []blob.Ref
+		lens  []int
+	)
+	for i := 0; i < len(refs); i += n {
+		end := i + n
+		if end > len(refs) {
+			end = len(refs)
+		}
+		sref, err := e.receiveJSON(ctx, refs[i:end])
+		if err != nil {
+			return blob.Ref{}, errors.Wrap(err, "storing ref-array chunk")
+		}
+		level = append(level, sref.Ref)
+		lens = append(lens, end-i)
+	}
+
+	// Interior nodes, until one remains.
+	for {
+		var (
+			nextLevel []blob.Ref
+			nextLens  []int
+		)
+		for i := 0; i < len(level); i += n {
+			end := i + n
+			if end > len(level) {
+				end = len(level)
+			}
+			idx := chunkIndex{Chunks: level[i:end]}
+			for _, l := range lens[i:end] {
+				idx.Len += l
+			}
+			sref, err := e.receiveJSON(ctx, idx)
+			if err != nil {
+				return blob.Ref{}, errors.Wrap(err, "storing chunk index")
+			}
+			nextLevel = append(nextLevel, sref.Ref)
+			nextLens = append(nextLens, idx.Len)
+		}
+		if len(nextLevel) == 1 {
+			return nextLevel[0], nil
+		}
+		level, lens = nextLevel, nextLens
+	}
+}
+
+// Parses s as a JSON array of refs,
+// or as the root of a chunked tree of them,
+// which is walked to produce the full array.
+func (d *Decoder) readRefArray(ctx context.Context, s []byte) ([]blob.Ref, error) {
+	if t := bytes.TrimSpace(s); len(t) == 0 || t[0] != '{' {
+		var refs []blob.Ref
+		dec := d.newJSONDecoder(bytes.NewReader(s))
+		err := dec.Decode(&refs)
+		if err != nil {
+			if c, ok := ctx.Value(collectorKey{}).(*collector); ok && d.tolerateTruncation {
+				refs, err = salvageRefs(s)
+				if err == nil {
+					c.add(ctx, errors.Wrapf(ErrTruncated, "salvaged %d refs", len(refs)))
+					return refs, d.checkRefCount(len(refs))
+				}
+			}
+			return nil, errors.Wrap(err, "JSON-decoding blobref array")
+		}
+		return refs, d.checkRefCount(len(refs))
+	}
+
+	if _, ok := parseScalarValues(s); ok {
+		return nil, errors.New("blob holds inline scalar values, not blobrefs")
+	}
+
+	var idx chunkIndex
+	dec := d.newJSONDecoder(bytes.NewReader(s))
+	err := dec.Decode(&idx)
+	if err != nil {
+		return nil, errors.Wrap(err, "JSON-decoding chunk index")
+	}
+	if err := d.checkRefCount(idx.Len); err != nil {
+		return nil, err
+	}
+	var refs []blob.Ref
+	for _, chunkRef := range idx.Chunks {
+		chunk, err := d.fetchStructure(ctx, chunkRef)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching chunk %s", chunkRef)
+		}
+		chunkRefs, err := d.readRefArray(ctx, chunk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading chunk %s", chunkRef)
+		}
+		refs = append(refs, chunkRefs...)
+		if len(refs) > idx.Len {
+			return nil, errors.Errorf("chunk index promised %d refs, found more", idx.Len)
+		}
+	}
+	if len(refs) != idx.Len {
+		return nil, errors.Errorf("chunk index promised %d refs, found %d", idx.Len, len(refs))
+	}
+	return refs, nil
+}
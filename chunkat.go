@@ -0,0 +1,161 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/schema"
+)
+
+// chunkedField is how a field with the "chunkat" option
+// whose value exceeds the option's size
+// appears in its struct's JSON object:
+// with the ref of a Perkeep file or bytes schema blob holding the value,
+// rather than with the ref of a blob of the value itself.
+// Exactly one of File and Bytes is set.
+type chunkedField struct {
+	File  *blob.Ref `json:"file,omitempty"`
+	Bytes *blob.Ref `json:"bytes,omitempty"`
+}
+
+// SetBytesSchema controls the kind of Perkeep schema blob
+// in which Encode stores the large values of fields with the "chunkat" option.
+// By default it is a file schema,
+// with an empty file name.
+// When b is true it is instead the lighter "bytes" schema,
+// which describes the same chunks but carries no file metadata,
+// and the field's JSON is {"bytes": ref} rather than {"file": ref}.
+// A Decoder reads either form.
+func (e *Encoder) SetBytesSchema(b bool) {
+	e.bytesSchema = b
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+
+// Tells whether a field with type t and tag options o
+// is a string or []byte to be stored as a file schema when large.
+func isChunkable(t reflect.Type, o options) bool {
+	return o.ChunkAt > 0 && (t.Kind() == reflect.String || (t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8))
+}
+
+// Parses a size like "4096", "64k", or "4m"
+// (with the suffixes k, m, and g, in either case, denoting powers of 1024).
+func parseSize(s string) (int64, bool) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "g"), strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 1 || n > (1<<62)/mult {
+		return 0, false
+	}
+	return n * mult, true
+}
+
+// Stores v, the value of a string or []byte field with the "chunkat" option.
+// Up to limit bytes, it is stored as a single blob, and its ref is returned;
+// above that, it is stored as a file or bytes schema, and a chunkedField is returned.
+func (e *Encoder) encodeChunkable(ctx context.Context, v reflect.Value, limit int64) (interface{}, error) {
+	var content []byte
+	if v.Kind() == reflect.String {
+		content = []byte(v.String())
+	} else {
+		content = v.Bytes()
+	}
+	if int64(len(content)) <= limit {
+		sref, err := e.receiveString(ctx, string(content))
+		return sref.Ref, err
+	}
+
+	var dst blobserver.StatReceiver
+	if e.dryRunFor(ctx) {
+		dst = discardReceiver{}
+	} else {
+		var ok bool
+		dst, ok = e.dst.(blobserver.StatReceiver)
+		if !ok {
+			return nil, errors.New("chunked field requires a BlobReceiver that is also a BlobStatter")
+		}
+	}
+	dst = recordingStatReceiver(ctx, dst)
+	if e.bytesSchema {
+		ref, err := schema.WriteFileMap(ctx, dst, schema.NewBytes(), bytes.NewReader(content))
+		if err != nil {
+			return nil, errors.Wrap(err, "storing bytes schema")
+		}
+		return chunkedField{Bytes: &ref}, nil
+	}
+	ref, err := schema.WriteFileMap(ctx, dst, schema.NewFileMap(""), bytes.NewReader(content))
+	if err != nil {
+		return nil, errors.Wrap(err, "storing file schema")
+	}
+	return chunkedField{File: &ref}, nil
+}
+
+// Decodes raw, the JSON for a field with the "chunkat" option,
+// into field.
+// An absent field (with empty raw) leaves field untouched.
+func (d *Decoder) decodeChunkable(ctx context.Context, raw json.RawMessage, field reflect.Value) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	var content []byte
+	if t := bytes.TrimSpace(raw); len(t) > 0 && t[0] == '{' {
+		var cf chunkedField
+		if err := json.Unmarshal(raw, &cf); err != nil {
+			return errors.Wrap(err, "JSON-decoding chunked field")
+		}
+		ref := cf.File
+		if ref == nil {
+			ref = cf.Bytes
+		}
+		if ref == nil {
+			return errors.New("chunked field has no schema ref")
+		}
+		// NewFileReader reads both file and bytes schemas.
+		fr, err := schema.NewFileReader(ctx, d.source(), *ref)
+		if err != nil {
+			return errors.Wrapf(err, "reading schema %s", *ref)
+		}
+		defer fr.Close()
+		content, err = ioutil.ReadAll(fr)
+		if err != nil {
+			return errors.Wrapf(err, "reading contents of %s", *ref)
+		}
+	} else {
+		var ref blob.Ref
+		if err := json.Unmarshal(raw, &ref); err != nil {
+			return errors.Wrap(err, "JSON-decoding blobref")
+		}
+		if !ref.Valid() {
+			return nil
+		}
+		s, err := d.fetch(ctx, ref)
+		if err != nil {
+			return err
+		}
+		content = s
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(string(content))
+	} else {
+		field.SetBytes(append([]byte(nil), content...))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package pk
+
+import (
+	"math/big"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var decimalRegex = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// Parses s as an exact whole number for SetNumericCoercion.
+func coerceWhole(s string) (*big.Int, error) {
+	if !decimalRegex.MatchString(s) {
+		return nil, errors.Errorf("%q is not a decimal number", s)
+	}
+	// Guard against huge exponents before computing exactly.
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		return nil, errors.Wrapf(err, "parsing %q", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, errors.Errorf("%q is not a decimal number", s)
+	}
+	if !r.IsInt() {
+		return nil, errors.Errorf("%q has a nonzero fractional part", s)
+	}
+	return r.Num(), nil
+}
+
+func coerceInt(s string, bits int) (int64, error) {
+	n, err := coerceWhole(s)
+	if err != nil {
+		return 0, err
+	}
+	if !n.IsInt64() {
+		return 0, errors.Errorf("%q out of range for %d-bit integer", s, bits)
+	}
+	i := n.Int64()
+	if shift := 64 - uint(bits); i<<shift>>shift != i {
+		return 0, errors.Errorf("%q out of range for %d-bit integer", s, bits)
+	}
+	return i, nil
+}
+
+func coerceUint(s string, bits int) (uint64, error) {
+	n, err := coerceWhole(s)
+	if err != nil {
+		return 0, err
+	}
+	if n.Sign() < 0 || n.BitLen() > bits {
+		return 0, errors.Errorf("%q out of range for %d-bit unsigned integer", s, bits)
+	}
+	return n.Uint64(), nil
+}
@@ -0,0 +1,100 @@
+package pk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/constants"
+)
+
+// SetStructuralCompression tells whether the Encoder should gzip-compress
+// the structural blobs it writes:
+// the JSON blobs of structs, slices, arrays, maps, and interface values
+// (including chunk indexes, map shards, and log entries),
+// which consist mostly of verbose blobrefs.
+// Leaf blobs (strings, numbers, and so on)
+// are still written uncompressed,
+// so that they remain readable and shareable,
+// as are readable-root summaries (see SetReadableRoot)
+// and manifests (see EncodeWithManifest).
+//
+// A compressed blob is recognized by the gzip header it begins with,
+// which no JSON text can begin with,
+// so decoding reads structural blobs correctly regardless of this setting.
+// Compression changes the refs of structural blobs,
+// and so of everything above them in the tree.
+// By default structural blobs are not compressed.
+func (e *Encoder) SetStructuralCompression(val bool) {
+	e.compressStructure = val
+}
+
+// gzipMagic begins every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Stores s, the JSON of a structural blob,
+// compressing it if the Encoder is so configured.
+func (e *Encoder) receiveStructure(ctx context.Context, s string) (blob.SizedRef, error) {
+	if !e.compressStructure {
+		return e.receiveString(ctx, s)
+	}
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		return blob.SizedRef{}, errors.Wrap(err, "compressing structural blob")
+	}
+	if err := w.Close(); err != nil {
+		return blob.SizedRef{}, errors.Wrap(err, "compressing structural blob")
+	}
+	return e.receiveString(ctx, buf.String())
+}
+
+// Returns the JSON of the structural blob s,
+// decompressing it if necessary.
+func unpackStructure(s []byte) ([]byte, error) {
+	if !bytes.HasPrefix(s, gzipMagic) {
+		return s, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(s))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing structural blob")
+	}
+	defer r.Close()
+
+	// Guard against a small blob that decompresses to something huge.
+	result, err := ioutil.ReadAll(io.LimitReader(r, constants.MaxBlobSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing structural blob")
+	}
+	if len(result) > constants.MaxBlobSize {
+		return nil, errors.Errorf("decompressed structural blob exceeds %d bytes", constants.MaxBlobSize)
+	}
+	return result, nil
+}
+
+// Fetches the structural blob at ref,
+// decompressing it if necessary.
+func (d *Decoder) fetchStructure(ctx context.Context, ref blob.Ref) ([]byte, error) {
+	s, err := d.fetch(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return unpackStructure(s)
+}
+
+// Tells whether values of type t are stored as structural blobs,
+// which may be compressed.
+func isStructural(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.Interface:
+		return true
+	case reflect.Struct:
+		return !isRefType(t) && t != timeType
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package pk
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// computeMethodPrefix prefixes the name of the method supplying a computed field's value.
+// (A method cannot have the same name as a field.)
+const computeMethodPrefix = "Compute"
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Calls the method that computes the value of field i of struct v,
+// which has the "compute" option.
+// For a field named F of type T, this is a method named ComputeF,
+// with no arguments,
+// returning either T or (T, error).
+// It may have a value or pointer receiver.
+func computeField(v reflect.Value, i int) (reflect.Value, error) {
+	t := v.Type()
+	tf := t.Field(i)
+	name := computeMethodPrefix + tf.Name
+
+	m := v.MethodByName(name)
+	if !m.IsValid() {
+		if _, ok := reflect.PtrTo(t).MethodByName(name); ok {
+			// Pointer receiver.
+			var p reflect.Value
+			if v.CanAddr() {
+				p = v.Addr()
+			} else {
+				p = reflect.New(t)
+				p.Elem().Set(v)
+			}
+			m = p.MethodByName(name)
+		}
+	}
+	if !m.IsValid() {
+		return reflect.Value{}, errors.Errorf("computed field %s of %s: no method %s", tf.Name, t, name)
+	}
+
+	mt := m.Type()
+	ok := mt.NumIn() == 0 && mt.NumOut() >= 1 && mt.NumOut() <= 2 && mt.Out(0).AssignableTo(tf.Type)
+	if ok && mt.NumOut() == 2 {
+		ok = mt.Out(1) == errorType
+	}
+	if !ok {
+		return reflect.Value{}, errors.Errorf("computed field %s of %s: method %s has type %s, want func() %s or func() (%s, error)", tf.Name, t, name, mt, tf.Type, tf.Type)
+	}
+
+	out := m.Call(nil)
+	if len(out) == 2 && !out[1].IsNil() {
+		return reflect.Value{}, errors.Wrapf(out[1].Interface().(error), "computing field %s of %s", tf.Name, t)
+	}
+	result := reflect.New(tf.Type).Elem()
+	result.Set(out[0])
+	return result, nil
+}
@@ -0,0 +1,76 @@
+package pk
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	"perkeep.org/pkg/blob"
+)
+
+// Context keys for per-call overrides of Encoder settings,
+// and for per-call state.
+type (
+	concurrencyKey struct{}
+	dryRunKey      struct{}
+	manifestKey    struct{}
+	progressKey    struct{}
+	semKey         struct{}
+)
+
+// WithContextConcurrency returns a context that overrides
+// the concurrency limit of any Encoder it is passed to.
+// See Encoder.SetConcurrency.
+func WithContextConcurrency(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, concurrencyKey{}, n)
+}
+
+// WithContextDryRun returns a context that overrides
+// the dry-run setting of any Encoder it is passed to.
+// See Encoder.SetDryRun.
+func WithContextDryRun(ctx context.Context, val bool) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, val)
+}
+
+// WithContextProgress returns a context that overrides
+// the progress callback of any Encoder it is passed to.
+// See Encoder.SetProgress.
+func WithContextProgress(ctx context.Context, f func(blob.SizedRef)) context.Context {
+	return context.WithValue(ctx, progressKey{}, f)
+}
+
+func (e *Encoder) concurrencyFor(ctx context.Context) int {
+	if n, ok := ctx.Value(concurrencyKey{}).(int); ok {
+		return n
+	}
+	return e.concurrency
+}
+
+func (e *Encoder) dryRunFor(ctx context.Context) bool {
+	if val, ok := ctx.Value(dryRunKey{}).(bool); ok {
+		return val
+	}
+	return e.dryRun
+}
+
+func (e *Encoder) progressFor(ctx context.Context) func(blob.SizedRef) {
+	if f, ok := ctx.Value(progressKey{}).(func(blob.SizedRef)); ok {
+		return f
+	}
+	return e.progress
+}
+
+// discardReceiver is a BlobReceiver that stores nothing.
+type discardReceiver struct{}
+
+func (discardReceiver) ReceiveBlob(ctx context.Context, ref blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	n, err := io.Copy(ioutil.Discard, source)
+	return blob.SizedRef{Ref: ref, Size: uint32(n)}, err
+}
+
+// StatBlobs reports no blobs,
+// so that writers checking for existing blobs (such as schema.WriteFileMap)
+// send them all.
+func (discardReceiver) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	return nil
+}
@@ -3,12 +3,16 @@ package pk
 import (
 	"bytes"
 	"context"
+	"encoding"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"perkeep.org/pkg/blob"
@@ -17,21 +21,219 @@ import (
 // Decoder is an object that can unmarshal data into Go data structures from a Perkeep server.
 type Decoder struct {
 	src blob.Fetcher
+
+	onMissing MissingBlobHandler
+
+	retry retrier
+
+	lenientNumbers     bool
+	numericCoercion    bool
+	strictArrayLengths bool
+	tolerateTruncation bool
+	refPassthrough     bool
+	verifyRefs         bool
+
+	cache *lruCache[[]byte]
+
+	errMode ErrorMode
+
+	strictTags bool
+
+	legacyNames bool
+
+	protoNames bool
+	jsonNames  bool
+
+	caseSensitive bool
+
+	maxRefs int
+
+	maxOps int
+
+	interner StringInterner
+
+	cipher FieldCipher
+
+	permanodeAttrs PermanodeAttrsFunc
+
+	verify VerifyFunc
+
+	resolver TypeResolver
+
+	versions map[reflect.Type]*versionSet
 }
 
+// MissingBlobHandler is the type of a callback that a Decoder invokes
+// when a blob it needs is not present in its source.
+// It receives the missing ref
+// and the type of the Go value that was to be decoded from it.
+//
+// If handled is true,
+// val (if valid) is used in place of the missing blob's decoded value;
+// an invalid (zero) reflect.Value leaves the destination untouched.
+// If handled is false,
+// decoding fails with the original not-found error.
+type MissingBlobHandler func(ref blob.Ref, dst reflect.Type) (val reflect.Value, handled bool, err error)
+
 // NewDecoder creates a new Decoder reading from src, a Perkeep server.
 func NewDecoder(src blob.Fetcher) *Decoder {
 	return &Decoder{src: src}
 }
 
+// SetMissingBlobHandler installs a callback to consult
+// when a referenced blob cannot be found in the source.
+// This permits partial decoding of incomplete trees,
+// e.g. in eventually-consistent stores.
+// By default (or with a nil handler) a missing blob is an error.
+func (d *Decoder) SetMissingBlobHandler(h MissingBlobHandler) {
+	d.onMissing = h
+}
+
+// SetRetry causes each blob fetch to be retried,
+// up to a total of attempts tries,
+// when it fails with a transient error
+// (as classified by IsTransient, or by the function given to SetIsTransient).
+// Before retry number n (starting at 1), the Decoder waits for backoff(n),
+// or until its context is canceled.
+// A nil backoff retries immediately.
+// By default, and when attempts is less than 2, fetches are not retried.
+func (d *Decoder) SetRetry(attempts int, backoff func(attempt int) time.Duration) {
+	d.retry.attempts, d.retry.backoff = attempts, backoff
+}
+
+// SetIsTransient sets the function that decides,
+// when retries are enabled with SetRetry,
+// whether a failed blob fetch should be retried.
+// The default (also selected by a nil f) is IsTransient.
+func (d *Decoder) SetIsTransient(f func(error) bool) {
+	d.retry.isTransient = f
+}
+
+// DefaultMaxRefArrayLen is the default limit on the number of entries
+// a Decoder accepts in a single slice, array, or map.
+// See SetMaxRefArrayLen.
+const DefaultMaxRefArrayLen = 1 << 24
+
+// SetMaxRefArrayLen limits the number of entries the Decoder accepts
+// in any one slice, array, or map
+// (including a chunked one, in total),
+// to bound the fetching and memory use
+// that a maliciously crafted tree could cause.
+// A container with more entries produces ErrTooManyRefs
+// before any of its elements are decoded.
+// With n less than 1,
+// and by default,
+// the limit is DefaultMaxRefArrayLen.
+func (d *Decoder) SetMaxRefArrayLen(n int) {
+	d.maxRefs = n
+}
+
+// Returns ErrTooManyRefs if n exceeds the Decoder's limit.
+func (d *Decoder) checkRefCount(n int) error {
+	max := d.maxRefs
+	if max < 1 {
+		max = DefaultMaxRefArrayLen
+	}
+	if n > max {
+		return errors.Wrapf(ErrTooManyRefs, "%d entries exceeds limit of %d", n, max)
+	}
+	return nil
+}
+
+// SetLenientNumbers tells whether leading and trailing whitespace
+// should be ignored in blobs decoded as integers and floats.
+// This helps interoperate with external tools that append newlines.
+// By default numbers are parsed strictly.
+func (d *Decoder) SetLenientNumbers(val bool) {
+	d.lenientNumbers = val
+}
+
+// SetNumericCoercion tells whether a blob written as a floating-point number
+// may be decoded into an integer destination,
+// easing schema evolution from float to integer types.
+// With coercion enabled,
+// a blob that does not parse as an integer
+// is parsed as a decimal number
+// (with optional fraction and exponent, as in "3.0" or "3e2")
+// and accepted if its value, computed exactly, is a whole number
+// in range for the destination type.
+// No rounding is ever done:
+// a value with a nonzero fractional part (like "3.5"),
+// or one out of range (including a negative value for an unsigned type),
+// is an error.
+// NaN and infinities are errors too.
+// Float destinations are unaffected, since they already accept integers.
+// By default numeric coercion is disabled.
+func (d *Decoder) SetNumericCoercion(val bool) {
+	d.numericCoercion = val
+}
+
+// SetStrictArrayLengths tells whether decoding an array blob into a Go array
+// requires them to have the same number of elements.
+// With strict lengths,
+// a mismatch produces ErrArrayLength,
+// which catches corrupt or mistyped blobs,
+// including at every level of nested arrays such as [3][2]int.
+// By default lengths need not match:
+// extra elements in the blob are ignored,
+// and missing ones are left as zero values,
+// easing changes to an array type's length.
+func (d *Decoder) SetStrictArrayLengths(val bool) {
+	d.strictArrayLengths = val
+}
+
+// SetRefPassthrough tells whether a blob.Ref destination
+// may stand in for a value of any type.
+// Normally a blob.Ref is decoded from a blob holding a blobref,
+// as written when encoding a blob.Ref,
+// and any other blob is an error.
+// With passthrough,
+// a blob that does not hold a blobref
+// (such as the blob of a struct, map, or slice, or an interface's type hint)
+// leaves its own ref in the destination instead.
+//
+// This lets a program decode the parts of a tree it understands
+// and keep handles to the rest:
+// a struct field of type blob.Ref captures the ref of the sub-object stored in that field,
+// which can be decoded later with a destination of the right type.
+// The elements of slice and map fields are listed in their struct's own blob,
+// so handles to those are kept with a destination like []blob.Ref or map[string]blob.Ref.
+// (The empty blob still decodes as the zero blob.Ref.)
+// By default passthrough is disabled.
+func (d *Decoder) SetRefPassthrough(val bool) {
+	d.refPassthrough = val
+}
+
 var reftype = reflect.TypeOf(blob.Ref{})
 
+// Tells whether t is blob.Ref
+// (or an alias for it, which is the same type),
+// or a defined type whose underlying type is blob.Ref's,
+// like "type ObjectID blob.Ref".
+func isRefType(t reflect.Type) bool {
+	return t == reftype || (t.Kind() == reflect.Struct && t.ConvertibleTo(reftype))
+}
+
 // Decode decodes the Perkeep blob or blobs rooted at ref,
 // unmarshaling into obj, which must be a non-nil pointer.
 // See Unmarshal for more information.
 func (d *Decoder) Decode(ctx context.Context, ref blob.Ref, obj interface{}) error {
+	ctx = d.withBudget(ctx)
+
+	if (d.errMode == Collect || d.tolerateTruncation) && ctx.Value(collectorKey{}) == nil {
+		c := &collector{skip: d.errMode == Collect}
+		err := d.Decode(context.WithValue(ctx, collectorKey{}, c), ref, obj)
+		if err != nil {
+			return err
+		}
+		return c.err()
+	}
+
+	if u, ok := obj.(UnmarshalerWithDecoder); ok {
+		return u.PkUnmarshalWithDecoder(ctx, d, ref)
+	}
 	if u, ok := obj.(Unmarshaler); ok {
-		return u.PkUnmarshal(ctx, d.src, ref)
+		return u.PkUnmarshal(ctx, d.source(), ref)
 	}
 
 	v := reflect.ValueOf(obj)
@@ -43,280 +245,743 @@ func (d *Decoder) Decode(ctx context.Context, ref blob.Ref, obj interface{}) err
 		return ErrNilPointer
 	}
 
-	r, size, err := d.src.Fetch(ctx, ref)
-	if err != nil {
-		return errors.Wrapf(err, "fetching %s from src", ref)
-	}
-	defer r.Close()
+	elTyp := t.Elem()
 
-	s, err := ioutil.ReadAll(r)
+	s, err := d.fetch(ctx, ref)
 	if err != nil {
-		return errors.Wrapf(err, "reading body of %s", ref)
+		if handled, herr := d.handleMissing(ref, v, err); handled || herr != nil {
+			return herr
+		}
+		return err
+	}
+	if d.permanodeAttrs != nil && elTyp.Kind() == reflect.Struct && isPermanode(s) {
+		return d.decodePermanode(ctx, ref, v.Elem())
+	}
+	if isStructural(elTyp) {
+		s, err = unpackStructure(s)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", ref)
+		}
 	}
 
-	elTyp := t.Elem()
+	switch elTyp.Kind() {
+	case reflect.Map, reflect.Slice:
+		if len(s) == 0 {
+			// Nil maps and slices are marshaled as the empty blob.
+			v.Elem().Set(reflect.Zero(elTyp))
+			return nil
+		}
+	}
 
 	switch elTyp.Kind() {
-	case reflect.Bool:
-		p := obj.(*bool)
-		*p = (size > 0)
-		return nil
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return d.setScalar(v.Elem(), s)
 
-	case reflect.Int:
-		n, err := strconv.ParseInt(string(s), 10, 0)
+	case reflect.Array:
+		if vals, ok := parseScalarValues(s); ok {
+			return d.setScalarValues(v.Elem(), vals)
+		}
+		refs, err := d.readRefArray(ctx, s)
 		if err != nil {
-			return errors.Wrapf(err, "parsing int from %s", string(s))
+			return errors.Wrap(err, "reading blobref array")
 		}
-		p := obj.(*int)
-		*p = int(n)
-		return nil
+		arr := v.Elem()
+		return d.buildArray(ctx, arr, refs)
 
-	case reflect.Int8:
-		n, err := strconv.ParseInt(string(s), 10, 8)
+	case reflect.Slice:
+		if vals, ok := parseScalarValues(s); ok {
+			return d.setScalarValues(v.Elem(), vals)
+		}
+		refs, err := d.readRefArray(ctx, s)
 		if err != nil {
-			return errors.Wrapf(err, "parsing int8 from %s", string(s))
+			return errors.Wrap(err, "reading blobref slice")
 		}
-		p := obj.(*int8)
-		*p = int8(n)
-		return nil
-
-	case reflect.Int16:
-		n, err := strconv.ParseInt(string(s), 10, 16)
+		slice := v.Elem()
+		slice, err = d.buildSlice(ctx, slice, refs)
 		if err != nil {
-			return errors.Wrapf(err, "parsing int16 from %s", string(s))
+			return err
 		}
-		p := obj.(*int16)
-		*p = int16(n)
+		if slice.IsNil() {
+			// Only a nil slice is stored as the empty blob.
+			slice = reflect.MakeSlice(elTyp, 0, 0)
+		}
+		v.Elem().Set(slice)
 		return nil
 
-	case reflect.Int32:
-		n, err := strconv.ParseInt(string(s), 10, 32)
+	case reflect.Map:
+		mm, err := d.readRefMap(ctx, s, elTyp.Key())
 		if err != nil {
-			return errors.Wrapf(err, "parsing int32 from %s", string(s))
+			return errors.Wrap(err, "reading blobref map")
 		}
-		p := obj.(*int32)
-		*p = int32(n)
-		return nil
+		return d.buildMap(ctx, v.Elem(), mm)
 
-	case reflect.Int64:
-		n, err := strconv.ParseInt(string(s), 10, 64)
-		if err != nil {
-			return errors.Wrapf(err, "parsing int64 from %s", string(s))
+	case reflect.Struct:
+		if om, ok := obj.(orderedMapDecoder); ok {
+			return d.decodeOrderedMap(ctx, s, om)
+		}
+		if isRefType(elTyp) {
+			var parsed blob.Ref
+			if len(s) > 0 {
+				var ok bool
+				parsed, ok = blob.Parse(string(s))
+				if !ok {
+					if !d.refPassthrough {
+						return errors.Errorf("parsing blobref from %s", string(s))
+					}
+					// The blob of some other value; keep a handle to it.
+					parsed = ref
+				}
+			}
+			v.Elem().Set(reflect.ValueOf(parsed).Convert(elTyp))
+			return nil
+		}
+		if elTyp == timeType {
+			tm, err := time.Parse(time.RFC3339Nano, string(s))
+			if err != nil {
+				return errors.Wrapf(err, "parsing time from %s", string(s))
+			}
+			v.Elem().Set(reflect.ValueOf(tm))
+			return nil
+		}
+		if isNetipType(elTyp) {
+			err := obj.(encoding.TextUnmarshaler).UnmarshalText(s)
+			return errors.Wrapf(err, "parsing %s from %s", elTyp, string(s))
 		}
-		p := obj.(*int64)
-		*p = n
-		return nil
 
-	case reflect.Uint:
-		n, err := strconv.ParseUint(string(s), 10, 0)
+		s, err = d.checkSignature(ctx, ref, s)
+		if err != nil {
+			return err
+		}
+		selfs, err := selfFields(elTyp)
+		if err != nil {
+			return err
+		}
+		if f := chainField(elTyp); f >= 0 {
+			return d.decodeChain(ctx, ref, s, v.Elem(), f, selfs)
+		}
+		if vs := d.versions[elTyp]; vs != nil {
+			err = d.decodeVersioned(ctx, s, v.Elem(), vs, nil)
+		} else {
+			err = d.decodeStruct(ctx, s, v.Elem(), nil)
+		}
 		if err != nil {
-			return errors.Wrapf(err, "parsing uint from %s", string(s))
+			return err
 		}
-		p := obj.(*uint)
-		*p = uint(n)
+		setSelfRefs(v.Elem(), selfs, ref)
 		return nil
 
-	case reflect.Uint8:
-		n, err := strconv.ParseUint(string(s), 10, 8)
+	case reflect.Interface:
+		if len(s) == 0 {
+			v.Elem().Set(reflect.Zero(elTyp))
+			return nil
+		}
+		if ref, ok := blob.Parse(string(s)); ok && reftype.AssignableTo(elTyp) {
+			// A blob.Ref stored without a type hint.
+			v.Elem().Set(reflect.ValueOf(ref))
+			return nil
+		}
+		var hint typeHint
+		dec := d.newJSONDecoder(bytes.NewReader(s))
+		err := dec.Decode(&hint)
 		if err != nil {
-			return errors.Wrapf(err, "parsing uint8 from %s", string(s))
+			return errors.Wrap(err, "JSON-decoding type hint")
 		}
-		p := obj.(*uint8)
-		*p = uint8(n)
+		typ, err := d.resolveType(hint.Type)
+		if err != nil {
+			return err
+		}
+		if !typ.AssignableTo(elTyp) {
+			return errors.Errorf("registered type %s is not assignable to %s", typ, elTyp)
+		}
+		newVal, err := newValue(typ)
+		if err != nil {
+			return err
+		}
+		err = d.Decode(ctx, hint.Ref, newVal.Interface())
+		if err != nil {
+			return errors.Wrapf(err, "decoding value of type %s", hint.Type)
+		}
+		v.Elem().Set(newVal.Elem())
 		return nil
 
-	case reflect.Uint16:
-		n, err := strconv.ParseUint(string(s), 10, 16)
-		if err != nil {
-			return errors.Wrapf(err, "parsing uint16 from %s", string(s))
+	case reflect.Ptr:
+		ptr := v.Elem()
+		if len(s) == 0 && !mayBeEmpty(elTyp.Elem()) {
+			// A nil pointer.
+			ptr.Set(reflect.Zero(elTyp))
+			return nil
+		}
+		if ptr.IsNil() {
+			newItem, err := newValue(elTyp.Elem())
+			if err != nil {
+				return err
+			}
+			v.Elem().Set(newItem)
 		}
-		p := obj.(*uint16)
-		*p = uint16(n)
+		// Recursively unmarshal into the thing ptr points to.
+		return d.Decode(ctx, ref, ptr.Interface())
+
+	default:
+		return ErrUnsupportedType{Name: elTyp.String()}
+	}
+}
+
+// Tells whether k is a boolean, numeric, or string kind.
+func isScalarKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// Sets v, which has a boolean, numeric, or string kind,
+// from the blob s.
+func (d *Decoder) setScalar(v reflect.Value, s []byte) error {
+	t := v.Type()
+	switch t.Kind() {
+	case reflect.Bool:
+		v.SetBool(len(s) > 0)
 		return nil
 
-	case reflect.Uint32:
-		n, err := strconv.ParseUint(string(s), 10, 32)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := enumValue(t, string(s)); ok {
+			v.SetInt(n)
+			return nil
+		}
+		n, err := strconv.ParseInt(d.numeric(s), 10, t.Bits())
+		if err != nil && d.numericCoercion {
+			n, err = coerceInt(d.numeric(s), t.Bits())
+		}
 		if err != nil {
-			return errors.Wrapf(err, "parsing uint32 from %s", string(s))
+			return errors.Wrapf(err, "parsing %s from %s", t, string(s))
 		}
-		p := obj.(*uint32)
-		*p = uint32(n)
+		v.SetInt(n)
 		return nil
 
-	case reflect.Uint64:
-		n, err := strconv.ParseUint(string(s), 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(d.numeric(s), 10, t.Bits())
+		if err != nil && d.numericCoercion {
+			n, err = coerceUint(d.numeric(s), t.Bits())
+		}
 		if err != nil {
-			return errors.Wrapf(err, "parsing uint64 from %s", string(s))
+			return errors.Wrapf(err, "parsing %s from %s", t, string(s))
 		}
-		p := obj.(*uint64)
-		*p = n
+		v.SetUint(n)
 		return nil
 
-	case reflect.Float32:
-		f, err := strconv.ParseFloat(string(s), 32)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(d.numeric(s), t.Bits())
 		if err != nil {
-			return errors.Wrapf(err, "parsing float32 from %s", string(s))
+			return errors.Wrapf(err, "parsing %s from %s", t, string(s))
 		}
-		p := obj.(*float32)
-		*p = float32(f)
+		v.SetFloat(f)
 		return nil
 
-	case reflect.Float64:
-		f, err := strconv.ParseFloat(string(s), 64)
-		if err != nil {
-			return errors.Wrapf(err, "parsing float64 from %s", string(s))
+	case reflect.String:
+		if t == numberType {
+			n := d.numeric(s)
+			if !isJSONNumber(n) {
+				return errors.Errorf("invalid json.Number %q", n)
+			}
+			v.SetString(n)
+			return nil
 		}
-		p := obj.(*float64)
-		*p = f
+		v.SetString(d.str(s))
 		return nil
+	}
+	return ErrUnsupportedType{Name: t.String()}
+}
 
-	case reflect.Array:
-		var refs []blob.Ref
-		dec := d.newJSONDecoder(bytes.NewReader(s))
-		err := dec.Decode(&refs)
+// Decodes the struct blob s into structVal.
+// If link is not nil,
+// the field it names is not decoded;
+// instead the field's ref is recorded in the link.
+func (d *Decoder) decodeStruct(ctx context.Context, s []byte, structVal reflect.Value, link *chainLink) error {
+	elTyp := structVal.Type()
+
+	if d.strictTags {
+		if err := checkTags(elTyp); err != nil {
+			return err
+		}
+	}
+
+	if prefixes := groupPrefixes(elTyp); len(prefixes) > 0 {
+		var err error
+		s, err = flattenDottedKeys(s, prefixes)
 		if err != nil {
-			return errors.Wrap(err, "JSON-decoding blobref array")
+			return errors.Wrap(err, "ungrouping fields")
 		}
-		arr := v.Elem()
-		return d.buildArray(ctx, arr, refs)
+	}
 
-	case reflect.Slice:
-		var refs []blob.Ref
-		dec := d.newJSONDecoder(bytes.NewReader(s))
-		err := dec.Decode(&refs)
+	if d.protoNames || d.jsonNames {
+		var err error
+		s, err = renameFromFallbackKeys(s, fallbackRenames(elTyp, d.protoNames, d.jsonNames))
 		if err != nil {
-			return errors.Wrap(err, "JSON-decoding blobref slice")
+			return errors.Wrap(err, "renaming fields from their tags")
 		}
-		slice := v.Elem()
-		slice, err = d.buildSlice(ctx, slice, refs)
+	}
+
+	if d.legacyNames {
+		var err error
+		s, err = renameLegacyKeys(s, elTyp)
 		if err != nil {
-			return err
+			return errors.Wrap(err, "renaming legacy fields")
 		}
-		v.Elem().Set(slice)
-		return nil
+	}
 
-	case reflect.Map:
-		kt := elTyp.Key()
-		mt := reflect.MapOf(kt, reftype)
-		mm := reflect.New(mt)
-		dec := d.newJSONDecoder(bytes.NewReader(s))
-		err := dec.Decode(mm.Interface())
+	defaults, err := defaultsFor(elTyp)
+	if err != nil {
+		return err
+	}
+	refOfs, err := refOfFields(elTyp)
+	if err != nil {
+		return err
+	}
+
+	// The JSON from which encoding/json fills in the fields.
+	// Unlike s, it excludes keys that match fields only when ignoring case,
+	// if the Decoder requires exact matches.
+	fieldJSON := s
+	if d.caseSensitive {
+		fieldJSON, err = dropCaseFoldedKeys(s, elTyp)
 		if err != nil {
-			return errors.Wrap(err, "JSON-decoding map[K]blob.Ref")
+			return errors.Wrap(err, "matching field names")
 		}
-		return d.buildMap(ctx, v.Elem(), mm.Elem())
+	}
 
-	case reflect.String:
-		p := obj.(*string)
-		*p = string(s)
-		return nil
+	if hasInlineScalarsKey(s) && isScalarStruct(elTyp) {
+		err = d.decodeInlineScalarStruct(fieldJSON, structVal)
+		if err != nil || defaults == nil {
+			return err
+		}
+		return applyDefaults(elTyp, defaults, s, structVal)
+	}
 
-	case reflect.Struct:
-		// Construct an intermediate struct type for JSON-unmarshaling into.
-
-		var ftypes []reflect.StructField
-		for i := 0; i < elTyp.NumField(); i++ {
-			tf := elTyp.Field(i)
-			name, o := parseTag(tf)
-			tf.Tag = reflect.StructTag(fmt.Sprintf(`%s json:"%s"`, tf.Tag, name))
-			if o.omit || o.inline {
+	extra := extraMapField(elTyp)
+
+	// Construct an intermediate struct type for JSON-unmarshaling into.
+
+	var ftypes []reflect.StructField
+	for i := 0; i < elTyp.NumField(); i++ {
+		tf := elTyp.Field(i)
+		name, o := parseTag(tf)
+		// The json key comes first so that it takes precedence over any json tag of the field's own.
+		tf.Tag = reflect.StructTag(fmt.Sprintf(`json:"%s" %s`, name, tf.Tag))
+		if i == extra {
+			// Filled in from the leftover keys below.
+			tf.Tag = `json:"-"`
+			ftypes = append(ftypes, tf)
+			continue
+		}
+		if o.Omit || o.Inline {
+			ftypes = append(ftypes, tf)
+			continue
+		}
+		if isSparseArray(tf.Type, o) {
+			tf.Type = sparseArrayType
+			ftypes = append(ftypes, tf)
+			continue
+		}
+		if isChunkable(tf.Type, o) {
+			tf.Type = rawMessageType
+			ftypes = append(ftypes, tf)
+			continue
+		}
+		if !o.External && !isCompactTimes(tf.Type, o) && !isPacked(tf.Type, o) && !isBitset(tf.Type, o) {
+			switch tf.Type.Kind() {
+			case reflect.Slice:
+				tf.Type = reflect.SliceOf(reftype)
 				ftypes = append(ftypes, tf)
 				continue
-			}
-			if !o.external {
-				switch tf.Type.Kind() {
-				case reflect.Slice:
-					tf.Type = reflect.SliceOf(reftype)
-					ftypes = append(ftypes, tf)
-					continue
 
-				case reflect.Array:
-					tf.Type = reflect.SliceOf(reftype) // sic, not ArrayOf
-					ftypes = append(ftypes, tf)
-					continue
+			case reflect.Array:
+				tf.Type = reflect.SliceOf(reftype) // sic, not ArrayOf
+				ftypes = append(ftypes, tf)
+				continue
 
-				case reflect.Map:
-					tf.Type = reflect.MapOf(tf.Type.Key(), reftype)
-					ftypes = append(ftypes, tf)
-					continue
-				}
+			case reflect.Map:
+				tf.Type = reflect.MapOf(tf.Type.Key(), reftype)
+				ftypes = append(ftypes, tf)
+				continue
 			}
-			tf.Type = reftype
-			ftypes = append(ftypes, tf)
 		}
-		intermediateTyp := reflect.StructOf(ftypes)
-		intermediateStruct := reflect.New(intermediateTyp)
-		dec := d.newJSONDecoder(bytes.NewReader(s))
-		err := dec.Decode(intermediateStruct.Interface())
+		tf.Type = reftype
+		ftypes = append(ftypes, tf)
+	}
+	intermediateTyp := reflect.StructOf(ftypes)
+	intermediateStruct := reflect.New(intermediateTyp)
+	dec := d.newJSONDecoder(bytes.NewReader(fieldJSON))
+	err = dec.Decode(intermediateStruct.Interface())
+	if err != nil {
+		return errors.Wrap(err, "JSON-decoding into intermediate struct")
+	}
+
+	if extra >= 0 {
+		err = d.collectExtra(s, structVal.Field(extra), declaredNames(elTyp, extra))
 		if err != nil {
-			return errors.Wrap(err, "JSON-decoding into intermediate struct")
+			return errors.Wrap(err, "collecting extra keys")
 		}
-
-		structVal := v.Elem()
-		for i := 0; i < elTyp.NumField(); i++ {
-			tf := elTyp.Field(i)
-			name, o := parseTag(tf)
-			if o.omit {
-				continue
+	}
+	for i := 0; i < elTyp.NumField(); i++ {
+		tf := elTyp.Field(i)
+		name, o := parseTag(tf)
+		if o.Omit || o.Self || i == extra {
+			continue
+		}
+		field := structVal.Field(i)
+		ifield := intermediateStruct.Elem().Field(i)
+		fctx := withPathField(ctx, name)
+		if o.Encrypt {
+			fctx = withEncryption(fctx)
+		}
+		if o.Inline {
+			field.Set(ifield)
+			continue
+		}
+		if link != nil && i == link.field {
+			link.next = ifield.Interface().(blob.Ref)
+			continue
+		}
+		if o.RefOf != "" {
+			field.Set(ifield.Convert(tf.Type))
+			continue
+		}
+		if isChunkable(tf.Type, o) {
+			err = d.decodeChunkable(fctx, ifield.Interface().(json.RawMessage), field)
+			if err != nil {
+				return errors.Wrapf(err, "decoding field %s", name)
 			}
-			field := structVal.Field(i)
-			ifield := intermediateStruct.Elem().Field(i)
-			if o.inline {
-				field.Set(ifield)
-				continue
+			continue
+		}
+		if isSparseArray(tf.Type, o) {
+			err = d.buildSparseArray(fctx, field, ifield.Interface().(sparseArray))
+			if err != nil {
+				return errors.Wrapf(err, "building sparse array for field %s", name)
 			}
-			if !o.external {
-				switch tf.Type.Kind() {
-				case reflect.Slice:
-					refs := ifield.Interface().([]blob.Ref)
-					slice, err := d.buildSlice(ctx, field, refs)
-					if err != nil {
-						return errors.Wrapf(err, "building slice for field %s", name)
-					}
-					field.Set(slice)
-					continue
+			continue
+		}
+		if !o.External && !isCompactTimes(tf.Type, o) && !isPacked(tf.Type, o) && !isBitset(tf.Type, o) {
+			switch tf.Type.Kind() {
+			case reflect.Slice:
+				refs := ifield.Interface().([]blob.Ref)
+				slice, err := d.buildSlice(fctx, field, refs)
+				if err != nil {
+					return errors.Wrapf(err, "building slice for field %s", name)
+				}
+				field.Set(slice)
+				continue
 
-				case reflect.Array:
-					refs := ifield.Interface().([]blob.Ref)
-					err = d.buildArray(ctx, field, refs)
-					if err != nil {
-						return errors.Wrapf(err, "building array for field %s", name)
-					}
-					continue
+			case reflect.Array:
+				refs := ifield.Interface().([]blob.Ref)
+				err = d.buildArray(fctx, field, refs)
+				if err != nil {
+					return errors.Wrapf(err, "building array for field %s", name)
+				}
+				continue
 
-				case reflect.Map:
-					err = d.buildMap(ctx, field, ifield)
-					if err != nil {
-						return errors.Wrapf(err, "building map for field %s", name)
-					}
-					continue
+			case reflect.Map:
+				err = d.buildMap(fctx, field, ifield)
+				if err != nil {
+					return errors.Wrapf(err, "building map for field %s", name)
 				}
-			}
-			if ifield.IsZero() {
 				continue
 			}
-			fieldRef := ifield.Interface().(blob.Ref)
-			newFieldVal := reflect.New(tf.Type)
-			err = d.Decode(ctx, fieldRef, newFieldVal.Interface())
+		}
+		if ifield.IsZero() {
+			// Absent, but perhaps named by a refof field.
+			for k, j := range refOfs {
+				if j == i {
+					ifield = intermediateStruct.Elem().Field(k)
+					break
+				}
+			}
+		}
+		if ifield.IsZero() {
+			continue
+		}
+		fieldRef := ifield.Interface().(blob.Ref)
+		if o.Uintptr && tf.Type.Kind() == reflect.Uintptr {
+			s, err := d.fetch(fctx, fieldRef)
+			if err != nil {
+				return errors.Wrapf(err, "fetching uintptr for field %s", name)
+			}
+			n, err := strconv.ParseUint(d.numeric(s), 10, tf.Type.Bits())
 			if err != nil {
-				return errors.Wrapf(err, "decoding ref %s for field %s", fieldRef, name)
+				return errors.Wrapf(err, "parsing uintptr from %s for field %s", string(s), name)
 			}
-			field.Set(newFieldVal.Elem())
+			field.SetUint(n)
+			continue
 		}
-		return nil
+		if isZonedTime(tf.Type, o) {
+			s, err := d.fetch(fctx, fieldRef)
+			if err != nil {
+				return errors.Wrapf(err, "fetching time for field %s", name)
+			}
+			tm, err := parseZonedTime(s)
+			if err != nil {
+				return errors.Wrapf(err, "parsing time for field %s", name)
+			}
+			field.Set(reflect.ValueOf(tm))
+			continue
+		}
+		if isCompactTimes(tf.Type, o) {
+			s, err := d.fetch(fctx, fieldRef)
+			if err != nil {
+				return errors.Wrapf(err, "fetching times for field %s", name)
+			}
+			times, err := parseCompactTimes(s)
+			if err != nil {
+				return errors.Wrapf(err, "parsing times for field %s", name)
+			}
+			field.Set(reflect.ValueOf(times))
+			continue
+		}
+		if isPacked(tf.Type, o) {
+			s, err := d.fetch(fctx, fieldRef)
+			if err != nil {
+				return errors.Wrapf(err, "fetching packed slice for field %s", name)
+			}
+			slice, err := parsePacked(s, tf.Type)
+			if err != nil {
+				return errors.Wrapf(err, "parsing packed slice for field %s", name)
+			}
+			field.Set(slice)
+			continue
+		}
+		if isBitset(tf.Type, o) {
+			s, err := d.fetch(fctx, fieldRef)
+			if err != nil {
+				return errors.Wrapf(err, "fetching bitset for field %s", name)
+			}
+			slice, err := parseBitset(s, tf.Type)
+			if err != nil {
+				return errors.Wrapf(err, "parsing bitset for field %s", name)
+			}
+			field.Set(slice)
+			continue
+		}
+		if isMoney(tf.Type, o) {
+			s, err := d.fetch(fctx, fieldRef)
+			if err != nil {
+				return errors.Wrapf(err, "fetching money value for field %s", name)
+			}
+			if err := parseMoney(string(s), field); err != nil {
+				return errors.Wrapf(err, "parsing field %s", name)
+			}
+			continue
+		}
+		newFieldVal, err := newValue(tf.Type)
+		if err != nil {
+			return errors.Wrapf(err, "allocating field %s", name)
+		}
+		err = d.Decode(fctx, fieldRef, newFieldVal.Interface())
+		if err != nil {
+			return errors.Wrapf(err, "decoding ref %s for field %s", fieldRef, name)
+		}
+		field.Set(newFieldVal.Elem())
+	}
+	if defaults != nil {
+		return applyDefaults(elTyp, defaults, s, structVal)
+	}
+	return nil
+}
 
-	case reflect.Ptr:
-		ptr := v.Elem()
-		if ptr.IsNil() {
-			newItem := reflect.New(elTyp.Elem())
-			v.Elem().Set(newItem)
+// DecodeRefMap reads the map blob at ref
+// (as written by Encoder.EncodeRefMap, or by Encode for any map with string keys,
+// and possibly sharded)
+// and returns its refs without decoding the values they refer to.
+func (d *Decoder) DecodeRefMap(ctx context.Context, ref blob.Ref) (map[string]blob.Ref, error) {
+	ctx = d.withBudget(ctx)
+	s, err := d.fetchStructure(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(s) == 0 {
+		return nil, nil
+	}
+	mm, err := d.readRefMap(ctx, s, reflect.TypeOf(""))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading ref map")
+	}
+	return mm.Interface().(map[string]blob.Ref), nil
+}
+
+// DecodeMapValue decodes into dst (a non-nil pointer)
+// the value for key in the map blob at mapRef,
+// without decoding the map's other values.
+// If the map is sharded (see Encoder.SetMapSharding),
+// only the shard that can hold key is read.
+// The key must be of a type that Marshal accepts as a map key.
+// If the map has no entry for key,
+// DecodeMapValue returns false and leaves dst untouched.
+func (d *Decoder) DecodeMapValue(ctx context.Context, mapRef blob.Ref, key, dst interface{}) (found bool, err error) {
+	if key == nil {
+		return false, errors.New("nil map key")
+	}
+	ctx = d.withBudget(ctx)
+	k := reflect.ValueOf(key)
+	ks, err := mapKeyString(k)
+	if err != nil {
+		return false, err
+	}
+
+	s, err := d.fetchStructure(ctx, mapRef)
+	if err != nil {
+		return false, err
+	}
+	if len(s) == 0 {
+		// A nil map.
+		return false, nil
+	}
+	var refs map[string]blob.Ref
+	if dir, ok := parseShardDir(s); ok {
+		if len(dir.Shards) == 0 {
+			return false, nil
 		}
-		// Recursively unmarshal into the thing ptr points to.
-		return d.Decode(ctx, ref, ptr.Interface())
+		i, err := shardFor(k, len(dir.Shards))
+		if err != nil {
+			return false, err
+		}
+		shard, err := d.readShard(ctx, dir.Shards[i], reflect.TypeOf(refs))
+		if err != nil {
+			return false, err
+		}
+		refs = shard.Interface().(map[string]blob.Ref)
+	} else {
+		dec := d.newJSONDecoder(bytes.NewReader(s))
+		err = dec.Decode(&refs)
+		if err != nil {
+			return false, errors.Wrap(err, "JSON-decoding map[K]blob.Ref")
+		}
+	}
 
-	default:
-		return ErrUnsupportedType{Name: t.Name()}
+	ref, ok := refs[ks]
+	if !ok {
+		return false, nil
+	}
+	err = d.Decode(withPathKey(ctx, key), ref, dst)
+	if err != nil {
+		return false, errors.Wrapf(err, "decoding value for key %v", key)
+	}
+	return true, nil
+}
+
+// Consults the missing-blob handler, if any,
+// when fetching ref for decoding into the pointer v failed with err.
+// It reports whether the handler took care of the missing blob.
+func (d *Decoder) handleMissing(ref blob.Ref, v reflect.Value, err error) (bool, error) {
+	if !os.IsNotExist(errors.Cause(err)) || d.onMissing == nil {
+		return false, nil
+	}
+	elTyp := v.Type().Elem()
+	val, handled, herr := d.onMissing(ref, elTyp)
+	if herr != nil {
+		return false, errors.Wrapf(herr, "handling missing blob %s", ref)
+	}
+	if !handled {
+		return false, nil
 	}
+	if !val.IsValid() {
+		return true, nil
+	}
+	if !val.Type().AssignableTo(elTyp) {
+		return false, errors.Errorf("missing-blob handler for %s returned %s, not assignable to %s", ref, val.Type(), elTyp)
+	}
+	v.Elem().Set(val)
+	return true, nil
+}
+
+// All blobs read by the Decoder pass through here.
+func (d *Decoder) fetch(ctx context.Context, ref blob.Ref) ([]byte, error) {
+	if err := spend(ctx); err != nil {
+		return nil, err
+	}
+	if d.cache != nil {
+		if s, ok := d.cache.get(ref); ok {
+			return d.decryptFor(ctx, s)
+		}
+	}
+
+	var s []byte
+	err := d.retry.do(ctx, func() error {
+		r, _, err := d.src.Fetch(ctx, ref)
+		if err != nil {
+			return errors.Wrapf(err, "fetching %s from src", ref)
+		}
+		defer r.Close()
+
+		s, err = ioutil.ReadAll(r)
+		if err != nil {
+			return errors.Wrapf(err, "reading body of %s", ref)
+		}
+		return d.checkRef(ref, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if d.cache != nil {
+		d.cache.add(ref, s)
+	}
+	return d.decryptFor(ctx, s)
+}
+
+// Returns the string to parse from a numeric blob.
+func (d *Decoder) numeric(s []byte) string {
+	if d.lenientNumbers {
+		return strings.TrimSpace(string(s))
+	}
+	return string(s)
+}
+
+var (
+	numberType                 = reflect.TypeOf(json.Number(""))
+	unmarshalerType            = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	unmarshalerWithDecoderType = reflect.TypeOf((*UnmarshalerWithDecoder)(nil)).Elem()
+)
+
+// Tells whether t implements Unmarshaler or UnmarshalerWithDecoder.
+func isUnmarshaler(t reflect.Type) bool {
+	return t.Implements(unmarshalerType) || t.Implements(unmarshalerWithDecoderType)
+}
+
+// Tells whether a value of type t may be marshaled as the zero-byte blob,
+// which otherwise denotes a nil pointer to t.
+func mayBeEmpty(t reflect.Type) bool {
+	if isMarshaler(t) || isMarshaler(reflect.PtrTo(t)) || isUnmarshaler(reflect.PtrTo(t)) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Map, reflect.Slice, reflect.Interface, reflect.Ptr:
+		return true
+	case reflect.Struct:
+		return isRefType(t) || isNetipType(t)
+	}
+	return false
+}
+
+// Tells whether s is a valid JSON number literal.
+func isJSONNumber(s string) bool {
+	if s == "" || s != strings.TrimSpace(s) {
+		return false
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var x interface{}
+	if err := dec.Decode(&x); err != nil {
+		return false
+	}
+	if _, ok := x.(json.Number); !ok {
+		return false
+	}
+	_, err := dec.Token()
+	return err == io.EOF
 }
 
 func (d *Decoder) newJSONDecoder(r io.Reader) *json.Decoder {
@@ -326,28 +991,91 @@ func (d *Decoder) newJSONDecoder(r io.Reader) *json.Decoder {
 }
 
 func (d *Decoder) buildSlice(ctx context.Context, slice reflect.Value, refs []blob.Ref) (reflect.Value, error) {
-	slice.SetLen(0)
+	if err := d.checkRefCount(len(refs)); err != nil {
+		return reflect.Value{}, err
+	}
 	elTyp := slice.Type().Elem()
-	for _, ref := range refs {
-		elVal := reflect.New(elTyp)
-		err := d.Decode(ctx, ref, elVal.Interface())
+	if isScalarKind(elTyp.Kind()) && !isUnmarshaler(reflect.PtrTo(elTyp)) && factoryFor(elTyp) == nil {
+		return d.buildScalarSlice(ctx, slice, refs)
+	}
+	slice.SetLen(0)
+	for i, ref := range refs {
+		elVal, err := newValue(elTyp)
 		if err != nil {
 			return reflect.Value{}, err
 		}
+		elCtx := withPathIndex(ctx, i)
+		err = d.Decode(elCtx, ref, elVal.Interface())
+		if err != nil {
+			if skipElement(elCtx, err) {
+				continue
+			}
+			return reflect.Value{}, err
+		}
 		slice = reflect.Append(slice, elVal.Elem())
 	}
 	return slice, nil
 }
 
+// A fast path for buildSlice when the elements have a scalar kind:
+// each one is parsed directly into its place in a slice of the final length,
+// rather than into a newly allocated value that is then appended.
+func (d *Decoder) buildScalarSlice(ctx context.Context, slice reflect.Value, refs []blob.Ref) (reflect.Value, error) {
+	if slice.Cap() < len(refs) {
+		slice = reflect.MakeSlice(slice.Type(), len(refs), len(refs))
+	} else {
+		slice = slice.Slice(0, len(refs))
+	}
+	zero := reflect.Zero(slice.Type().Elem())
+	n := 0
+	for i, ref := range refs {
+		el := slice.Index(n)
+		s, err := d.fetch(ctx, ref)
+		if err == nil {
+			err = d.setScalar(el, s)
+		} else if handled, herr := d.handleMissing(ref, el.Addr(), err); handled || herr != nil {
+			err = herr
+		}
+		if err != nil {
+			if skipElement(withPathIndex(ctx, i), err) {
+				el.Set(zero)
+				continue
+			}
+			return reflect.Value{}, err
+		}
+		n++
+	}
+	return slice.Slice(0, n), nil
+}
+
 func (d *Decoder) buildArray(ctx context.Context, arr reflect.Value, refs []blob.Ref) error {
+	if err := d.checkRefCount(len(refs)); err != nil {
+		return err
+	}
+	if err := d.checkArrayLen(arr, len(refs)); err != nil {
+		return err
+	}
 	elTyp := arr.Type().Elem()
 	zero := reflect.Zero(elTyp)
+	hasFactory := factoryFor(elTyp) != nil
 	for i := 0; i < arr.Len(); i++ {
 		el := arr.Index(i)
 		el.Set(zero)
 		if i < len(refs) {
-			err := d.Decode(ctx, refs[i], el.Addr().Interface())
+			if hasFactory {
+				p, err := newValue(elTyp)
+				if err != nil {
+					return err
+				}
+				el.Set(p.Elem())
+			}
+			elCtx := withPathIndex(ctx, i)
+			err := d.Decode(elCtx, refs[i], el.Addr().Interface())
 			if err != nil {
+				if skipElement(elCtx, err) {
+					el.Set(zero)
+					continue
+				}
 				return err
 			}
 		}
@@ -355,9 +1083,21 @@ func (d *Decoder) buildArray(ctx context.Context, arr reflect.Value, refs []blob
 	return nil
 }
 
+// Returns ErrArrayLength if the Decoder requires array lengths to match
+// and n is not the length of arr.
+func (d *Decoder) checkArrayLen(arr reflect.Value, n int) error {
+	if d.strictArrayLengths && n != arr.Len() {
+		return errors.Wrapf(ErrArrayLength, "%d elements for %s", n, arr.Type())
+	}
+	return nil
+}
+
 // dst is a map[K]T
 // refs is a map[K]blob.Ref
 func (d *Decoder) buildMap(ctx context.Context, dst, refs reflect.Value) error {
+	if err := d.checkRefCount(refs.Len()); err != nil {
+		return err
+	}
 	dstTyp := dst.Type()
 	if dst.IsNil() {
 		dst.Set(reflect.MakeMap(dstTyp))
@@ -366,11 +1106,18 @@ func (d *Decoder) buildMap(ctx context.Context, dst, refs reflect.Value) error {
 	for iter.Next() {
 		k := iter.Key()
 		ref := iter.Value().Interface().(blob.Ref)
-		item := reflect.New(dstTyp.Elem())
-		err := d.Decode(ctx, ref, item.Interface())
+		item, err := newValue(dstTyp.Elem())
 		if err != nil {
 			return err
 		}
+		elCtx := withPathKey(ctx, k)
+		err = d.Decode(elCtx, ref, item.Interface())
+		if err != nil {
+			if skipElement(elCtx, err) {
+				continue
+			}
+			return err
+		}
 		dst.SetMapIndex(k, item.Elem())
 	}
 	return nil
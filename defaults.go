@@ -0,0 +1,128 @@
+package pk
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Parses s, from a field's "default=" tag option, as a value of type t.
+func parseDefault(t reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch {
+	case t == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v.SetInt(int64(d))
+		return v, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(s)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := enumValue(t, s); ok {
+			v.SetInt(n)
+			break
+		}
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v.SetFloat(f)
+
+	default:
+		return reflect.Value{}, errors.Errorf("defaults are not supported for type %s", t)
+	}
+	return v, nil
+}
+
+// structDefaults holds the parsed defaults of a struct type's fields, by field index.
+type structDefaults map[int]reflect.Value
+
+// Caches the result of defaultsFor by struct type.
+var defaultsCache sync.Map // reflect.Type -> defaultsResult
+
+type defaultsResult struct {
+	defaults structDefaults
+	err      error
+}
+
+// Parses and validates the defaults of the fields of struct type t.
+// Returns nil if there are none.
+func defaultsFor(t reflect.Type) (structDefaults, error) {
+	if r, ok := defaultsCache.Load(t); ok {
+		r := r.(defaultsResult)
+		return r.defaults, r.err
+	}
+	var (
+		defaults structDefaults
+		err      error
+	)
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		_, o := parseTag(tf)
+		if o.Omit || !o.HasDefault {
+			continue
+		}
+		var v reflect.Value
+		v, err = parseDefault(tf.Type, o.Default)
+		if err != nil {
+			err = errors.Wrapf(err, "invalid default %q for field %s of %s", o.Default, tf.Name, t)
+			defaults = nil
+			break
+		}
+		if defaults == nil {
+			defaults = make(structDefaults)
+		}
+		defaults[i] = v
+	}
+	defaultsCache.Store(t, defaultsResult{defaults: defaults, err: err})
+	return defaults, err
+}
+
+// Sets the fields of dst, a struct of type t, that have defaults
+// and whose keys are absent from s, the struct's (ungrouped) JSON.
+func applyDefaults(t reflect.Type, defaults structDefaults, s []byte, dst reflect.Value) error {
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(s, &present); err != nil {
+		return errors.Wrap(err, "JSON-decoding struct keys")
+	}
+	for i, v := range defaults {
+		name, _ := parseTag(t.Field(i))
+		if _, ok := present[name]; !ok {
+			dst.Field(i).Set(v)
+		}
+	}
+	return nil
+}
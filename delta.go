@@ -0,0 +1,175 @@
+package pk
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// Context keys for EncodeDelta's walk of the previous tree.
+type (
+	deltaKey struct{} // *Decoder for fetching blobs of the previous tree
+	prevKey  struct{} // blob.Ref of the previous version of the value being encoded
+)
+
+// EncodeDelta is like Encode,
+// but skips uploading blobs that are unchanged from a previous version of obj,
+// whose root is prevRoot.
+// This is useful for re-marshaling a large object that has changed only in part.
+//
+// EncodeDelta walks the tree at prevRoot in parallel with obj,
+// fetching the interior blobs (structs, slices, maps, and interface values)
+// of the previous version as it goes.
+// Whenever the blob computed for some part of obj has the same ref
+// as the corresponding blob in the previous tree,
+// it is known already to be stored
+// and is not sent again.
+// Every blob is still computed and hashed,
+// but only new blobs are uploaded.
+//
+// The Encoder's BlobReceiver must also be a blob.Fetcher
+// from which the previous tree can be read,
+// and the previous tree must be complete.
+// Parts of the previous tree that are missing or do not match obj's type
+// are simply treated as changed.
+// A zero prevRoot makes EncodeDelta equivalent to Encode.
+func (e *Encoder) EncodeDelta(ctx context.Context, obj interface{}, prevRoot blob.Ref) (blob.Ref, error) {
+	src, ok := e.dst.(blob.Fetcher)
+	if !ok {
+		return blob.Ref{}, errors.New("EncodeDelta requires a BlobReceiver that is also a blob.Fetcher")
+	}
+	d := NewDecoder(src)
+	d.retry = e.retry
+	d.cipher = e.cipher
+	ctx = context.WithValue(ctx, deltaKey{}, d)
+	ctx = withPrev(ctx, prevRoot)
+	return e.Encode(ctx, obj)
+}
+
+// Returns a context recording ref as the previous version of the value about to be encoded,
+// when called during EncodeDelta.
+// Otherwise returns ctx.
+func withPrev(ctx context.Context, ref blob.Ref) context.Context {
+	if ctx.Value(deltaKey{}) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, prevKey{}, ref)
+}
+
+// Returns the ref of the previous version of the value being encoded, if known.
+func prevFor(ctx context.Context) (blob.Ref, bool) {
+	ref, ok := ctx.Value(prevKey{}).(blob.Ref)
+	return ref, ok && ref.Valid()
+}
+
+// Fetches the previous version of the blob being encoded.
+// Returns nil if there is none.
+func prevBlob(ctx context.Context) ([]byte, error) {
+	ref, ok := prevFor(ctx)
+	if !ok {
+		return nil, nil
+	}
+	d := ctx.Value(deltaKey{}).(*Decoder)
+	s, err := d.fetchStructure(ctx, ref)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	return s, errors.Wrapf(err, "fetching previous version %s", ref)
+}
+
+// Returns the element refs of the previous version of the slice or array being encoded.
+func prevRefArray(ctx context.Context) ([]blob.Ref, error) {
+	s, err := prevBlob(ctx)
+	if err != nil || len(s) == 0 {
+		return nil, err
+	}
+	d := ctx.Value(deltaKey{}).(*Decoder)
+	refs, err := d.readRefArray(ctx, s)
+	if err != nil {
+		// Not a ref array (or unreadable): no hints.
+		// That includes inline small scalars (see SetInlineSmallScalars),
+		// whose elements have no blobs of their own to reuse.
+		return nil, nil
+	}
+	return refs, nil
+}
+
+// Returns the previous version of the map being encoded,
+// as a map[K]blob.Ref for key type kt,
+// or an invalid Value if there is none.
+func prevRefMap(ctx context.Context, kt reflect.Type) (reflect.Value, error) {
+	s, err := prevBlob(ctx)
+	if err != nil || len(s) == 0 {
+		return reflect.Value{}, err
+	}
+	d := ctx.Value(deltaKey{}).(*Decoder)
+	mm, err := d.readRefMap(ctx, s, kt)
+	if err != nil {
+		// Not a ref map (or unreadable): no hints.
+		return reflect.Value{}, nil
+	}
+	return mm, nil
+}
+
+// Returns the fields of the previous version of the struct of type t being encoded,
+// with any dotted names ungrouped.
+func prevFields(ctx context.Context, t reflect.Type) (map[string]json.RawMessage, error) {
+	s, err := prevBlob(ctx)
+	if err != nil || len(s) == 0 {
+		return nil, err
+	}
+	if prefixes := groupPrefixes(t); len(prefixes) > 0 {
+		s, err = flattenDottedKeys(s, prefixes)
+		if err != nil {
+			return nil, nil
+		}
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(s, &m); err != nil {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// Returns the ref of the value in the previous version of the interface value being encoded,
+// if it had the type registered as name.
+func prevInterfaceRef(ctx context.Context, name string) (blob.Ref, error) {
+	s, err := prevBlob(ctx)
+	if err != nil || len(s) == 0 {
+		return blob.Ref{}, err
+	}
+	var hint typeHint
+	if err := json.Unmarshal(s, &hint); err != nil || hint.Type != name {
+		return blob.Ref{}, nil
+	}
+	return hint.Ref, nil
+}
+
+// These parse parts of previous-version blobs,
+// yielding zero values for anything unparseable.
+
+func refFromJSON(raw json.RawMessage) blob.Ref {
+	var ref blob.Ref
+	json.Unmarshal(raw, &ref)
+	return ref
+}
+
+func refsFromJSON(raw json.RawMessage) []blob.Ref {
+	var refs []blob.Ref
+	if err := json.Unmarshal(raw, &refs); err != nil {
+		return nil
+	}
+	return refs
+}
+
+func refMapFromJSON(raw json.RawMessage, kt reflect.Type) reflect.Value {
+	mm := reflect.New(reflect.MapOf(kt, reftype))
+	if err := json.Unmarshal(raw, mm.Interface()); err != nil {
+		return reflect.Value{}
+	}
+	return mm.Elem()
+}
@@ -4,17 +4,31 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"hash"
 	"io"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"perkeep.org/pkg/blob"
 	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/schema"
 )
 
 // Encoder is an object that can marshal a Go data structure
 // as a blob or tree of blobs stored in a Perkeep server.
+//
+// Some Encoder settings can be overridden for a single call to Encode
+// by placing a value in the context passed to it,
+// allowing a shared Encoder to behave differently per request.
+// A context value takes precedence over the corresponding Encoder setting.
+// The overridable settings are
+// concurrency (see WithContextConcurrency),
+// dry run (see WithContextDryRun),
+// and the progress callback (see WithContextProgress).
 type Encoder struct {
 	dst blobserver.BlobReceiver
 
@@ -22,6 +36,55 @@ type Encoder struct {
 	escapeHTML     bool
 	prefix, indent string
 
+	skipUnsupported bool
+
+	fieldFilter func(structType reflect.Type, fieldName string, value reflect.Value) bool
+
+	chunkFanout int
+
+	shardThreshold, shards int
+
+	inlineScalarStructs bool
+
+	newHash func() hash.Hash
+
+	dedup *lruCache[struct{}]
+
+	knownRefs map[blob.Ref]bool
+
+	readableRoot bool
+
+	markRoots bool
+
+	strictTags bool
+
+	protoNames bool
+	jsonNames  bool
+
+	compressStructure bool
+
+	cipher FieldCipher
+
+	permanodeSigner *schema.Signer
+
+	signer       *schema.Signer
+	signerPubKey blob.Ref
+
+	retry retrier
+
+	limiter    RateLimiter
+	limitBytes bool
+
+	bytesSchema bool
+
+	inlineScalars int
+
+	// These may be overridden per call via the context.
+	// See WithContextConcurrency, WithContextDryRun, and WithContextProgress.
+	concurrency int
+	dryRun      bool
+	progress    func(blob.SizedRef)
+
 	// TODO: an option to write proper schema blobs
 	// (with a callback for determining each item's camliType).
 }
@@ -48,16 +111,195 @@ func (e *Encoder) SetIndent(prefix, indent string) {
 	e.prefix, e.indent = prefix, indent
 }
 
+// SetSkipUnsupported tells whether struct fields of unsupported kinds
+// (funcs, chans, complex numbers, uintptrs, and unsafe pointers,
+// or pointers to these)
+// should be silently skipped,
+// as in "encoding/json",
+// rather than causing Encode to fail with ErrUnsupportedType.
+// When decoding, such fields are left at their zero values.
+// By default unsupported fields are an error.
+func (e *Encoder) SetSkipUnsupported(val bool) {
+	e.skipUnsupported = val
+}
+
+// SetFieldFilter sets a function that decides,
+// for each field of each struct being encoded,
+// whether to include the field.
+// It receives the struct's type,
+// the field's Go name,
+// and the field's value
+// (after any "compute" option is applied),
+// and returns false to skip the field,
+// as with a zero value under the "omitempty" option.
+// It is not consulted for fields that are skipped anyway.
+//
+// A skipped field is simply absent from the stored struct,
+// so when decoding it cannot be distinguished from a field that never existed:
+// it is not set
+// (so is zero in a freshly allocated struct),
+// or gets its "default=" value, if any.
+// By default (and with a nil f) no fields are filtered.
+func (e *Encoder) SetFieldFilter(f func(structType reflect.Type, fieldName string, value reflect.Value) bool) {
+	e.fieldFilter = f
+}
+
+// SetRetry causes each blob write to be retried,
+// up to a total of attempts tries,
+// when it fails with a transient error
+// (as classified by IsTransient, or by the function given to SetIsTransient).
+// Before retry number n (starting at 1), the Encoder waits for backoff(n),
+// or until its context is canceled.
+// A nil backoff retries immediately.
+// By default, and when attempts is less than 2, writes are not retried.
+//
+// Blobs that a Marshaler writes directly to its BlobReceiver are not retried.
+func (e *Encoder) SetRetry(attempts int, backoff func(attempt int) time.Duration) {
+	e.retry.attempts, e.retry.backoff = attempts, backoff
+}
+
+// SetIsTransient sets the function that decides,
+// when retries are enabled with SetRetry,
+// whether a failed blob write should be retried.
+// The default (also selected by a nil f) is IsTransient.
+func (e *Encoder) SetIsTransient(f func(error) bool) {
+	e.retry.isTransient = f
+}
+
+// SetConcurrency sets the maximum number of goroutines
+// that a single call to Encode may use
+// for marshaling the members of slices, arrays, and maps.
+// Values of n less than 2 (the default) mean members are marshaled sequentially.
+// When concurrency is enabled, Marshaler implementations and the progress callback
+// (see SetProgress) must be safe for concurrent use.
+func (e *Encoder) SetConcurrency(n int) {
+	e.concurrency = n
+}
+
+// SetDryRun tells whether the Encoder should compute blobrefs
+// without writing any blobs.
+// Encode returns the same root ref it would have otherwise.
+// In a dry run, Marshaler implementations are given a BlobReceiver
+// that discards what it receives.
+func (e *Encoder) SetDryRun(val bool) {
+	e.dryRun = val
+}
+
+// SetProgress sets a callback that is invoked after each blob
+// (other than those written directly by a Marshaler)
+// is written, or would have been written in a dry run.
+func (e *Encoder) SetProgress(f func(blob.SizedRef)) {
+	e.progress = f
+}
+
+// SetBlobHash sets the function producing the hash
+// used to compute the refs of the blobs the Encoder writes,
+// for interoperating with a store configured for a particular hash.
+// Perkeep supports SHA-224
+// (blob.NewHash, the current Perkeep default)
+// and the legacy SHA-1
+// (crypto/sha1.New);
+// with any other hash, Encode panics
+// (since blob.RefFromHash does).
+// The default (also selected by a nil f) is blob.NewHash.
+//
+// Blobs that a Marshaler writes directly to its BlobReceiver
+// are hashed however the Marshaler chooses.
+func (e *Encoder) SetBlobHash(f func() hash.Hash) {
+	e.newHash = f
+}
+
 // Encode marshals obj as a blob or tree of blobs,
 // writes them to the Perkeep server in e,
 // and returns the blobref of the root of the tree.
+//
+// Encode is synchronous:
+// when it returns without error,
+// every blob in the tree has been received by the server
+// (or was already known to be there, see SetKnownRefs),
+// even with concurrency (see SetConcurrency) or rate limiting (see SetRateLimiter).
+// An Encoder holds no pending blobs between calls,
+// so there is nothing to flush or close afterward.
 func (e *Encoder) Encode(ctx context.Context, obj interface{}) (blob.Ref, error) {
-	if m, ok := obj.(Marshaler); ok {
-		return m.PkMarshal(ctx, e.dst)
+	if ctx.Value(nestedKey{}) == e {
+		// A call from a MarshalerWithEncoder.
+		return e.encodeValue(ctx, reflect.ValueOf(obj))
+	}
+	if n := e.concurrencyFor(ctx); n > 1 && ctx.Value(semKey{}) == nil {
+		// The calling goroutine counts toward the limit.
+		ctx = context.WithValue(ctx, semKey{}, make(chan struct{}, n-1))
+	}
+	if e.readableRoot || e.signer != nil {
+		ctx = context.WithValue(ctx, rootKey{}, true)
+	}
+	var (
+		ref blob.Ref
+		err error
+	)
+	if e.permanodeSigner != nil {
+		ref, err = e.encodePermanode(ctx, obj)
+	} else {
+		ref, err = e.encodeValue(ctx, reflect.ValueOf(obj))
+	}
+	if err != nil || !e.markRoots {
+		return ref, err
+	}
+	return ref, e.markRoot(ctx, ref)
+}
+
+// nestedKey is the context key under which an Encoder
+// identifies itself to a MarshalerWithEncoder,
+// so that calls back into Encode can be recognized.
+type nestedKey struct{}
+
+var (
+	marshalerType            = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	marshalerWithEncoderType = reflect.TypeOf((*MarshalerWithEncoder)(nil)).Elem()
+)
+
+// Tells whether t implements Marshaler or MarshalerWithEncoder.
+func isMarshaler(t reflect.Type) bool {
+	return t.Implements(marshalerType) || t.Implements(marshalerWithEncoderType)
+}
+
+func (e *Encoder) encodeValue(ctx context.Context, v reflect.Value) (blob.Ref, error) {
+	isRoot, _ := ctx.Value(rootKey{}).(bool)
+	if isRoot {
+		ctx = context.WithValue(ctx, rootKey{}, false)
+	}
+
+	if !v.IsValid() {
+		// A nil interface.
+		sref, err := e.receiveString(ctx, "")
+		return sref.Ref, err
+	}
+	if v.Kind() == reflect.Interface {
+		return e.encodeInterface(ctx, v)
+	}
+	if v.CanInterface() {
+		if !isMarshaler(v.Type()) && isMarshaler(reflect.PtrTo(v.Type())) {
+			// PkMarshal has a pointer receiver.
+			if v.CanAddr() {
+				v = v.Addr()
+			} else {
+				p := reflect.New(v.Type())
+				p.Elem().Set(v)
+				v = p
+			}
+		}
+		if m, ok := v.Interface().(MarshalerWithEncoder); ok {
+			return m.PkMarshalWithEncoder(context.WithValue(ctx, nestedKey{}, e), e)
+		}
+		if m, ok := v.Interface().(Marshaler); ok {
+			dst := e.dst
+			if e.dryRunFor(ctx) {
+				dst = discardReceiver{}
+			}
+			return m.PkMarshal(ctx, recordingReceiver(ctx, dst))
+		}
 	}
 
 	var (
-		v = reflect.ValueOf(obj)
 		t = v.Type()
 		k = t.Kind()
 	)
@@ -70,9 +312,10 @@ func (e *Encoder) Encode(ctx context.Context, obj interface{}) (blob.Ref, error)
 	}
 
 	switch k {
-	case reflect.Map, reflect.Slice:
+	case reflect.Map, reflect.Slice, reflect.Ptr:
+		// A pointer is nil here, since the loop above stopped at it.
 		if v.IsNil() {
-			sref, err := blobserver.ReceiveString(ctx, e.dst, "")
+			sref, err := e.receiveString(ctx, "")
 			return sref.Ref, err
 		}
 	}
@@ -84,126 +327,527 @@ func (e *Encoder) Encode(ctx context.Context, obj interface{}) (blob.Ref, error)
 		if v.Bool() {
 			s = "true"
 		}
-		sref, err := blobserver.ReceiveString(ctx, e.dst, s)
+		sref, err := e.receiveString(ctx, s)
 		return sref.Ref, errors.Wrap(err, "storing bool val")
 
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		s := strconv.FormatInt(v.Int(), 10)
-		sref, err := blobserver.ReceiveString(ctx, e.dst, s)
+		s, ok := enumName(t, v.Int())
+		if !ok {
+			s = strconv.FormatInt(v.Int(), 10)
+		}
+		sref, err := e.receiveString(ctx, s)
 		return sref.Ref, errors.Wrap(err, "storing int val")
 
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		s := strconv.FormatUint(v.Uint(), 10)
-		sref, err := blobserver.ReceiveString(ctx, e.dst, s)
+		sref, err := e.receiveString(ctx, s)
 		return sref.Ref, errors.Wrap(err, "storing int val")
 
 	case reflect.Float32:
 		s := strconv.FormatFloat(v.Float(), 'f', -1, 32)
-		sref, err := blobserver.ReceiveString(ctx, e.dst, s)
+		sref, err := e.receiveString(ctx, s)
 		return sref.Ref, errors.Wrap(err, "storing float32 val")
 
 	case reflect.Float64:
 		s := strconv.FormatFloat(v.Float(), 'f', -1, 64)
-		sref, err := blobserver.ReceiveString(ctx, e.dst, s)
+		sref, err := e.receiveString(ctx, s)
 		return sref.Ref, errors.Wrap(err, "storing float64 val")
 
 	case reflect.Array, reflect.Slice:
-		refs, err := e.encodeSliceOrArray(ctx, v)
+		if vals, ok := e.smallScalars(v); ok {
+			return e.storeScalarValues(ctx, vals)
+		}
+		prev, err := prevRefArray(ctx)
 		if err != nil {
 			return blob.Ref{}, err
 		}
-		buf := new(bytes.Buffer)
-		enc := e.newJSONEncoder(buf)
-		err = enc.Encode(refs)
+		refs, err := e.encodeSliceOrArray(ctx, v, prev)
 		if err != nil {
 			return blob.Ref{}, err
 		}
-		sref, err := blobserver.ReceiveString(ctx, e.dst, buf.String())
-		return sref.Ref, err
+		return e.storeRefArray(ctx, refs)
 
 	case reflect.Map:
 		// Keys are not blobrefs. (Should they be?)
-		mm, err := e.encodeMap(ctx, v)
+		prev, err := prevRefMap(ctx, t.Key())
 		if err != nil {
 			return blob.Ref{}, err
 		}
-		buf := new(bytes.Buffer)
-		enc := e.newJSONEncoder(buf)
-		err = enc.Encode(mm.Interface())
+		mm, err := e.encodeMap(ctx, v, prev)
 		if err != nil {
 			return blob.Ref{}, err
 		}
-		sref, err := blobserver.ReceiveString(ctx, e.dst, buf.String())
-		return sref.Ref, err
+		return e.storeRefMap(ctx, mm)
 
 	case reflect.String:
-		sref, err := blobserver.ReceiveString(ctx, e.dst, obj.(string))
+		if t == numberType && !isJSONNumber(v.String()) {
+			return blob.Ref{}, errors.Errorf("invalid json.Number %q", v.String())
+		}
+		sref, err := e.receiveString(ctx, v.String())
 		return sref.Ref, errors.Wrap(err, "storing string")
 
+	case reflect.Interface:
+		return e.encodeInterface(ctx, v)
+
 	case reflect.Struct:
-		m := make(map[string]interface{})
-		for i := 0; i < v.NumField(); i++ {
-			tf := t.Field(i)
-			name, o := parseTag(tf)
-			if o.omit {
-				continue
+		if v.CanInterface() {
+			if om, ok := v.Interface().(orderedMapEncoder); ok {
+				return e.encodeOrderedMap(ctx, om)
 			}
-			vf := v.Field(i)
-			if o.omitEmpty && vf.IsZero() {
-				continue
+		}
+		if isRefType(t) {
+			ref := v.Convert(reftype).Interface().(blob.Ref)
+			var s string
+			if ref.Valid() {
+				s = ref.String()
 			}
-			if o.inline {
-				m[name] = vf.Interface()
-				continue
+			sref, err := e.receiveString(ctx, s)
+			return sref.Ref, errors.Wrap(err, "storing blobref")
+		}
+		if t == timeType && v.CanInterface() {
+			s := v.Interface().(time.Time).Format(time.RFC3339Nano)
+			sref, err := e.receiveString(ctx, s)
+			return sref.Ref, errors.Wrap(err, "storing time")
+		}
+		if isNetipType(t) && v.CanInterface() {
+			s, err := netipText(v)
+			if err != nil {
+				return blob.Ref{}, errors.Wrapf(err, "marshaling %s", t)
 			}
+			sref, err := e.receiveString(ctx, s)
+			return sref.Ref, errors.Wrapf(err, "storing %s", t)
+		}
 
-			if !o.external {
-				// With o.external false (the default),
-				// slices and arrays are encoded as [blobref, blobref, ...]
-				// and maps are encoded as {key: blobref, key: blobref, ...}
-				//
-				// With o.external true, the whole slice/array/map becomes a blobref,
-				// like other kinds of value.
-
-				switch tf.Type.Kind() {
-				case reflect.Slice, reflect.Array:
-					refs, err := e.encodeSliceOrArray(ctx, vf)
-					if err != nil {
-						return blob.Ref{}, err
-					}
-					m[name] = refs
-					continue
-
-				case reflect.Map:
-					mm, err := e.encodeMap(ctx, vf)
-					if err != nil {
-						return blob.Ref{}, err
-					}
-					m[name] = mm.Interface()
-					continue
-				}
+		if f := chainField(t); f >= 0 {
+			return e.encodeChain(ctx, v, f, isRoot)
+		}
+		return e.encodeStruct(ctx, v, isRoot, nil)
+
+	default:
+		return blob.Ref{}, ErrUnsupportedType{Name: t.String()}
+	}
+}
+
+// Encodes the struct v.
+// If link is not nil,
+// the ref it gives is used for one field
+// in place of encoding that field's value.
+func (e *Encoder) encodeStruct(ctx context.Context, v reflect.Value, isRoot bool, link *chainLink) (blob.Ref, error) {
+	t := v.Type()
+
+	if e.strictTags {
+		if err := checkTags(t); err != nil {
+			return blob.Ref{}, err
+		}
+	}
+
+	if _, err := defaultsFor(t); err != nil {
+		return blob.Ref{}, err
+	}
+	refOfs, err := refOfFields(t)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	selfs, err := selfFields(t)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+
+	fast := e.inlineScalarStructs && isScalarStruct(t)
+
+	prev, err := prevFields(ctx, t)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+
+	var summaryRef blob.Ref
+	if isRoot && e.readableRoot {
+		summaryRef, err = e.storeSummary(ctx, t)
+		if err != nil {
+			return blob.Ref{}, err
+		}
+	}
+
+	extra := extraMapField(t)
+
+	m := make(map[string]interface{})
+	for i := 0; i < v.NumField(); i++ {
+		tf := t.Field(i)
+		name, o := parseTag(tf)
+		if o.Omit || o.Self || o.RefOf != "" || i == extra {
+			// Refof fields are filled in below, once their targets are stored,
+			// and self fields once the struct is.
+			continue
+		}
+		isUintptr := o.Uintptr && tf.Type.Kind() == reflect.Uintptr
+		if e.skipUnsupported && !isUintptr && isUnsupportedKind(tf.Type) {
+			continue
+		}
+		vf := v.Field(i)
+		if o.Compute {
+			var err error
+			vf, err = computeField(v, i)
+			if err != nil {
+				return blob.Ref{}, err
+			}
+		}
+		if o.OmitEmpty && vf.IsZero() {
+			continue
+		}
+		if e.jsonNames && vf.IsZero() && jsonOmitEmpty(tf, e.protoNames) {
+			continue
+		}
+		if e.fieldFilter != nil && !e.fieldFilter(t, tf.Name, vf) {
+			continue
+		}
+		if link != nil && i == link.field {
+			m[name] = link.next
+			continue
+		}
+		ctx := ctx
+		if o.Encrypt {
+			if o.Inline || fast {
+				return blob.Ref{}, errors.Errorf("field %s of struct type %s cannot be both inline and encrypted", name, t)
+			}
+			ctx = withEncryption(ctx)
+		}
+		if isUintptr {
+			sref, err := e.receiveString(withPrev(ctx, refFromJSON(prev[name])), strconv.FormatUint(vf.Uint(), 10))
+			if err != nil {
+				return blob.Ref{}, errors.Wrapf(err, "storing uintptr field %s of struct type %s", name, t)
+			}
+			m[name] = sref.Ref
+			continue
+		}
+		if isZonedTime(tf.Type, o) {
+			ref, err := e.encodeZonedTime(withPrev(ctx, refFromJSON(prev[name])), vf.Interface().(time.Time))
+			if err != nil {
+				return blob.Ref{}, errors.Wrapf(err, "storing field %s of struct type %s", name, t)
+			}
+			m[name] = ref
+			continue
+		}
+		if isCompactTimes(tf.Type, o) {
+			ref, err := e.encodeCompactTimes(withPrev(ctx, refFromJSON(prev[name])), vf.Interface().([]time.Time))
+			if err != nil {
+				return blob.Ref{}, errors.Wrapf(err, "storing field %s of struct type %s", name, t)
+			}
+			m[name] = ref
+			continue
+		}
+		if isPacked(tf.Type, o) {
+			ref, err := e.encodePacked(withPrev(ctx, refFromJSON(prev[name])), vf)
+			if err != nil {
+				return blob.Ref{}, errors.Wrapf(err, "storing field %s of struct type %s", name, t)
+			}
+			m[name] = ref
+			continue
+		}
+		if isChunkable(tf.Type, o) {
+			if o.Encrypt {
+				return blob.Ref{}, errors.Errorf("field %s of struct type %s cannot be both chunked and encrypted", name, t)
+			}
+			val, err := e.encodeChunkable(withPrev(ctx, refFromJSON(prev[name])), vf, o.ChunkAt)
+			if err != nil {
+				return blob.Ref{}, errors.Wrapf(err, "storing field %s of struct type %s", name, t)
+			}
+			m[name] = val
+			continue
+		}
+		if isBitset(tf.Type, o) {
+			ref, err := e.encodeBitset(withPrev(ctx, refFromJSON(prev[name])), vf)
+			if err != nil {
+				return blob.Ref{}, errors.Wrapf(err, "storing field %s of struct type %s", name, t)
 			}
+			m[name] = ref
+			continue
+		}
+		if isMoney(tf.Type, o) {
+			ref, err := e.encodeMoney(withPrev(ctx, refFromJSON(prev[name])), vf)
+			if err != nil {
+				return blob.Ref{}, errors.Wrapf(err, "storing field %s of struct type %s", name, t)
+			}
+			m[name] = ref
+			continue
+		}
+		if o.Inline || fast {
+			m[name] = vf.Interface()
+			continue
+		}
+
+		fctx := withPathField(ctx, name)
 
-			fieldRef, err := e.Encode(ctx, vf.Interface())
+		if isSparseArray(tf.Type, o) {
+			sparse, err := e.encodeSparseArray(fctx, vf, sparseFromJSON(prev[name]))
 			if err != nil {
-				return blob.Ref{}, errors.Wrapf(err, "storing field %s of struct type %s", name, t.Name())
+				return blob.Ref{}, err
 			}
-			m[name] = fieldRef
+			m[name] = sparse
+			continue
 		}
 
-		buf := new(bytes.Buffer)
-		enc := e.newJSONEncoder(buf)
-		err := enc.Encode(m)
+		if !o.External {
+			// With o.External false (the default),
+			// slices and arrays are encoded as [blobref, blobref, ...]
+			// and maps are encoded as {key: blobref, key: blobref, ...}
+			//
+			// With o.External true, the whole slice/array/map becomes a blobref,
+			// like other kinds of value.
+
+			switch tf.Type.Kind() {
+			case reflect.Slice, reflect.Array:
+				refs, err := e.encodeSliceOrArray(fctx, vf, refsFromJSON(prev[name]))
+				if err != nil {
+					return blob.Ref{}, err
+				}
+				m[name] = refs
+				continue
+
+			case reflect.Map:
+				mm, err := e.encodeMap(fctx, vf, refMapFromJSON(prev[name], tf.Type.Key()))
+				if err != nil {
+					return blob.Ref{}, err
+				}
+				m[name] = mm.Interface()
+				continue
+			}
+		}
+
+		fieldRef, err := e.encodeValue(withPrev(fctx, refFromJSON(prev[name])), vf)
 		if err != nil {
-			return blob.Ref{}, errors.Wrapf(err, "encoding fields of struct type %s", t.Name())
+			return blob.Ref{}, errors.Wrapf(err, "storing field %s of struct type %s", name, t)
 		}
+		m[name] = fieldRef
+	}
 
-		sref, err := blobserver.ReceiveString(ctx, e.dst, buf.String())
-		return sref.Ref, errors.Wrapf(err, "storing struct type %s", t.Name())
+	for i, j := range refOfs {
+		tf := t.Field(i)
+		name, _ := parseTag(tf)
+		target, _ := parseTag(t.Field(j))
+		val, ok := m[target]
+		if !ok {
+			// The target was omitted.
+			continue
+		}
+		ref := val.(blob.Ref)
+		m[name] = ref
+		if vf := v.Field(i); vf.CanSet() {
+			vf.Set(reflect.ValueOf(ref).Convert(tf.Type))
+		}
+	}
 
-	default:
-		return blob.Ref{}, ErrUnsupportedType{Name: t.Name()}
+	if e.protoNames || e.jsonNames {
+		renameToFallbackKeys(m, fallbackRenames(t, e.protoNames, e.jsonNames))
+	}
+	if fast {
+		m[inlineScalarsKey] = true
+	}
+	if summaryRef.Valid() {
+		m[summaryKey] = summaryRef
+	}
+	sign := isRoot && e.signer != nil
+	if sign {
+		m[camliSignerKey] = e.signerPubKey
+	}
+
+	m, err = nestDottedKeys(m)
+	if err != nil {
+		return blob.Ref{}, errors.Wrapf(err, "grouping fields of struct type %s", t)
+	}
+	if extra >= 0 {
+		// Extra keys are added after grouping,
+		// so that dotted ones survive unchanged.
+		spreadExtra(m, v.Field(extra), declaredNames(t, extra), groupPrefixes(t))
+	}
+
+	buf := new(bytes.Buffer)
+	enc := e.newJSONEncoder(buf)
+	err = enc.Encode(m)
+	if err != nil {
+		return blob.Ref{}, errors.Wrapf(err, "encoding fields of struct type %s", t)
 	}
+	var ref blob.Ref
+	if sign {
+		ref, err = e.receiveSigned(ctx, buf.String())
+	} else {
+		var sref blob.SizedRef
+		sref, err = e.receiveStructure(ctx, buf.String())
+		ref, err = sref.Ref, errors.Wrapf(err, "storing struct type %s", t)
+	}
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	setSelfRefs(v, selfs, ref)
+	return ref, nil
+}
+
+// Tells whether t (after dereferencing any pointers) is of a kind that pk can never marshal.
+func isUnsupportedKind(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.Uintptr, reflect.UnsafePointer:
+		return true
+	}
+	return false
+}
+
+// EncodeRefMap writes a blob for m, a map of precomputed refs,
+// in the format that Encode uses for maps,
+// (including sharding, if enabled with SetMapSharding),
+// without re-encoding the values the refs refer to.
+// This is useful for composing trees from pre-existing blobs:
+// if each ref in m is the root of a marshaled T,
+// the result can be decoded as a map[string]T.
+// See also Decoder.DecodeRefMap.
+func (e *Encoder) EncodeRefMap(ctx context.Context, m map[string]blob.Ref) (blob.Ref, error) {
+	if m == nil {
+		sref, err := e.receiveString(ctx, "")
+		return sref.Ref, err
+	}
+	return e.storeRefMap(ctx, reflect.ValueOf(m))
+}
+
+// All blobs written by the Encoder itself pass through here.
+func (e *Encoder) receiveString(ctx context.Context, s string) (blob.SizedRef, error) {
+	s, err := e.encryptFor(ctx, s)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+
+	if m := manifestFor(ctx); m != nil {
+		m.add(e.refFromString(s))
+	}
+
+	if e.dryRunFor(ctx) {
+		sref := blob.SizedRef{Ref: e.refFromString(s), Size: uint32(len(s))}
+		if progress := e.progressFor(ctx); progress != nil {
+			progress(sref)
+		}
+		return sref, nil
+	}
+
+	if prev, ok := prevFor(ctx); ok && e.refFromString(s) == prev {
+		// Unchanged from the previous version (see EncodeDelta).
+		return blob.SizedRef{Ref: prev, Size: uint32(len(s))}, nil
+	}
+	if e.dedup != nil {
+		ref := e.refFromString(s)
+		if _, ok := e.dedup.get(ref); ok {
+			return blob.SizedRef{Ref: ref, Size: uint32(len(s))}, nil
+		}
+	}
+	if len(e.knownRefs) > 0 {
+		if ref := e.refFromString(s); e.knownRefs[ref] {
+			return blob.SizedRef{Ref: ref, Size: uint32(len(s))}, nil
+		}
+	}
+
+	if err := e.waitToUpload(ctx, len(s)); err != nil {
+		return blob.SizedRef{}, err
+	}
+
+	var sref blob.SizedRef
+	err = e.retry.do(ctx, func() error {
+		var err error
+		if e.newHash == nil {
+			sref, err = blobserver.ReceiveString(ctx, e.dst, s)
+		} else {
+			sref, err = blobserver.Receive(ctx, e.dst, e.refFromString(s), strings.NewReader(s))
+		}
+		return err
+	})
+	if err != nil {
+		return sref, err
+	}
+	if e.dedup != nil {
+		e.dedup.add(sref.Ref, struct{}{})
+	}
+	if progress := e.progressFor(ctx); progress != nil {
+		progress(sref)
+	}
+	return sref, nil
+}
+
+// Computes the ref of a blob with content s
+// using the hash selected with SetBlobHash.
+func (e *Encoder) refFromString(s string) blob.Ref {
+	if e.newHash == nil {
+		return blob.RefFromString(s)
+	}
+	h := e.newHash()
+	h.Write([]byte(s))
+	return blob.RefFromHash(h)
+}
+
+// Calls f(ctx, i) for each i in [0, n),
+// in separate goroutines when the per-call concurrency limit permits
+// and in the calling goroutine otherwise
+// (so that nested calls can never deadlock waiting for a slot).
+// Returns the first error encountered.
+func (e *Encoder) forEach(ctx context.Context, n int, f func(ctx context.Context, i int) error) error {
+	sem, _ := ctx.Value(semKey{}).(chan struct{})
+	if sem == nil {
+		for i := 0; i < n; i++ {
+			if err := f(ctx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	setErr := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+	getErr := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr
+	}
+
+	for i := 0; i < n && getErr() == nil; i++ {
+		select {
+		case sem <- struct{}{}:
+			wg.Add(1)
+			go func(i int) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				if err := f(ctx, i); err != nil {
+					setErr(err)
+				}
+			}(i)
+
+		default:
+			if err := f(ctx, i); err != nil {
+				setErr(err)
+			}
+		}
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Stores v, JSON-encoded, as a structural blob.
+func (e *Encoder) receiveJSON(ctx context.Context, v interface{}) (blob.SizedRef, error) {
+	buf := new(bytes.Buffer)
+	enc := e.newJSONEncoder(buf)
+	err := enc.Encode(v)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	return e.receiveStructure(ctx, buf.String())
 }
 
 func (e *Encoder) newJSONEncoder(w io.Writer) *json.Encoder {
@@ -213,33 +857,101 @@ func (e *Encoder) newJSONEncoder(w io.Writer) *json.Encoder {
 	return result
 }
 
-func (e *Encoder) encodeSliceOrArray(ctx context.Context, sliceOrArray reflect.Value) ([]blob.Ref, error) {
-	var refs []blob.Ref
-	for i := 0; i < sliceOrArray.Len(); i++ {
+// During EncodeDelta, prev holds the element refs of the previous version.
+func (e *Encoder) encodeSliceOrArray(ctx context.Context, sliceOrArray reflect.Value, prev []blob.Ref) ([]blob.Ref, error) {
+	n := sliceOrArray.Len()
+	if n == 0 {
+		return nil, nil
+	}
+	refs := make([]blob.Ref, n)
+	err := e.forEach(ctx, n, func(ctx context.Context, i int) error {
 		el := sliceOrArray.Index(i)
-		ref, err := e.Encode(ctx, el.Interface())
+		ctx = withPathIndex(ctx, i)
+		if i < len(prev) {
+			ctx = withPrev(ctx, prev[i])
+		} else {
+			ctx = withPrev(ctx, blob.Ref{})
+		}
+		ref, err := e.encodeValue(ctx, el)
 		if err != nil {
-			return nil, err // xxx return the refs created so far?
+			return err // xxx return the refs created so far?
 		}
-		refs = append(refs, ref)
+		refs[i] = ref
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return refs, nil
 }
 
 // Returns a reflect.Value containing a map[K]blob.Ref, where K is the key type of m.
-func (e *Encoder) encodeMap(ctx context.Context, m reflect.Value) (reflect.Value, error) {
+// During EncodeDelta, prev (if valid) is the map[K]blob.Ref of the previous version.
+func (e *Encoder) encodeMap(ctx context.Context, m reflect.Value, prev reflect.Value) (reflect.Value, error) {
 	kt := m.Type().Key()
 	mt := reflect.MapOf(kt, reflect.TypeOf(blob.Ref{}))
 	mm := reflect.MakeMap(mt)
+
+	var keys, vals []reflect.Value
 	iter := m.MapRange()
 	for iter.Next() {
-		mk := iter.Key()
-		mv := iter.Value()
-		ref, err := e.Encode(ctx, mv.Interface())
+		keys = append(keys, iter.Key())
+		vals = append(vals, iter.Value())
+	}
+	refs := make([]blob.Ref, len(keys))
+	err := e.forEach(ctx, len(keys), func(ctx context.Context, i int) error {
+		ctx = withPathKey(ctx, keys[i])
+		var prevRef blob.Ref
+		if prev.IsValid() {
+			if r := prev.MapIndex(keys[i]); r.IsValid() {
+				prevRef = r.Interface().(blob.Ref)
+			}
+		}
+		ref, err := e.encodeValue(withPrev(ctx, prevRef), vals[i])
 		if err != nil {
-			return reflect.Value{}, err
+			return err
 		}
-		mm.SetMapIndex(mk, reflect.ValueOf(ref))
+		refs[i] = ref
+		return nil
+	})
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	for i, k := range keys {
+		mm.SetMapIndex(k, reflect.ValueOf(refs[i]))
 	}
 	return mm, nil
 }
+
+// Encodes the dynamic value in the interface v together with its registered type name.
+func (e *Encoder) encodeInterface(ctx context.Context, v reflect.Value) (blob.Ref, error) {
+	if v.IsNil() {
+		sref, err := e.receiveString(ctx, "")
+		return sref.Ref, err
+	}
+	el := v.Elem()
+	if el.Type() == reftype && el.Interface().(blob.Ref).Valid() {
+		// Stored as itself, with no type hint.
+		return e.encodeValue(ctx, el)
+	}
+	name, ok := registeredName(el.Type())
+	if !ok {
+		return blob.Ref{}, ErrUnregisteredType{Name: el.Type().String()}
+	}
+	prev, err := prevInterfaceRef(ctx, name)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	ref, err := e.encodeValue(withPrev(ctx, prev), el)
+	if err != nil {
+		return blob.Ref{}, errors.Wrapf(err, "storing value of type %s", name)
+	}
+	buf := new(bytes.Buffer)
+	enc := e.newJSONEncoder(buf)
+	err = enc.Encode(typeHint{Type: name, Ref: ref})
+	if err != nil {
+		return blob.Ref{}, errors.Wrapf(err, "encoding type hint for %s", name)
+	}
+	sref, err := e.receiveStructure(ctx, buf.String())
+	return sref.Ref, errors.Wrapf(err, "storing type hint for %s", name)
+}
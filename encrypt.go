@@ -0,0 +1,81 @@
+package pk
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// FieldCipher encrypts and decrypts the blobs of struct fields
+// having the "encrypt" option.
+// See Encoder.SetFieldCipher.
+type FieldCipher interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// encryptKey is the context key marking the value being encoded or decoded
+// as part of a field with the "encrypt" option.
+type encryptKey struct{}
+
+func withEncryption(ctx context.Context) context.Context {
+	return context.WithValue(ctx, encryptKey{}, true)
+}
+
+func isEncrypted(ctx context.Context) bool {
+	val, _ := ctx.Value(encryptKey{}).(bool)
+	return val
+}
+
+// ErrNoFieldCipher is produced when encoding or decoding a struct field
+// with the "encrypt" option
+// by an Encoder or Decoder that has no FieldCipher.
+var ErrNoFieldCipher = errors.New("no field cipher")
+
+// SetFieldCipher sets the cipher used for struct fields with the "encrypt" option.
+// Every blob the Encoder writes for such a field's value
+// (including, for a container or struct, the blobs of its members)
+// is passed through c.Encrypt,
+// and the blob's ref is computed over the ciphertext,
+// while the other fields of the struct are stored in plaintext as usual.
+// Blobs that a Marshaler writes directly to its BlobReceiver are not encrypted.
+// A cipher that uses random nonces (as an AEAD should)
+// gives a new ref each time an unchanged value is encoded.
+//
+// Encoding a field with the "encrypt" option fails with ErrNoFieldCipher
+// if no cipher has been set.
+func (e *Encoder) SetFieldCipher(c FieldCipher) {
+	e.cipher = c
+}
+
+// SetFieldCipher sets the cipher used for decrypting the blobs of struct fields
+// with the "encrypt" option.
+// It must match the one the Encoder used.
+// See Encoder.SetFieldCipher.
+func (d *Decoder) SetFieldCipher(c FieldCipher) {
+	d.cipher = c
+}
+
+// Returns s, encrypted if ctx calls for it.
+func (e *Encoder) encryptFor(ctx context.Context, s string) (string, error) {
+	if !isEncrypted(ctx) {
+		return s, nil
+	}
+	if e.cipher == nil {
+		return "", ErrNoFieldCipher
+	}
+	b, err := e.cipher.Encrypt([]byte(s))
+	return string(b), errors.Wrap(err, "encrypting blob")
+}
+
+// Returns s, decrypted if ctx calls for it.
+func (d *Decoder) decryptFor(ctx context.Context, s []byte) ([]byte, error) {
+	if !isEncrypted(ctx) {
+		return s, nil
+	}
+	if d.cipher == nil {
+		return nil, ErrNoFieldCipher
+	}
+	b, err := d.cipher.Decrypt(s)
+	return b, errors.Wrap(err, "decrypting blob")
+}
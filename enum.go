@@ -0,0 +1,93 @@
+package pk
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type enumInfo struct {
+	names  map[int64]string
+	values map[string]int64
+}
+
+var enums = struct {
+	mu    sync.RWMutex
+	types map[reflect.Type]*enumInfo
+}{
+	types: make(map[reflect.Type]*enumInfo),
+}
+
+// RegisterEnum records names for the values of the integer type T,
+// typically a set of constants declared in a const block.
+// Wherever a registered value of type T is marshaled,
+// it is stored as its name rather than as a number,
+// and the name is parsed back into the value when unmarshaling.
+// A value of type T not in the map is stored numerically, as usual,
+// and a numeric blob unmarshals into T numerically.
+//
+// The standard types time.Month and time.Weekday
+// are registered automatically,
+// with the names given by their String methods.
+//
+// Names must be distinct,
+// and should not look like numbers.
+// A later call for the same T replaces the earlier registration.
+// RegisterEnum panics if two values have the same name.
+func RegisterEnum[T ~int | ~int8 | ~int16 | ~int32 | ~int64](values map[T]string) {
+	info := &enumInfo{
+		names:  make(map[int64]string),
+		values: make(map[string]int64),
+	}
+	for val, name := range values {
+		if other, ok := info.values[name]; ok {
+			panic(fmt.Sprintf("pk: duplicate enum name %q for values %d and %d", name, other, val))
+		}
+		info.names[int64(val)] = name
+		info.values[name] = int64(val)
+	}
+
+	var zero T
+	t := reflect.TypeOf(zero)
+
+	enums.mu.Lock()
+	enums.types[t] = info
+	enums.mu.Unlock()
+}
+
+func enumName(t reflect.Type, val int64) (string, bool) {
+	enums.mu.RLock()
+	info, ok := enums.types[t]
+	enums.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+	name, ok := info.names[val]
+	return name, ok
+}
+
+func enumValue(t reflect.Type, name string) (int64, bool) {
+	enums.mu.RLock()
+	info, ok := enums.types[t]
+	enums.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	val, ok := info.values[name]
+	return val, ok
+}
+
+func init() {
+	months := make(map[time.Month]string)
+	for m := time.January; m <= time.December; m++ {
+		months[m] = m.String()
+	}
+	RegisterEnum(months)
+
+	weekdays := make(map[time.Weekday]string)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		weekdays[d] = d.String()
+	}
+	RegisterEnum(weekdays)
+}
@@ -0,0 +1,110 @@
+package pk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorMode tells a Decoder what to do when an element of a container can't be decoded.
+// See Decoder.SetErrorMode.
+type ErrorMode int
+
+const (
+	// FailFast makes Decode return the first error it encounters.
+	// This is the default.
+	FailFast ErrorMode = iota
+
+	// Collect makes Decode skip elements of slices, arrays, and maps
+	// that can't be decoded,
+	// and report them all at the end in an ErrCollected.
+	Collect
+)
+
+// SetErrorMode sets the Decoder's handling of elements that can't be decoded.
+// In Collect mode,
+// a bad element of a slice is dropped
+// (so later elements move up),
+// a bad element of an array is left as the zero value,
+// and a bad map entry is omitted,
+// and decoding continues.
+// If anything was skipped,
+// Decode then returns an ErrCollected listing each error with the path of its element
+// (see PathFromContext),
+// while obj holds everything that could be decoded.
+// Errors outside of container elements are still returned immediately.
+// The default is FailFast.
+func (d *Decoder) SetErrorMode(mode ErrorMode) {
+	d.errMode = mode
+}
+
+// ElementError is an error decoding the element at Path.
+type ElementError struct {
+	Path string
+	Err  error
+}
+
+// Error implements the error interface.
+func (e ElementError) Error() string {
+	return fmt.Sprintf("at %s: %s", e.Path, e.Err)
+}
+
+// ErrCollected is returned by Decode in Collect mode
+// when some elements could not be decoded and were skipped.
+// See Decoder.SetErrorMode.
+type ErrCollected struct {
+	Errs []ElementError
+}
+
+// Error implements the error interface.
+func (e ErrCollected) Error() string {
+	strs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		strs = append(strs, err.Error())
+	}
+	return fmt.Sprintf("%d element(s) skipped: %s", len(e.Errs), strings.Join(strs, "; "))
+}
+
+// collectorKey is the context key for the collector of a Decode call in Collect mode.
+type collectorKey struct{}
+
+type collector struct {
+	mu   sync.Mutex
+	errs []ElementError
+
+	// Whether elements that can't be decoded are skipped.
+	// When false, the collector gathers only truncation warnings
+	// (see Decoder.SetTolerateTruncation).
+	skip bool
+}
+
+// Records err as the error for the value at ctx's path.
+func (c *collector) add(ctx context.Context, err error) {
+	c.mu.Lock()
+	c.errs = append(c.errs, ElementError{Path: PathFromContext(ctx), Err: err})
+	c.mu.Unlock()
+}
+
+// In Collect mode, records err as the error for the element at ctx's path
+// and returns true.
+// Otherwise returns false,
+// as it also does for ErrOperationBudget,
+// which stops decoding in any mode.
+func skipElement(ctx context.Context, err error) bool {
+	c, ok := ctx.Value(collectorKey{}).(*collector)
+	if !ok || !c.skip || errors.Cause(err) == ErrOperationBudget {
+		return false
+	}
+	c.add(ctx, err)
+	return true
+}
+
+func (c *collector) err() error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return ErrCollected{Errs: c.errs}
+}
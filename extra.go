@@ -0,0 +1,127 @@
+package pk
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Tells whether a field of type t with options o is a catch-all for extra keys:
+// an inline map[string]interface{} (or another map type with string keys and interface{} values).
+func isExtraMap(t reflect.Type, o options) bool {
+	return o.Inline &&
+		t.Kind() == reflect.Map &&
+		t.Key().Kind() == reflect.String &&
+		t.Elem().Kind() == reflect.Interface &&
+		t.Elem().NumMethod() == 0
+}
+
+// Caches the result of extraMapField by struct type.
+var extraCache sync.Map // reflect.Type -> int
+
+// Returns the index of the first extra-keys field of struct type t,
+// or -1 if there is none.
+func extraMapField(t reflect.Type) int {
+	if i, ok := extraCache.Load(t); ok {
+		return i.(int)
+	}
+	i := findExtraMapField(t)
+	extraCache.Store(t, i)
+	return i
+}
+
+func findExtraMapField(t reflect.Type) int {
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		if _, o := parseTag(tf); !o.Omit && isExtraMap(tf.Type, o) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Caches the result of declaredNames by its arguments.
+var declaredCache sync.Map // declaredKey -> map[string]bool
+
+type declaredKey struct {
+	t     reflect.Type
+	extra int
+}
+
+// Returns the names of the fields of struct type t
+// that may appear as keys in its JSON,
+// excluding the extra-keys field.
+// The result is shared and must not be modified.
+func declaredNames(t reflect.Type, extra int) map[string]bool {
+	key := declaredKey{t: t, extra: extra}
+	if names, ok := declaredCache.Load(key); ok {
+		return names.(map[string]bool)
+	}
+	names := findDeclaredNames(t, extra)
+	declaredCache.Store(key, names)
+	return names
+}
+
+func findDeclaredNames(t reflect.Type, extra int) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		if i == extra {
+			continue
+		}
+		if name, o := parseTag(t.Field(i)); !o.Omit {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// Adds the entries of extra, a map with string keys, to m,
+// the (grouped) JSON object of a struct,
+// with their keys verbatim.
+// It skips any whose keys are the names of declared fields or their groups
+// (see groupPrefixes),
+// or are already in m.
+func spreadExtra(m map[string]interface{}, extra reflect.Value, declared, prefixes map[string]bool) {
+	iter := extra.MapRange()
+	for iter.Next() {
+		k := iter.Key().String()
+		if declared[k] || prefixes[k] {
+			continue
+		}
+		if _, ok := m[k]; ok {
+			continue
+		}
+		m[k] = iter.Value().Interface()
+	}
+}
+
+// Decodes the keys of s, the (ungrouped) JSON of a struct,
+// that are not the names of declared fields
+// into dst, an extra-keys map.
+// Leaves dst nil if there are none.
+func (d *Decoder) collectExtra(s []byte, dst reflect.Value, declared map[string]bool) error {
+	var all map[string]json.RawMessage
+	err := json.Unmarshal(s, &all)
+	if err != nil {
+		return err
+	}
+	dst.Set(reflect.Zero(dst.Type()))
+	for k, raw := range all {
+		if declared[k] || k == summaryKey || k == inlineScalarsKey {
+			continue
+		}
+		val := reflect.New(dst.Type().Elem())
+		err = d.newJSONDecoder(bytes.NewReader(raw)).Decode(val.Interface())
+		if err != nil {
+			return errors.Wrapf(err, "JSON-decoding extra key %s", k)
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(dst.Type()))
+		}
+		dst.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), val.Elem())
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package pk
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var factories = struct {
+	mu    sync.RWMutex
+	types map[reflect.Type]func() interface{}
+}{
+	types: make(map[reflect.Type]func() interface{}),
+}
+
+// RegisterFactory records a constructor for type t,
+// for types whose values need initialization beyond the zero value
+// (such as unexported fields that a NewT function sets up).
+// Whenever a Decoder allocates a new value of type t
+// (for a struct field, a slice, array, or map element, the target of a pointer,
+// or the concrete value of an interface),
+// it calls f to create it and then populates the value's fields,
+// instead of starting from the zero value.
+// Values that the caller passes to Decode or Unmarshal are populated as they are.
+//
+// The result of f must have type t or *t.
+// In the latter case the pointer itself is used
+// wherever a *t is being allocated.
+// A result of any other type causes decoding to fail.
+//
+// RegisterFactory panics if f is nil.
+// Registering a second factory for the same type replaces the first.
+func RegisterFactory(t reflect.Type, f func() interface{}) {
+	if f == nil {
+		panic("pk: nil factory for " + t.String())
+	}
+	factories.mu.Lock()
+	factories.types[t] = f
+	factories.mu.Unlock()
+}
+
+func factoryFor(t reflect.Type) func() interface{} {
+	factories.mu.RLock()
+	defer factories.mu.RUnlock()
+	return factories.types[t]
+}
+
+// Allocates a new value of type t and returns a pointer to it.
+// The value comes from the factory registered for t, if there is one,
+// and is otherwise the zero value.
+func newValue(t reflect.Type) (reflect.Value, error) {
+	f := factoryFor(t)
+	if f == nil {
+		return reflect.New(t), nil
+	}
+	obj := f()
+	v := reflect.ValueOf(obj)
+	switch {
+	case !v.IsValid():
+		// The factory returned nil.
+	case v.Type() == t:
+		p := reflect.New(t)
+		p.Elem().Set(v)
+		return p, nil
+	case v.Type() == reflect.PtrTo(t) && !v.IsNil():
+		return v, nil
+	}
+	return reflect.Value{}, errors.Errorf("factory for %s returned %T, want %s or *%s", t, obj, t, t)
+}
@@ -0,0 +1,105 @@
+package pk
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Caches the result of fallbackRenames by its arguments.
+var renamesCache sync.Map // renamesKey -> map[string]string
+
+type renamesKey struct {
+	t                 reflect.Type
+	useProto, useJSON bool
+}
+
+// Maps the stored names of the fields of struct type t
+// to the names that other packages' tags give them,
+// for the fields without pk tags:
+// the protobuf name (see SetProtobufTagFallback) if useProto is true,
+// and otherwise the JSON name (see SetJSONTagFallback) if useJSON is true.
+// The result is shared and must not be modified.
+func fallbackRenames(t reflect.Type, useProto, useJSON bool) map[string]string {
+	key := renamesKey{t: t, useProto: useProto, useJSON: useJSON}
+	if renames, ok := renamesCache.Load(key); ok {
+		return renames.(map[string]string)
+	}
+	renames := findFallbackRenames(t, useProto, useJSON)
+	renamesCache.Store(key, renames)
+	return renames
+}
+
+func findFallbackRenames(t reflect.Type, useProto, useJSON bool) map[string]string {
+	renames := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		name, o := parseTag(tf)
+		if o.Omit {
+			continue
+		}
+		if useProto {
+			if pname, ok := protoName(tf); ok {
+				if pname != name {
+					renames[name] = pname
+				}
+				continue
+			}
+		}
+		if useJSON {
+			if jname, _, ok := jsonName(tf); ok && jname != name {
+				renames[name] = jname
+			}
+		}
+	}
+	return renames
+}
+
+// Renames the keys of m, the fields of a struct being encoded,
+// from their stored names to the names in renames.
+func renameToFallbackKeys(m map[string]interface{}, renames map[string]string) {
+	for name, fname := range renames {
+		v, ok := m[name]
+		if !ok {
+			continue
+		}
+		if _, ok := m[fname]; ok {
+			continue
+		}
+		m[fname] = v
+		delete(m, name)
+	}
+}
+
+// Rewrites s, the JSON object for a struct,
+// renaming the keys that are names in renames
+// back to the fields' stored names.
+func renameFromFallbackKeys(s []byte, renames map[string]string) ([]byte, error) {
+	if len(renames) == 0 {
+		return s, nil
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(s, &m); err != nil {
+		return nil, errors.Wrap(err, "JSON-decoding struct")
+	}
+	var changed bool
+	for name, fname := range renames {
+		v, ok := m[fname]
+		if !ok {
+			continue
+		}
+		if _, ok := m[name]; ok {
+			continue
+		}
+		m[name] = v
+		delete(m, fname)
+		changed = true
+	}
+	if !changed {
+		return s, nil
+	}
+	return json.Marshal(m)
+}
@@ -0,0 +1,99 @@
+package pk
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/schema"
+)
+
+// EncodeFile streams the contents of the file at path into a Perkeep file schema blob,
+// returning the ref of the schema blob.
+// The schema records the file's base name and modification time.
+// The Encoder's BlobReceiver must also be a blobserver.BlobStatter
+// (so that chunks already present need not be sent again).
+//
+// The blobs of the file are written by schema.WriteFileMap,
+// so the Encoder's JSON settings, hash, retries, and progress callback do not apply to them.
+// In dry-run mode nothing is stored, but the returned ref is correct.
+func (e *Encoder) EncodeFile(ctx context.Context, path string) (blob.Ref, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return blob.Ref{}, errors.Wrapf(err, "opening %s", path)
+	}
+	defer f.Close()
+	return e.EncodeOSFile(ctx, f)
+}
+
+// EncodeOSFile is like EncodeFile but reads from an open file.
+// The file is read from its current offset.
+func (e *Encoder) EncodeOSFile(ctx context.Context, f *os.File) (blob.Ref, error) {
+	var dst blobserver.StatReceiver
+	if e.dryRunFor(ctx) {
+		dst = discardReceiver{}
+	} else {
+		var ok bool
+		dst, ok = e.dst.(blobserver.StatReceiver)
+		if !ok {
+			return blob.Ref{}, errors.New("EncodeFile requires a BlobReceiver that is also a BlobStatter")
+		}
+	}
+	dst = recordingStatReceiver(ctx, dst)
+
+	info, err := f.Stat()
+	if err != nil {
+		return blob.Ref{}, errors.Wrapf(err, "getting info for %s", f.Name())
+	}
+	fileMap := schema.NewFileMap(filepath.Base(f.Name()))
+	fileMap.SetModTime(info.ModTime())
+
+	ref, err := schema.WriteFileMap(ctx, dst, fileMap, f)
+	return ref, errors.Wrapf(err, "storing %s", f.Name())
+}
+
+// RestoreFile writes the contents of the Perkeep file schema blob at ref
+// (as produced by Encoder.EncodeFile)
+// to a new file at destPath,
+// replacing any existing file there,
+// and sets its modification time to the one recorded in the schema.
+// If writing fails, the partial file is removed.
+func (d *Decoder) RestoreFile(ctx context.Context, ref blob.Ref, destPath string) (err error) {
+	fr, err := schema.NewFileReader(ctx, d.source(), ref)
+	if err != nil {
+		return errors.Wrapf(err, "reading file schema %s", ref)
+	}
+	defer fr.Close()
+
+	f, err := os.Create(destPath)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", destPath)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(destPath)
+		}
+	}()
+
+	_, err = io.Copy(f, fr)
+	if err != nil {
+		return errors.Wrapf(err, "writing %s", destPath)
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "closing %s", destPath)
+	}
+
+	if mtime := fr.ModTime(); !mtime.IsZero() {
+		err = os.Chtimes(destPath, mtime, mtime)
+		if err != nil {
+			return errors.Wrapf(err, "setting modification time of %s", destPath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package pk
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Converts the keys of m that contain dots into nested objects.
+// Struct field names like `pk:"addr.street"`
+// thus place the field in a group within the struct's JSON encoding:
+// {"addr": {"street": ...}}.
+func nestDottedKeys(m map[string]interface{}) (map[string]interface{}, error) {
+	var dotted []string
+	for k := range m {
+		if strings.Contains(k, ".") {
+			dotted = append(dotted, k)
+		}
+	}
+	if len(dotted) == 0 {
+		return m, nil
+	}
+
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if !strings.Contains(k, ".") {
+			result[k] = v
+		}
+	}
+	for _, k := range dotted {
+		var (
+			parts = strings.Split(k, ".")
+			group = result
+		)
+		for i, part := range parts[:len(parts)-1] {
+			sub, ok := group[part]
+			if !ok {
+				sub = make(map[string]interface{})
+				group[part] = sub
+			}
+			subgroup, ok := sub.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("field name %s conflicts with group %s", strings.Join(parts[:i+1], "."), k)
+			}
+			group = subgroup
+		}
+		last := parts[len(parts)-1]
+		if _, ok := group[last]; ok {
+			return nil, errors.Errorf("field name %s conflicts with a group of the same name", k)
+		}
+		group[last] = m[k]
+	}
+	return result, nil
+}
+
+// Caches the result of groupPrefixes by struct type.
+var groupCache sync.Map // reflect.Type -> map[string]bool
+
+// Returns the set of group prefixes implied by the dotted field names of struct type t.
+// E.g. a field named "a.b.c" implies the groups "a" and "a.b".
+// The result is shared and must not be modified.
+func groupPrefixes(t reflect.Type) map[string]bool {
+	if prefixes, ok := groupCache.Load(t); ok {
+		return prefixes.(map[string]bool)
+	}
+	prefixes := findGroupPrefixes(t)
+	groupCache.Store(t, prefixes)
+	return prefixes
+}
+
+func findGroupPrefixes(t reflect.Type) map[string]bool {
+	var result map[string]bool
+	for i := 0; i < t.NumField(); i++ {
+		name, o := parseTag(t.Field(i))
+		if o.Omit {
+			continue
+		}
+		parts := strings.Split(name, ".")
+		for j := 1; j < len(parts); j++ {
+			if result == nil {
+				result = make(map[string]bool)
+			}
+			result[strings.Join(parts[:j], ".")] = true
+		}
+	}
+	return result
+}
+
+// The inverse of nestDottedKeys, operating on a JSON object:
+// the members of nested objects whose (dotted) keys are in prefixes
+// are hoisted to the top level under dotted names.
+func flattenDottedKeys(s []byte, prefixes map[string]bool) ([]byte, error) {
+	var m map[string]json.RawMessage
+	err := json.Unmarshal(s, &m)
+	if err != nil {
+		return nil, err
+	}
+	flat := make(map[string]json.RawMessage)
+	err = flattenInto(flat, "", m, prefixes)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(flat)
+}
+
+func flattenInto(flat map[string]json.RawMessage, prefix string, m map[string]json.RawMessage, prefixes map[string]bool) error {
+	for k, v := range m {
+		name := prefix + k
+		if !prefixes[name] {
+			flat[name] = v
+			continue
+		}
+		var sub map[string]json.RawMessage
+		err := json.Unmarshal(v, &sub)
+		if err != nil {
+			return errors.Wrapf(err, "JSON-decoding group %s", name)
+		}
+		err = flattenInto(flat, name+".", sub, prefixes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
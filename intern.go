@@ -0,0 +1,62 @@
+package pk
+
+import "sync"
+
+// StringInterner deduplicates strings.
+// Intern returns a string equal to string(b),
+// ideally one it has returned before,
+// so that equal strings share storage.
+// It must not retain b.
+// See Decoder.SetStringInterner.
+type StringInterner interface {
+	Intern(b []byte) string
+}
+
+// NewStringInterner returns a StringInterner,
+// safe for concurrent use,
+// that remembers every distinct string it is given.
+func NewStringInterner() StringInterner {
+	return &mapInterner{m: make(map[string]string)}
+}
+
+type mapInterner struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func (in *mapInterner) Intern(b []byte) string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	// The compiler does not allocate for string(b) in a map index.
+	if s, ok := in.m[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	in.m[s] = s
+	return s
+}
+
+// SetStringInterner causes the Decoder to pass the bytes of each string it decodes
+// through in,
+// so that a tree with many equal string values
+// (such as enum-like names)
+// holds a single copy of each
+// rather than one per occurrence.
+// The interner is kept across calls to Decode,
+// so strings are shared among everything the Decoder decodes;
+// with NewStringInterner, memory for every distinct string is retained for the Decoder's lifetime.
+// It applies to values of string kind,
+// not to map keys or other strings within JSON blobs.
+// By default (and with a nil in) strings are not interned.
+func (d *Decoder) SetStringInterner(in StringInterner) {
+	d.interner = in
+}
+
+// Returns string(s), interned if the Decoder has an interner.
+func (d *Decoder) str(s []byte) string {
+	if d.interner == nil {
+		return string(s)
+	}
+	return d.interner.Intern(s)
+}
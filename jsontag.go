@@ -0,0 +1,70 @@
+package pk
+
+import (
+	"reflect"
+	"strings"
+)
+
+// SetJSONTagFallback tells whether a struct field
+// that has no pk tag but does have a json tag,
+// as in types written for encoding/json,
+// should be stored according to the json tag:
+// under the name it gives (if any) instead of under its Go name,
+// and skipped when zero if it has the omitempty option.
+// Other json options (such as string) are ignored,
+// as is a json tag of "-".
+// A pk tag, when present, always wins,
+// and a protobuf tag wins when SetProtobufTagFallback is also on.
+// Blobs written this way must be read with a Decoder
+// that has the same setting (see Decoder.SetJSONTagFallback).
+// By default json tags are ignored.
+func (e *Encoder) SetJSONTagFallback(val bool) {
+	e.jsonNames = val
+}
+
+// SetJSONTagFallback tells whether a struct field
+// that has no pk tag but does have a json tag
+// should be read from the key named in the json tag,
+// as written by an Encoder with the same setting
+// (see Encoder.SetJSONTagFallback).
+// By default json tags are ignored.
+func (d *Decoder) SetJSONTagFallback(val bool) {
+	d.jsonNames = val
+}
+
+// Returns the name in the json tag of tf
+// (or tf's Go name if the tag gives none)
+// and whether the tag has the omitempty option,
+// if tf has a json tag other than "-" and no pk tag.
+func jsonName(tf reflect.StructField) (name string, omitEmpty, ok bool) {
+	if _, ok := tf.Tag.Lookup("pk"); ok {
+		return "", false, false
+	}
+	tag, ok := tf.Tag.Lookup("json")
+	if !ok || tag == "-" {
+		return "", false, false
+	}
+	items := strings.Split(tag, ",")
+	name = items[0]
+	if name == "" {
+		name = tf.Name
+	}
+	for _, item := range items[1:] {
+		if item == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return name, omitEmpty, true
+}
+
+// Tells whether tf is to be skipped when zero because of its json tag.
+// The protobuf tag takes precedence when useProto is true.
+func jsonOmitEmpty(tf reflect.StructField, useProto bool) bool {
+	if useProto {
+		if _, ok := protoName(tf); ok {
+			return false
+		}
+	}
+	_, omitEmpty, ok := jsonName(tf)
+	return ok && omitEmpty
+}
@@ -0,0 +1,276 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// Node is a handle on one value in a tree of blobs written by pk,
+// for exploring the tree incrementally without decoding all of it.
+// A Node fetches its blob only when asked about its children,
+// and its children are Nodes in turn.
+// Load decodes a Node's value into a Go value on demand.
+//
+// A Node has no Go type to go by,
+// so its structure is inferred from its JSON:
+// an object (a struct, a map, or a sharded map) has keys,
+// and an array (a slice or array, possibly chunked) has elements.
+// Other values are leaves,
+// including the elements of slices and arrays of small scalars stored in one blob
+// (see Encoder.SetInlineSmallScalars).
+// Get Nodes with Decoder.DecodeLazy.
+type Node struct {
+	d    *Decoder
+	ref  blob.Ref        // the blob holding the value, if it is not inline
+	raw  json.RawMessage // the value's JSON, if it is inline in its parent's blob
+	leaf []byte          // the value's content, if it is an inline small scalar
+	path *pathElem
+}
+
+// DecodeLazy returns a Node for the value at ref,
+// without fetching anything.
+func (d *Decoder) DecodeLazy(ctx context.Context, ref blob.Ref) (*Node, error) {
+	if !ref.Valid() {
+		return nil, errors.New("invalid blobref")
+	}
+	return &Node{d: d, ref: ref}, nil
+}
+
+// Ref returns the blobref of n's value,
+// or the zero blobref if the value is stored inline in its parent's blob
+// (as are fields with the "inline" option, and the blobref lists of slice and map fields).
+func (n *Node) Ref() blob.Ref {
+	return n.ref
+}
+
+// Path returns the location of n beneath the root given to DecodeLazy,
+// in the form reported by PathFromContext.
+func (n *Node) Path() string {
+	return n.path.String()
+}
+
+// Returns the JSON of n's value, fetching it if necessary.
+func (n *Node) content(ctx context.Context) ([]byte, error) {
+	if n.leaf != nil {
+		return nil, errors.Errorf("value at path %q is a scalar", n.Path())
+	}
+	if n.raw != nil {
+		return n.raw, nil
+	}
+	s, err := n.d.fetchStructure(n.d.withBudget(ctx), n.ref)
+	return s, errors.Wrapf(err, "fetching %s at path %q", n.ref, n.Path())
+}
+
+// Tells whether s is a chunk index (see SetChunkFanout).
+func isChunkIndex(s []byte) bool {
+	var m map[string]json.RawMessage
+	if json.Unmarshal(s, &m) != nil || len(m) != 2 {
+		return false
+	}
+	_, hasLen := m["len"]
+	_, hasChunks := m["chunks"]
+	return hasLen && hasChunks
+}
+
+// Tells whether s holds an array of elements.
+func isArrayJSON(s []byte) bool {
+	t := bytes.TrimSpace(s)
+	if len(t) == 0 {
+		return false
+	}
+	if t[0] == '[' {
+		return true
+	}
+	if t[0] != '{' {
+		return false
+	}
+	_, ok := parseScalarValues(t)
+	return ok || isChunkIndex(t)
+}
+
+// Returns the entries of the object s, with the values of a sharded map as blobrefs.
+func (n *Node) entries(ctx context.Context, s []byte) (map[string]json.RawMessage, error) {
+	if t := bytes.TrimSpace(s); len(t) == 0 || t[0] != '{' || isArrayJSON(t) {
+		return nil, errors.Errorf("value at path %q is not an object", n.Path())
+	}
+	if _, ok := parseShardDir(s); ok {
+		mm, err := n.d.readRefMap(n.d.withBudget(ctx), s, reflect.TypeOf(""))
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading sharded map at path %q", n.Path())
+		}
+		result := make(map[string]json.RawMessage, mm.Len())
+		iter := mm.MapRange()
+		for iter.Next() {
+			result[iter.Key().String()], err = json.Marshal(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(s, &m); err != nil {
+		return nil, errors.Wrapf(err, "JSON-decoding object at path %q", n.Path())
+	}
+	delete(m, summaryKey)
+	delete(m, inlineScalarsKey)
+	delete(m, camliSignerKey)
+	delete(m, camliSigKey)
+	return m, nil
+}
+
+// Keys returns the keys of n's value,
+// which must be an object:
+// the stored names of a struct's fields or the keys of a map,
+// sorted.
+func (n *Node) Keys(ctx context.Context) ([]string, error) {
+	s, err := n.content(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m, err := n.entries(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Field returns the Node for the value under key in n's value,
+// which must be an object.
+func (n *Node) Field(ctx context.Context, key string) (*Node, error) {
+	s, err := n.content(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m, err := n.entries(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := m[key]
+	if !ok {
+		return nil, errors.Errorf("no key %q at path %q", key, n.Path())
+	}
+	return n.child(raw, &pathElem{parent: n.path, step: key, field: true}), nil
+}
+
+// Returns the elements of n's value, which must be an array:
+// their refs,
+// or their contents if they are small scalars stored inline.
+func (n *Node) elements(ctx context.Context) ([]blob.Ref, []string, error) {
+	s, err := n.content(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isArrayJSON(s) {
+		return nil, nil, errors.Errorf("value at path %q is not an array", n.Path())
+	}
+	if vals, ok := parseScalarValues(s); ok && n.raw == nil {
+		return nil, vals, nil
+	}
+	refs, err := n.d.readRefArray(n.d.withBudget(ctx), s)
+	return refs, nil, errors.Wrapf(err, "reading blobref array at path %q", n.Path())
+}
+
+// Len returns the number of elements in n's value,
+// which must be an array.
+func (n *Node) Len(ctx context.Context) (int, error) {
+	refs, vals, err := n.elements(ctx)
+	return len(refs) + len(vals), err
+}
+
+// Index returns the Node for element i of n's value,
+// which must be an array.
+func (n *Node) Index(ctx context.Context, i int) (*Node, error) {
+	refs, vals, err := n.elements(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if l := len(refs) + len(vals); i < 0 || i >= l {
+		return nil, errors.Errorf("index [%d] out of range at path %q (length %d)", i, n.Path(), l)
+	}
+	path := &pathElem{parent: n.path, step: "[" + strconv.Itoa(i) + "]"}
+	if vals != nil {
+		return &Node{d: n.d, leaf: []byte(vals[i]), path: path}, nil
+	}
+	return &Node{d: n.d, ref: refs[i], path: path}, nil
+}
+
+// Makes a child Node from raw, its JSON in n's blob.
+func (n *Node) child(raw json.RawMessage, path *pathElem) *Node {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		if ref, ok := blob.Parse(s); ok {
+			return &Node{d: n.d, ref: ref, path: path}
+		}
+	}
+	return &Node{d: n.d, raw: raw, path: path}
+}
+
+// Load decodes n's value, and everything beneath it, into obj,
+// which must be a pointer,
+// as Decoder.Decode would.
+func (n *Node) Load(ctx context.Context, obj interface{}) error {
+	ctx = withPath(ctx, n.path)
+	if n.raw == nil && n.leaf == nil {
+		return n.d.Decode(ctx, n.ref, obj)
+	}
+
+	// An inline value.
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Ptr {
+		return ErrNotPointer
+	}
+	if v.IsNil() {
+		return ErrNilPointer
+	}
+	if n.leaf != nil {
+		if !isScalarKind(v.Elem().Kind()) {
+			return errors.Errorf("cannot decode inline scalar at path %q into %s", n.Path(), v.Elem().Type())
+		}
+		err := n.d.setScalar(v.Elem(), n.leaf)
+		return errors.Wrapf(err, "decoding inline scalar at path %q", n.Path())
+	}
+	ctx = n.d.withBudget(ctx)
+	switch el := v.Elem(); el.Kind() {
+	case reflect.Slice, reflect.Array:
+		if !isArrayJSON(n.raw) {
+			break
+		}
+		refs, err := n.d.readRefArray(ctx, n.raw)
+		if err != nil {
+			// Not an array of refs; try it as an inline array value.
+			break
+		}
+		if el.Kind() == reflect.Array {
+			return n.d.buildArray(ctx, el, refs)
+		}
+		slice, err := n.d.buildSlice(ctx, el, refs)
+		if err != nil {
+			return err
+		}
+		el.Set(slice)
+		return nil
+
+	case reflect.Map:
+		mm, err := n.d.readRefMap(ctx, n.raw, el.Type().Key())
+		if err != nil {
+			// Not a map of refs; try it as an inline map value.
+			break
+		}
+		return n.d.buildMap(ctx, el, mm)
+	}
+	err := n.d.newJSONDecoder(bytes.NewReader(n.raw)).Decode(obj)
+	return errors.Wrapf(err, "JSON-decoding inline value at path %q", n.Path())
+}
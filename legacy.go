@@ -0,0 +1,62 @@
+package pk
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// SetLegacyNameFallback tells whether a struct field
+// whose stored name (from its pk tag) is absent from a struct blob
+// should be read from the key of its Go field name instead, if that is present.
+// This allows reading blobs written before fields were renamed with pk tags,
+// such as a field Name that was stored as "Name"
+// before it was tagged `pk:"name"`.
+// A Go field name is not used
+// if it is also the stored name of some other field.
+// By default only stored names are used.
+func (d *Decoder) SetLegacyNameFallback(val bool) {
+	d.legacyNames = val
+}
+
+// Rewrites s, the JSON object for a struct of type t,
+// renaming the key of each field's Go name to the field's stored name
+// where the latter is absent.
+func renameLegacyKeys(s []byte, t reflect.Type) ([]byte, error) {
+	declared := declaredNames(t, -1)
+	renames := make(map[string]string) // Go name -> stored name
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		name, o := parseTag(tf)
+		if o.Omit || name == tf.Name || declared[tf.Name] {
+			continue
+		}
+		renames[tf.Name] = name
+	}
+	if len(renames) == 0 {
+		return s, nil
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(s, &m); err != nil {
+		return nil, errors.Wrap(err, "JSON-decoding struct")
+	}
+	var changed bool
+	for goName, name := range renames {
+		v, ok := m[goName]
+		if !ok {
+			continue
+		}
+		if _, ok := m[name]; ok {
+			continue
+		}
+		m[name] = v
+		delete(m, goName)
+		changed = true
+	}
+	if !changed {
+		return s, nil
+	}
+	return json.Marshal(m)
+}
@@ -0,0 +1,90 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// Log is an append-only, hash-linked chain of marshaled objects,
+// e.g. for event sourcing.
+// Each entry records the root of one marshaled object
+// and the ref of the previous entry,
+// so the ref of the newest entry (the head) identifies the whole history.
+//
+// Each entry is stored as the JSON object {"prev": ref, "obj": ref},
+// where prev is null in the first entry.
+//
+// A Log is not safe for concurrent use.
+type Log struct {
+	enc  *Encoder
+	prev blob.Ref
+}
+
+type logEntry struct {
+	Prev blob.Ref `json:"prev"`
+	Obj  blob.Ref `json:"obj"`
+}
+
+// NewLog creates a Log that appends entries using enc.
+// The new entries extend the chain whose head is prev;
+// use the zero blob.Ref to start a new chain.
+func NewLog(enc *Encoder, prev blob.Ref) *Log {
+	return &Log{enc: enc, prev: prev}
+}
+
+// Append marshals obj,
+// adds an entry for it to the log,
+// and returns the ref of the entry,
+// which is the log's new head.
+func (l *Log) Append(ctx context.Context, obj interface{}) (blob.Ref, error) {
+	objRef, err := l.enc.Encode(ctx, obj)
+	if err != nil {
+		return blob.Ref{}, errors.Wrap(err, "storing log object")
+	}
+	sref, err := l.enc.receiveJSON(ctx, logEntry{Prev: l.prev, Obj: objRef})
+	if err != nil {
+		return blob.Ref{}, errors.Wrap(err, "storing log entry")
+	}
+	l.prev = sref.Ref
+	return sref.Ref, nil
+}
+
+// Head returns the ref of the newest entry in the log
+// (or the prev value given to NewLog if nothing has been appended).
+func (l *Log) Head() blob.Ref {
+	return l.prev
+}
+
+// Replay walks the log whose newest entry is head,
+// following each entry's prev link backward to the start of the chain,
+// then calls f with the root ref of each entry's object,
+// oldest first.
+// The callback typically decodes the object with d.Decode.
+// If f returns an error, Replay stops and returns it.
+func (d *Decoder) Replay(ctx context.Context, head blob.Ref, f func(objRef blob.Ref) error) error {
+	ctx = d.withBudget(ctx)
+	var objRefs []blob.Ref
+	for ref := head; ref.Valid(); {
+		s, err := d.fetchStructure(ctx, ref)
+		if err != nil {
+			return errors.Wrapf(err, "fetching log entry %s", ref)
+		}
+		var entry logEntry
+		dec := d.newJSONDecoder(bytes.NewReader(s))
+		err = dec.Decode(&entry)
+		if err != nil {
+			return errors.Wrapf(err, "JSON-decoding log entry %s", ref)
+		}
+		objRefs = append(objRefs, entry.Obj)
+		ref = entry.Prev
+	}
+	for i := len(objRefs) - 1; i >= 0; i-- {
+		if err := f(objRefs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
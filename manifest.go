@@ -0,0 +1,134 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// MarshalWithManifest is like Marshal
+// but additionally stores a manifest blob listing every blob in the marshaled tree.
+// See Encoder.EncodeWithManifest.
+func MarshalWithManifest(ctx context.Context, dst blobserver.BlobReceiver, obj interface{}) (root, manifest blob.Ref, err error) {
+	return NewEncoder(dst).EncodeWithManifest(ctx, obj)
+}
+
+// EncodeWithManifest is like Encode,
+// but after encoding obj it writes an extra "manifest" blob
+// and returns its ref along with the root ref.
+// A single fetch of the manifest tells the full set of blobs
+// making up the tree, e.g. for replication.
+//
+// The manifest is a JSON array of blobrefs: "[ref,ref,...]".
+// It contains the ref of each distinct blob making up the encoding of obj
+// (including the root and any blobs written by Marshaler implementations),
+// sorted by their string form.
+// That includes blobs that were not written because they were already stored
+// (see SetDedupCache, SetKnownRefs, and EncodeDelta).
+// The manifest does not list itself.
+func (e *Encoder) EncodeWithManifest(ctx context.Context, obj interface{}) (root, manifest blob.Ref, err error) {
+	m := &manifestRefs{refs: make(map[blob.Ref]struct{})}
+	root, err = e.Encode(context.WithValue(ctx, manifestKey{}, m), obj)
+	if err != nil {
+		return blob.Ref{}, blob.Ref{}, err
+	}
+
+	refs := m.sorted()
+	buf := new(bytes.Buffer)
+	enc := e.newJSONEncoder(buf)
+	err = enc.Encode(refs)
+	if err != nil {
+		return blob.Ref{}, blob.Ref{}, errors.Wrap(err, "encoding manifest")
+	}
+	sref, err := e.receiveString(ctx, buf.String())
+	if err != nil {
+		return blob.Ref{}, blob.Ref{}, errors.Wrap(err, "storing manifest")
+	}
+	return root, sref.Ref, nil
+}
+
+// manifestRefs collects the refs for the manifest of an EncodeWithManifest call.
+// It travels in the context under manifestKey.
+// Blobs are recorded whether or not they are actually written
+// (they may be skipped as already stored, e.g. by the dedup cache or EncodeDelta),
+// since the manifest lists the whole tree.
+type manifestRefs struct {
+	mu   sync.Mutex
+	refs map[blob.Ref]struct{}
+}
+
+func manifestFor(ctx context.Context) *manifestRefs {
+	m, _ := ctx.Value(manifestKey{}).(*manifestRefs)
+	return m
+}
+
+func (m *manifestRefs) add(ref blob.Ref) {
+	m.mu.Lock()
+	m.refs[ref] = struct{}{}
+	m.mu.Unlock()
+}
+
+func (m *manifestRefs) sorted() []blob.Ref {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]blob.Ref, 0, len(m.refs))
+	for ref := range m.refs {
+		result = append(result, ref)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Less(result[j]) })
+	return result
+}
+
+// Returns dst,
+// wrapped to record the blobs it receives in ctx's manifest
+// if there is one.
+// This is for blobs that are written directly,
+// not through receiveString,
+// such as those of Marshaler implementations.
+func recordingReceiver(ctx context.Context, dst blobserver.BlobReceiver) blobserver.BlobReceiver {
+	if m := manifestFor(ctx); m != nil {
+		return manifestReceiver{BlobReceiver: dst, m: m}
+	}
+	return dst
+}
+
+// Like recordingReceiver but for a StatReceiver.
+// Blobs that dst reports as already present are recorded too.
+func recordingStatReceiver(ctx context.Context, dst blobserver.StatReceiver) blobserver.StatReceiver {
+	if m := manifestFor(ctx); m != nil {
+		return manifestStatReceiver{manifestReceiver: manifestReceiver{BlobReceiver: dst, m: m}, statter: dst}
+	}
+	return dst
+}
+
+type manifestReceiver struct {
+	blobserver.BlobReceiver
+	m *manifestRefs
+}
+
+func (r manifestReceiver) ReceiveBlob(ctx context.Context, ref blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	sref, err := r.BlobReceiver.ReceiveBlob(ctx, ref, source)
+	if err != nil {
+		return sref, err
+	}
+	r.m.add(sref.Ref)
+	return sref, nil
+}
+
+type manifestStatReceiver struct {
+	manifestReceiver
+	statter blobserver.BlobStatter
+}
+
+func (r manifestStatReceiver) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	return r.statter.StatBlobs(ctx, blobs, func(sref blob.SizedRef) error {
+		r.m.add(sref.Ref)
+		return fn(sref)
+	})
+}
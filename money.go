@@ -0,0 +1,88 @@
+package pk
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// Tells whether a field with type t and tag options o
+// is an amount of money to be stored as a single string like "USD 12.34":
+// a struct with an integer field Amount and a string field Currency.
+func isMoney(t reflect.Type, o options) bool {
+	if !o.Money || t.Kind() != reflect.Struct {
+		return false
+	}
+	amount, ok := t.FieldByName("Amount")
+	if !ok || len(amount.Index) != 1 {
+		return false
+	}
+	switch amount.Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+	default:
+		return false
+	}
+	currency, ok := t.FieldByName("Currency")
+	return ok && len(currency.Index) == 1 && currency.Type.Kind() == reflect.String
+}
+
+// Formats the money value v (see isMoney)
+// as its currency, a space, and its amount with two decimal places.
+// The amount is a count of hundredths of the currency unit.
+func formatMoney(v reflect.Value) (string, error) {
+	var (
+		amount   = v.FieldByName("Amount").Int()
+		currency = v.FieldByName("Currency").String()
+	)
+	if currency == "" || strings.ContainsAny(currency, " \t\n") {
+		return "", errors.Errorf("invalid currency %q", currency)
+	}
+	var (
+		sign string
+		u    = uint64(amount)
+	)
+	if amount < 0 {
+		sign = "-"
+		u = -u
+	}
+	frac := strconv.FormatUint(u%100, 10)
+	if len(frac) < 2 {
+		frac = "0" + frac
+	}
+	return currency + " " + sign + strconv.FormatUint(u/100, 10) + "." + frac, nil
+}
+
+// Parses s, as produced by formatMoney, into v.
+func parseMoney(s string, v reflect.Value) error {
+	currency, num, ok := strings.Cut(s, " ")
+	if !ok || currency == "" {
+		return errors.Errorf("invalid money value %q", s)
+	}
+	digits := strings.TrimPrefix(num, "-")
+	dot := strings.IndexByte(digits, '.')
+	if dot < 1 || len(digits)-dot != 3 || strings.Trim(digits[:dot]+digits[dot+1:], "0123456789") != "" {
+		return errors.Errorf("invalid amount in money value %q", s)
+	}
+	amountField := v.FieldByName("Amount")
+	amount, err := strconv.ParseInt(num[:len(num)-3]+num[len(num)-2:], 10, amountField.Type().Bits())
+	if err != nil {
+		return errors.Wrapf(err, "parsing amount in money value %q", s)
+	}
+	amountField.SetInt(amount)
+	v.FieldByName("Currency").SetString(currency)
+	return nil
+}
+
+// Stores the money value v as a single blob.
+func (e *Encoder) encodeMoney(ctx context.Context, v reflect.Value) (blob.Ref, error) {
+	s, err := formatMoney(v)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	sref, err := e.receiveString(ctx, s)
+	return sref.Ref, errors.Wrap(err, "storing money value")
+}
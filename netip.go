@@ -0,0 +1,24 @@
+package pk
+
+import (
+	"encoding"
+	"net/netip"
+	"reflect"
+)
+
+var (
+	addrType   = reflect.TypeOf(netip.Addr{})
+	prefixType = reflect.TypeOf(netip.Prefix{})
+)
+
+// Tells whether t is netip.Addr or netip.Prefix,
+// which are stored as their text forms.
+func isNetipType(t reflect.Type) bool {
+	return t == addrType || t == prefixType
+}
+
+// Returns the text form of v, a netip.Addr or netip.Prefix.
+func netipText(v reflect.Value) (string, error) {
+	b, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+	return string(b), err
+}
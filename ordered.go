@@ -0,0 +1,172 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// OrderedMap is a map that remembers the order in which its keys were added.
+// Unlike a native map,
+// it marshals as a JSON array of [key, valueRef] pairs,
+// in order,
+// and unmarshals back in the same order.
+// As with native maps, keys are stored directly in the JSON
+// (so must be JSON-marshalable)
+// and values are stored as blobrefs.
+//
+// The zero OrderedMap is empty and ready to use.
+type OrderedMap[K comparable, V any] struct {
+	keys []K
+	vals map[K]V
+}
+
+// Get returns the value for key k and whether it is present.
+func (m *OrderedMap[K, V]) Get(k K) (V, bool) {
+	v, ok := m.vals[k]
+	return v, ok
+}
+
+// Set sets the value for key k.
+// A new key is added at the end of the order;
+// an existing key keeps its position.
+func (m *OrderedMap[K, V]) Set(k K, v V) {
+	if m.vals == nil {
+		m.vals = make(map[K]V)
+	}
+	if _, ok := m.vals[k]; !ok {
+		m.keys = append(m.keys, k)
+	}
+	m.vals[k] = v
+}
+
+// Delete removes key k, if present.
+func (m *OrderedMap[K, V]) Delete(k K) {
+	if _, ok := m.vals[k]; !ok {
+		return
+	}
+	delete(m.vals, k)
+	for i, key := range m.keys {
+		if key == k {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Len returns the number of keys in m.
+func (m *OrderedMap[K, V]) Len() int {
+	return len(m.keys)
+}
+
+// Range calls f on each key and value in order,
+// stopping early if f returns false.
+func (m *OrderedMap[K, V]) Range(f func(K, V) bool) {
+	for _, k := range m.keys {
+		if !f(k, m.vals[k]) {
+			return
+		}
+	}
+}
+
+// These interfaces are how Encode and Decode recognize an OrderedMap
+// regardless of its type parameters.
+
+type orderedMapEncoder interface {
+	pkOrderedPairs() (keys, vals []reflect.Value)
+}
+
+type orderedMapDecoder interface {
+	pkOrderedTypes() (kt, vt reflect.Type)
+	pkOrderedReset()
+	pkOrderedAppend(k, v reflect.Value)
+}
+
+func (m OrderedMap[K, V]) pkOrderedPairs() (keys, vals []reflect.Value) {
+	for _, k := range m.keys {
+		keys = append(keys, reflect.ValueOf(k))
+		vals = append(vals, reflect.ValueOf(m.vals[k]))
+	}
+	return keys, vals
+}
+
+func (m *OrderedMap[K, V]) pkOrderedTypes() (kt, vt reflect.Type) {
+	return reflect.TypeOf((*K)(nil)).Elem(), reflect.TypeOf((*V)(nil)).Elem()
+}
+
+func (m *OrderedMap[K, V]) pkOrderedReset() {
+	m.keys, m.vals = nil, nil
+}
+
+func (m *OrderedMap[K, V]) pkOrderedAppend(k, v reflect.Value) {
+	m.Set(k.Interface().(K), v.Interface().(V))
+}
+
+func (e *Encoder) encodeOrderedMap(ctx context.Context, om orderedMapEncoder) (blob.Ref, error) {
+	keys, vals := om.pkOrderedPairs()
+	refs := make([]blob.Ref, len(keys))
+	err := e.forEach(ctx, len(keys), func(ctx context.Context, i int) error {
+		ref, err := e.encodeValue(withPathKey(ctx, keys[i]), vals[i])
+		if err != nil {
+			return err
+		}
+		refs[i] = ref
+		return nil
+	})
+	if err != nil {
+		return blob.Ref{}, err
+	}
+
+	pairs := make([][2]interface{}, 0, len(keys))
+	for i, k := range keys {
+		pairs = append(pairs, [2]interface{}{k.Interface(), refs[i]})
+	}
+	sref, err := e.receiveJSON(ctx, pairs)
+	return sref.Ref, errors.Wrap(err, "storing ordered map")
+}
+
+func (d *Decoder) decodeOrderedMap(ctx context.Context, s []byte, om orderedMapDecoder) error {
+	var pairs [][2]json.RawMessage
+	dec := d.newJSONDecoder(bytes.NewReader(s))
+	err := dec.Decode(&pairs)
+	if err != nil {
+		return errors.Wrap(err, "JSON-decoding ordered map")
+	}
+
+	if err := d.checkRefCount(len(pairs)); err != nil {
+		return err
+	}
+
+	kt, vt := om.pkOrderedTypes()
+	om.pkOrderedReset()
+	for _, pair := range pairs {
+		k := reflect.New(kt)
+		err = json.Unmarshal(pair[0], k.Interface())
+		if err != nil {
+			return errors.Wrapf(err, "JSON-decoding ordered map key %s", string(pair[0]))
+		}
+		var ref blob.Ref
+		err = json.Unmarshal(pair[1], &ref)
+		if err != nil {
+			return errors.Wrapf(err, "JSON-decoding ordered map ref %s", string(pair[1]))
+		}
+		v, err := newValue(vt)
+		if err != nil {
+			return err
+		}
+		elCtx := withPathKey(ctx, k.Elem())
+		err = d.Decode(elCtx, ref, v.Interface())
+		if err != nil {
+			if skipElement(elCtx, err) {
+				continue
+			}
+			return errors.Wrapf(err, "decoding ordered map value for key %v", k.Elem())
+		}
+		om.pkOrderedAppend(k.Elem(), v.Elem())
+	}
+	return nil
+}
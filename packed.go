@@ -0,0 +1,119 @@
+package pk
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// Tells whether a field with type t and tag options o
+// is a slice of numbers to be stored as a single packed binary blob.
+func isPacked(t reflect.Type, o options) bool {
+	return o.Packed && t.Kind() == reflect.Slice && packedSize(t.Elem()) > 0
+}
+
+// Returns the number of bytes per element
+// in the packed form of a slice with element type t,
+// or 0 if such slices cannot be packed.
+// Ints and uints are stored in 64 bits regardless of platform.
+func packedSize(t reflect.Type) int {
+	switch t.Kind() {
+	case reflect.Int8, reflect.Uint8:
+		return 1
+	case reflect.Int16, reflect.Uint16:
+		return 2
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 4
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Float64:
+		return 8
+	}
+	return 0
+}
+
+// Stores the elements of slice v, one after another, little-endian,
+// as a single blob.
+func (e *Encoder) encodePacked(ctx context.Context, v reflect.Value) (blob.Ref, error) {
+	size := packedSize(v.Type().Elem())
+	buf := make([]byte, v.Len()*size)
+	for i := 0; i < v.Len(); i++ {
+		var (
+			el = v.Index(i)
+			b  = buf[i*size : (i+1)*size]
+			u  uint64
+		)
+		switch el.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			u = uint64(el.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			u = el.Uint()
+		case reflect.Float32:
+			u = uint64(math.Float32bits(float32(el.Float())))
+		case reflect.Float64:
+			u = math.Float64bits(el.Float())
+		}
+		switch size {
+		case 1:
+			b[0] = byte(u)
+		case 2:
+			binary.LittleEndian.PutUint16(b, uint16(u))
+		case 4:
+			binary.LittleEndian.PutUint32(b, uint32(u))
+		case 8:
+			binary.LittleEndian.PutUint64(b, u)
+		}
+	}
+	sref, err := e.receiveString(ctx, string(buf))
+	return sref.Ref, errors.Wrap(err, "storing packed slice")
+}
+
+// Parses s, a packed slice, into a new slice of type t.
+// An empty blob parses as a nil slice.
+func parsePacked(s []byte, t reflect.Type) (reflect.Value, error) {
+	if len(s) == 0 {
+		return reflect.Zero(t), nil
+	}
+	size := packedSize(t.Elem())
+	if len(s)%size != 0 {
+		return reflect.Value{}, errors.Errorf("packed %s has %d bytes, not a multiple of %d", t, len(s), size)
+	}
+	n := len(s) / size
+	result := reflect.MakeSlice(t, n, n)
+	for i := 0; i < n; i++ {
+		var (
+			el = result.Index(i)
+			b  = s[i*size : (i+1)*size]
+			u  uint64
+		)
+		switch size {
+		case 1:
+			u = uint64(b[0])
+		case 2:
+			u = uint64(binary.LittleEndian.Uint16(b))
+		case 4:
+			u = uint64(binary.LittleEndian.Uint32(b))
+		case 8:
+			u = binary.LittleEndian.Uint64(b)
+		}
+		switch el.Kind() {
+		case reflect.Int, reflect.Int64:
+			el.SetInt(int64(u))
+		case reflect.Int8:
+			el.SetInt(int64(int8(u)))
+		case reflect.Int16:
+			el.SetInt(int64(int16(u)))
+		case reflect.Int32:
+			el.SetInt(int64(int32(u)))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			el.SetUint(u)
+		case reflect.Float32:
+			el.SetFloat(float64(math.Float32frombits(uint32(u))))
+		case reflect.Float64:
+			el.SetFloat(math.Float64frombits(u))
+		}
+	}
+	return result, nil
+}
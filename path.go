@@ -0,0 +1,74 @@
+package pk
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathKey is the context key under which Encoder and Decoder
+// record the location within the tree currently being processed.
+type pathKey struct{}
+
+// PathFromContext returns the location, within the tree being marshaled or unmarshaled,
+// of the value that a Marshaler or Unmarshaler is being invoked for.
+// It is meant for use in PkMarshal and PkUnmarshal implementations,
+// e.g. for logging and error messages.
+//
+// The path is a sequence of struct field names (as stored, i.e. after applying pk tags),
+// separated by dots,
+// and bracketed slice or array indexes and map keys,
+// like "Order.Items[2].Name".
+// The root of the tree has the empty path,
+// as does any context not derived from one passed in by an Encoder or Decoder.
+func PathFromContext(ctx context.Context) string {
+	p, _ := ctx.Value(pathKey{}).(*pathElem)
+	return p.String()
+}
+
+// pathElem is one step of a path,
+// linked to its parent
+// so that extending a path is cheap however deep it is;
+// the string form is built only on request.
+type pathElem struct {
+	parent *pathElem
+	step   string // a field name, or a bracketed index or key
+	field  bool
+}
+
+func (p *pathElem) String() string {
+	var elems []*pathElem
+	for ; p != nil; p = p.parent {
+		elems = append(elems, p)
+	}
+	var b strings.Builder
+	for i := len(elems) - 1; i >= 0; i-- {
+		if elems[i].field && i < len(elems)-1 {
+			b.WriteByte('.')
+		}
+		b.WriteString(elems[i].step)
+	}
+	return b.String()
+}
+
+func pathFrom(ctx context.Context) *pathElem {
+	p, _ := ctx.Value(pathKey{}).(*pathElem)
+	return p
+}
+
+func withPath(ctx context.Context, p *pathElem) context.Context {
+	return context.WithValue(ctx, pathKey{}, p)
+}
+
+func withPathField(ctx context.Context, name string) context.Context {
+	return withPath(ctx, &pathElem{parent: pathFrom(ctx), step: name, field: true})
+}
+
+func withPathIndex(ctx context.Context, i int) context.Context {
+	return withPath(ctx, &pathElem{parent: pathFrom(ctx), step: "[" + strconv.Itoa(i) + "]"})
+}
+
+func withPathKey(ctx context.Context, key interface{}) context.Context {
+	return withPath(ctx, &pathElem{parent: pathFrom(ctx), step: fmt.Sprintf("[%v]", key)})
+}
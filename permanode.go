@@ -0,0 +1,323 @@
+package pk
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// SetPermanodeSigner switches e to permanode mode when signer is non-nil.
+// In that mode,
+// Encode stores a struct (or pointer to struct)
+// not as an immutable JSON blob
+// but as a new Perkeep permanode
+// with claims, signed by signer, setting an attribute for each field,
+// and returns the permanode's blobref.
+// The object can then be edited with Perkeep's own tools
+// by adding further claims.
+// See also EncodeToPermanode.
+//
+// Each field's attribute is named like the field's key in the default form.
+// Booleans, numbers, strings, and time.Time values (in RFC 3339 format)
+// are stored directly as attribute values,
+// and slices of those as multi-valued attributes
+// (with a del-attribute claim followed by an add-attribute claim per element);
+// any other field is encoded as usual,
+// and its attribute holds the resulting blobref.
+// Fields tagged omitempty are skipped when they are zero.
+//
+// The claims can be verified only with signer's public key,
+// which the caller must make available to the Perkeep server.
+// Decoding a permanode requires Decoder.SetPermanodeAttrs.
+//
+// A nil signer (the default) restores the normal, immutable mode.
+func (e *Encoder) SetPermanodeSigner(signer *schema.Signer) {
+	e.permanodeSigner = signer
+}
+
+// EncodeToPermanode stores obj, a struct or pointer to struct,
+// as signed claims on the existing permanode pn,
+// as described at SetPermanodeSigner,
+// which must have been called with a non-nil signer.
+func (e *Encoder) EncodeToPermanode(ctx context.Context, pn blob.Ref, obj interface{}) error {
+	if e.permanodeSigner == nil {
+		return errors.New("no signer for permanode claims (see SetPermanodeSigner)")
+	}
+	v, err := permanodeStruct(reflect.ValueOf(obj))
+	if err != nil {
+		return err
+	}
+	return e.setAttrs(ctx, pn, v)
+}
+
+// Stores obj as a new permanode and returns its ref.
+func (e *Encoder) encodePermanode(ctx context.Context, obj interface{}) (blob.Ref, error) {
+	v, err := permanodeStruct(reflect.ValueOf(obj))
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	signed, err := schema.NewUnsignedPermanode().Sign(ctx, e.permanodeSigner)
+	if err != nil {
+		return blob.Ref{}, errors.Wrap(err, "signing permanode")
+	}
+	sref, err := e.receiveString(ctx, signed)
+	if err != nil {
+		return blob.Ref{}, errors.Wrap(err, "storing permanode")
+	}
+	return sref.Ref, e.setAttrs(ctx, sref.Ref, v)
+}
+
+// Dereferences v down to a struct, or reports an error.
+func permanodeStruct(v reflect.Value) (reflect.Value, error) {
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		name := "nil"
+		if v.IsValid() {
+			name = v.Type().String()
+		}
+		return reflect.Value{}, errors.Errorf("cannot store %s as a permanode, want a struct", name)
+	}
+	return v, nil
+}
+
+// Stores signed claims on pn setting an attribute for each field of struct v.
+func (e *Encoder) setAttrs(ctx context.Context, pn blob.Ref, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, o := parseTag(t.Field(i))
+		if o.Omit {
+			continue
+		}
+		vf := v.Field(i)
+		if o.OmitEmpty && vf.IsZero() {
+			continue
+		}
+		fctx := withPathField(ctx, name)
+		if !isMultiValued(vf.Type()) {
+			val, err := e.attrValue(fctx, vf)
+			if err != nil {
+				return errors.Wrapf(err, "encoding field %s of struct type %s", name, t)
+			}
+			if err := e.storeClaim(ctx, schema.NewSetAttributeClaim(pn, name, val)); err != nil {
+				return errors.Wrapf(err, "field %s", name)
+			}
+			continue
+		}
+		if err := e.storeClaim(ctx, schema.NewDelAttributeClaim(pn, name, "")); err != nil {
+			return errors.Wrapf(err, "field %s", name)
+		}
+		for j := 0; j < vf.Len(); j++ {
+			val, err := e.attrValue(withPathIndex(fctx, j), vf.Index(j))
+			if err != nil {
+				return errors.Wrapf(err, "encoding element %d of field %s of struct type %s", j, name, t)
+			}
+			if err := e.storeClaim(ctx, schema.NewAddAttributeClaim(pn, name, val)); err != nil {
+				return errors.Wrapf(err, "field %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Signs and stores the claim in b.
+func (e *Encoder) storeClaim(ctx context.Context, b *schema.Builder) error {
+	signed, err := b.Sign(ctx, e.permanodeSigner)
+	if err != nil {
+		return errors.Wrap(err, "signing claim")
+	}
+	_, err = e.receiveString(ctx, signed)
+	return errors.Wrap(err, "storing claim")
+}
+
+// Tells whether a field of type t is stored as a multi-valued attribute:
+// a slice of booleans, numbers, strings, or times.
+func isMultiValued(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice {
+		return false
+	}
+	el := t.Elem()
+	return el == timeType || isScalarKind(el.Kind())
+}
+
+// Produces the attribute value for field value v.
+func (e *Encoder) attrValue(ctx context.Context, v reflect.Value) (string, error) {
+	t := v.Type()
+	if t == timeType && v.CanInterface() {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if s, ok := enumName(t, v.Int()); ok {
+			return s, nil
+		}
+		return strconv.FormatInt(v.Int(), 10), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, t.Bits()), nil
+
+	case reflect.String:
+		return v.String(), nil
+	}
+	ref, err := e.encodeValue(ctx, v)
+	return ref.String(), err
+}
+
+// PermanodeAttrsFunc is the type of a callback that reports
+// the current attributes of the Perkeep permanode pn,
+// such as the Attr field of a search.DescribedPermanode
+// from a Perkeep server's search index.
+type PermanodeAttrsFunc func(ctx context.Context, pn blob.Ref) (url.Values, error)
+
+// SetPermanodeAttrs lets d decode permanodes
+// written in permanode mode (see Encoder.SetPermanodeSigner).
+// A Decoder reads only blobs,
+// and cannot itself work out which claims on a permanode are current,
+// so it relies on f for that.
+//
+// When f is non-nil and Decode finds a permanode where it expects a struct,
+// it decodes the permanode as DecodePermanode does.
+// By default f is nil, and permanodes are not recognized.
+func (d *Decoder) SetPermanodeAttrs(f PermanodeAttrsFunc) {
+	d.permanodeAttrs = f
+}
+
+// Tells whether the blob s is a permanode.
+func isPermanode(s []byte) bool {
+	var m struct {
+		CamliType string `json:"camliType"`
+	}
+	return json.Unmarshal(s, &m) == nil && m.CamliType == "permanode"
+}
+
+// DecodePermanode sets the fields of obj,
+// which must be a pointer to a struct,
+// from the current attributes of the Perkeep permanode pn,
+// which need not have been written by pk.
+// The attributes come from the callback given to SetPermanodeAttrs,
+// which must have been called with a non-nil function.
+//
+// Each field is set from the attribute with the field's name
+// (see ParseTag),
+// and is left unchanged if there is no such attribute.
+// The supported field types are:
+//
+// - booleans, parsed by strconv.ParseBool;
+//
+// - numbers and strings, parsed as in a blob written by pk
+// (including the names of types registered with RegisterEnum);
+//
+// - time.Time, in RFC 3339 format;
+//
+// - slices of any of those, for multi-valued attributes,
+// with one element per value;
+//
+// - any other type, for an attribute whose value is the blobref
+// of a value written by pk, which is decoded as with Decode.
+//
+// For an attribute with several values,
+// a field of a non-slice type gets the first.
+func (d *Decoder) DecodePermanode(ctx context.Context, pn blob.Ref, obj interface{}) error {
+	if d.permanodeAttrs == nil {
+		return errors.New("no source of permanode attributes (see SetPermanodeAttrs)")
+	}
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Ptr {
+		return ErrNotPointer
+	}
+	if v.IsNil() {
+		return ErrNilPointer
+	}
+	if v.Elem().Kind() != reflect.Struct {
+		return errors.Errorf("cannot decode permanode %s into %s, want a struct", pn, v.Elem().Type())
+	}
+	return d.decodePermanode(ctx, pn, v.Elem())
+}
+
+// Sets the fields of structVal from the current attributes of permanode pn.
+func (d *Decoder) decodePermanode(ctx context.Context, pn blob.Ref, structVal reflect.Value) error {
+	attrs, err := d.permanodeAttrs(ctx, pn)
+	if err != nil {
+		return errors.Wrapf(err, "getting attributes of permanode %s", pn)
+	}
+	t := structVal.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, o := parseTag(t.Field(i))
+		if o.Omit {
+			continue
+		}
+		vals, ok := attrs[name]
+		if !ok {
+			continue
+		}
+		var (
+			fctx  = withPathField(ctx, name)
+			field = structVal.Field(i)
+		)
+		if !isMultiValued(field.Type()) {
+			if err := d.setAttr(fctx, field, attrs.Get(name)); err != nil {
+				return errors.Wrapf(err, "decoding attribute %s of permanode %s", name, pn)
+			}
+			continue
+		}
+		slice := reflect.MakeSlice(field.Type(), len(vals), len(vals))
+		for j, val := range vals {
+			if err := d.setAttr(withPathIndex(fctx, j), slice.Index(j), val); err != nil {
+				return errors.Wrapf(err, "decoding value %d of attribute %s of permanode %s", j, name, pn)
+			}
+		}
+		field.Set(slice)
+	}
+	return nil
+}
+
+// Sets v from the attribute value s.
+func (d *Decoder) setAttr(ctx context.Context, v reflect.Value, s string) error {
+	t := v.Type()
+	if t == timeType {
+		tm, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return errors.Wrapf(err, "parsing time %s", s)
+		}
+		v.Set(reflect.ValueOf(tm))
+		return nil
+	}
+	if t.Kind() == reflect.Bool {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.Wrapf(err, "parsing %s from %s", t, s)
+		}
+		v.SetBool(b)
+		return nil
+	}
+	if isScalarKind(t.Kind()) {
+		return d.setScalar(v, []byte(s))
+	}
+	ref, ok := blob.Parse(s)
+	if !ok {
+		return errors.Errorf("invalid blobref %q", s)
+	}
+	newVal, err := newValue(t)
+	if err != nil {
+		return err
+	}
+	if err := d.Decode(ctx, ref, newVal.Interface()); err != nil {
+		return errors.Wrapf(err, "decoding ref %s", ref)
+	}
+	v.Set(newVal.Elem())
+	return nil
+}
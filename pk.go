@@ -11,15 +11,57 @@ import (
 )
 
 // Marshaler is the type of an object that knows how to store itself in Perkeep.
+// The context passed to PkMarshal tells where in the tree the object is;
+// see PathFromContext.
+//
+// If PkMarshal has a pointer receiver,
+// it is still used for values of the non-pointer type,
+// called on the value's address if it has one
+// and on a copy otherwise.
 type Marshaler interface {
 	PkMarshal(context.Context, blobserver.BlobReceiver) (blob.Ref, error)
 }
 
+// MarshalerWithEncoder is like Marshaler,
+// but PkMarshalWithEncoder receives the Encoder that is invoking it
+// rather than just its destination.
+// An implementation can store the parts of itself
+// by calling the Encoder's methods
+// (such as Encode, passing along the context),
+// so that they are stored with the same options, dedup cache, and concurrency limit
+// as the rest of the tree.
+// Such a nested call to Encode stores only the value passed to it,
+// and does not mark it as a root (see Encoder.SetMarkRoots)
+// or give it a summary (see Encoder.SetReadableRoot).
+//
+// If an object implements both interfaces,
+// PkMarshalWithEncoder is used.
+type MarshalerWithEncoder interface {
+	PkMarshalWithEncoder(context.Context, *Encoder) (blob.Ref, error)
+}
+
 // Unmarshaler is the type of an object that knows how to populate itself from Perkeep.
+// The context passed to PkUnmarshal tells where in the tree the object is;
+// see PathFromContext.
 type Unmarshaler interface {
 	PkUnmarshal(context.Context, blob.Fetcher, blob.Ref) error
 }
 
+// UnmarshalerWithDecoder is like Unmarshaler,
+// but PkUnmarshalWithDecoder receives the Decoder that is invoking it
+// rather than just its blob.Fetcher.
+// An implementation can decode the parts of itself
+// by calling the Decoder's methods
+// (such as Decode, passing along the context),
+// so that they are decoded with the same options, caches, and limits
+// as the rest of the tree.
+//
+// If an object implements both interfaces,
+// PkUnmarshalWithDecoder is used.
+type UnmarshalerWithDecoder interface {
+	PkUnmarshalWithDecoder(context.Context, *Decoder, blob.Ref) error
+}
+
 // Marshal stores obj to dst as a tree of Perkeep blobs.
 // It returns a reference to the root of the tree.
 //
@@ -30,6 +72,9 @@ type Unmarshaler interface {
 // (When unmarshaling, all blobs other than the zero-byte blob count as true.)
 //
 // Integers and floats of all sizes are marshaled as human-readable base 10 number strings.
+// (The exception is integer types with names registered via RegisterEnum,
+// including time.Month and time.Weekday,
+// which are registered automatically with names like "January" and "Monday".)
 //
 // Arrays and slices are marshaled as a JSON array of blobrefs: "[ref,ref,...]".
 // The blobrefs are those of the recursively marshaled members of the array or slice.
@@ -37,9 +82,64 @@ type Unmarshaler interface {
 // A map of type map[K]T is marshaled as the JSON encoding of a map[K]blob.Ref.
 // The blobrefs are those of the recursively marshaled values of the map.
 // (The keys of the map are not marshaled, however.)
+// As in encoding/json, K must be a string type, an integer type, or implement encoding.TextMarshaler;
+// integer keys appear as decimal strings in the JSON object.
+// A map whose values are themselves maps (or slices) nests naturally:
+// each value's blobref refers to the separately marshaled inner map.
+// Keys and values are handled independently,
+// so e.g. a map[int]interface{} round-trips both its integer keys
+// and the concrete types of its values.
+// Native maps do not preserve the order of their keys;
+// for that, see OrderedMap.
+//
+// A nil map or slice is marshaled as the zero-byte blob,
+// and unmarshals as nil,
+// while an empty one stored as a blob of its own
+// (not as the blobref list of a struct field)
+// unmarshals as empty but non-nil.
+// So is a nil pointer,
+// except that a pointer to a type whose values may themselves marshal as the zero-byte blob
+// (such as *string or *bool)
+// unmarshals from it as a pointer to the zero value.
+//
+// A struct type with a single field pointing to its own type,
+// like "type Node struct { V int; Next *Node }",
+// is marshaled and unmarshaled iteratively along that field,
+// so that a long linked list of them does not require deep recursion.
 //
 // A string is marshaled as a blob equal to the bytes of the string.
 //
+// A blob.Ref is marshaled as a blob containing its string form
+// (the zero blob.Ref as the zero-byte blob).
+// This applies equally to an alias of blob.Ref (type ObjectID = blob.Ref), which is the identical type,
+// and to a defined type with blob.Ref as its underlying type (type ObjectID blob.Ref),
+// which is recognized by that underlying type.
+//
+// A time.Time is marshaled as its RFC 3339 representation, with nanoseconds.
+// The time's offset from UTC is preserved, but not the name of its location
+// (except in struct fields with the "tzname" option; see below).
+//
+// A netip.Addr or netip.Prefix is marshaled as its text form,
+// such as "192.0.2.1", "fe80::1%eth0", or "2001:db8::/32"
+// (the zero value as the zero-byte blob).
+//
+// A json.Number is marshaled as its numeric string.
+// It must be a valid JSON number, both when marshaling and when unmarshaling.
+//
+// An interface value is marshaled as the JSON object {"type": name, "ref": ref},
+// where name is the name under which the value's concrete type was registered (see Register)
+// and ref is the blobref of the recursively marshaled concrete value.
+// A nil interface value marshals as the zero-byte blob,
+// and an interface value holding a valid blob.Ref marshals as the ref itself (as above),
+// with no type hint.
+// Because the type name is recorded,
+// values whose own blobs are indistinguishable
+// (such as "" and false, which both marshal as the zero-byte blob)
+// each unmarshal as the right type.
+// Marshaling an interface value whose concrete type is not registered,
+// or unmarshaling one whose type name is not,
+// fails with ErrUnregisteredType.
+//
 // A struct is marshaled as the JSON encoding of a map[string]interface{},
 // where the keys are the struct's field's names
 // and each value is a blobref, a slice of blobrefs, or a map[K]blob.Ref
@@ -55,6 +155,10 @@ type Unmarshaler interface {
 //
 // - `pk:"name"` means use "name" as the field name in the map[string]interface{} rather than the struct field's name;
 //
+// - `pk:"group.name"` (a name containing dots) means place the field in a nested object:
+// fields named "addr.street" and "addr.city" produce {"addr": {"street": ..., "city": ...}}
+// (and groups may themselves be nested);
+//
 // - `pk:",option1,option2"` means turn on the given options (available options listed below);
 //
 // - `pk:"name,option1,option2"` means use the given name and turn on the given options.
@@ -64,12 +168,144 @@ type Unmarshaler interface {
 // - omitempty, causes the field to be skipped if it has the zero value for its type;
 //
 // - inline, causes the field's value to be used directly in the map[string]interface{} rather than recursively marshaling it;
+// as a special case, the first inline field of type map[string]interface{} is a catch-all:
+// its entries are spread into the struct's JSON object, with their keys unchanged even if dotted
+// (except those whose keys are the names of other fields or their groups),
+// and on unmarshaling it collects every key that does not match another field,
+// so that unknown keys survive a round trip
+// (numbers among them unmarshal as json.Number);
 //
 // - external, causes container types (slices, arrays, and maps) to be marshaled separately from the struct, and the resulting blobref used as the value, rather than marshaling them as slices or maps of member blobrefs.
+//
+// - compact, causes a field of type []time.Time to be marshaled as a single blob
+// of newline-separated RFC 3339 timestamps
+// (rather than one blob per time);
+// an empty slice unmarshals as nil;
+//
+// - packed, causes a field whose type is a slice of integers or floats
+// (such as []uint32, []int64, or []float64)
+// to be marshaled as a single blob
+// holding the elements' little-endian binary representations one after another,
+// with ints and uints taking 64 bits each
+// (rather than one blob per element);
+// an empty slice unmarshals as nil;
+//
+// - chunkat=size, where size is a number of bytes
+// optionally followed by k, m, or g (for KiB, MiB, or GiB),
+// causes a string or []byte field to be marshaled as a single blob of its bytes
+// if it is no longer than size,
+// and otherwise as a Perkeep file schema (written by schema.WriteFileMap),
+// whose content is split into chunks;
+// the struct's JSON object then holds {"file": ref} for the field
+// in place of a plain blobref
+// (or {"bytes": ref} for a "bytes" schema, see Encoder.SetBytesSchema);
+// the Encoder's BlobReceiver must also be a blobserver.BlobStatter for this,
+// and the option cannot be combined with encrypt;
+//
+// - bitset, causes a field of type []bool to be marshaled as a single blob
+// holding one bit per element,
+// preceded by a byte giving the number of unused bits at the end;
+// an empty slice unmarshals as nil;
+//
+// - refof=F, on a field of type blob.Ref,
+// causes the field to be marshaled as the blobref of its sibling field with Go name F
+// (which must be stored as a single blob, not inline or as a list of refs),
+// and, if the struct being marshaled is addressable (e.g. given by pointer),
+// sets the field to that blobref too;
+// when unmarshaling, the field gets the blobref,
+// and F is decoded from it if F's own entry is absent;
+// this lets a struct carry explicit links to its own sub-blobs;
+//
+// - self, on a field of type blob.Ref,
+// causes the field to be left out of its struct's blob,
+// and set to that blob's ref,
+// for use as a content-addressed ID;
+// since a blob cannot contain its own ref,
+// the ID covers the struct minus its self fields,
+// and so is the same however those fields are set;
+// as with refof, the field is set when marshaling
+// only if the struct is addressable,
+// and when unmarshaling it gets the ref of the blob the struct is read from
+// (a struct stored inline in another's blob, e.g. with the inline option,
+// has no blob of its own, and its self fields are left alone);
+//
+// - money, causes a field whose type is a struct
+// with an integer field named Amount and a string field named Currency
+// (and perhaps others, which are not stored)
+// to be marshaled as a single blob holding a string like "USD 12.34" or "EUR -0.05";
+// Amount is taken to count hundredths of the currency unit,
+// so the string always has exactly two decimal places
+// regardless of the currency's customary precision
+// (100 yen is "JPY 1.00"),
+// and Currency must be non-empty and contain no whitespace;
+//
+// - tzname, causes a field of type time.Time to be marshaled
+// as the JSON object {"time": t, "zone": name},
+// where t is the RFC 3339 time and name is the name of its location
+// (such as "America/New_York"),
+// which is restored with time.LoadLocation when unmarshaling;
+// the instant is always preserved exactly,
+// but the offset is recomputed from the local time zone database,
+// so if the zone's rules (e.g. for daylight saving time) have changed since marshaling,
+// the restored time may show a different offset and wall-clock time than the original;
+// a name that time.LoadLocation does not know (such as that of a time.FixedZone)
+// leaves the time with its stored offset;
+//
+// - compute, causes the field's value to be obtained when marshaling
+// by calling a method named Compute plus the field's Go name
+// (e.g. ComputeTotal for a field Total)
+// that takes no arguments and returns the field's type,
+// optionally with an error;
+// the result is marshaled as the field's value would be,
+// and unmarshaled into the field as usual,
+// making this suitable for derived data that should be persisted;
+//
+// - encrypt, causes the blobs of the field's value to be encrypted
+// with the cipher given to Encoder.SetFieldCipher
+// (and decrypted with the one given to Decoder.SetFieldCipher),
+// leaving the struct's other fields in plaintext;
+// it cannot be combined with inline;
+//
+// - default=value, gives a value for the field when unmarshaling a blob that lacks it
+// (e.g. one written before the field was added),
+// parsed according to the field's type,
+// which must be a string, boolean, or numeric type
+// (a time.Duration default is parsed by time.ParseDuration,
+// and a registered enum's by name or number);
+// the value cannot contain a comma,
+// and an invalid default causes an error when the struct type is first marshaled or unmarshaled;
+// note that with omitempty, a zero value is omitted and so unmarshals as the default;
+//
+// - sparse, causes an array field to be marshaled as the JSON object {"len": N, "elems": {index: blobref, ...}},
+// listing only the non-zero elements
+// (which unmarshal as zeros),
+// rather than as a blobref per element;
+// this shrinks the struct's blob greatly for large, mostly empty arrays;
+//
+// - uintptr, permits a field of type uintptr to be marshaled, as an unsigned integer.
+// Without this option, uintptr fields are unsupported.
+// Beware: a uintptr that holds a memory address is meaningless in any other process,
+// or even later in the same process;
+// use this option only for uintptrs that hold plain numbers.
 func Marshal(ctx context.Context, dst blobserver.BlobReceiver, obj interface{}) (blob.Ref, error) {
 	return NewEncoder(dst).Encode(ctx, obj)
 }
 
+// MarshalIndent is like Marshal
+// but writes the JSON of structs, slices, arrays, and maps
+// with each element on its own line,
+// beginning with prefix and indented with one or more copies of indent
+// according to its depth,
+// as with "encoding/json".MarshalIndent.
+// This is meant for blobs that humans will read;
+// unmarshaling ignores the whitespace.
+// See Encoder.SetIndent.
+func MarshalIndent(ctx context.Context, dst blobserver.BlobReceiver, obj interface{}, prefix, indent string) (blob.Ref, error) {
+	e := NewEncoder(dst)
+	e.SetIndent(prefix, indent)
+	return e.Encode(ctx, obj)
+}
+
 // Unmarshal populates obj from the tree of blobs in src rooted at ref.
 // Unmarshaling is the inverse of marshaling.
 // See Marshal for the rules of how Go types correspond to marshaled Perkeep blobs.
@@ -90,6 +326,18 @@ func (e ErrUnsupportedType) Error() string {
 	return fmt.Sprintf("unsupported type \"%s\"", e.Name)
 }
 
+// ErrUnregisteredType indicates an attempt to marshal or unmarshal
+// an interface value whose concrete type has not been registered.
+// See Register.
+type ErrUnregisteredType struct {
+	Name string
+}
+
+// Error implements the error interface.
+func (e ErrUnregisteredType) Error() string {
+	return fmt.Sprintf("unregistered type \"%s\" (register it with pk.Register or pk.RegisterName)", e.Name)
+}
+
 var (
 	// ErrDecoding is produced when a blob can't be unmarshaled into a given Go object.
 	ErrDecoding = errors.New("decoding")
@@ -99,4 +347,15 @@ var (
 
 	// ErrNilPointer is produced when a nil pointer is passed to Unmarshal or Decode.
 	ErrNilPointer = errors.New("nil pointer")
+
+	// ErrTooManyRefs is produced when a slice, array, or map blob
+	// has more entries than a Decoder allows.
+	// See Decoder.SetMaxRefArrayLen.
+	ErrTooManyRefs = errors.New("too many refs")
+
+	// ErrArrayLength is produced when an array blob
+	// has a different number of elements than the Go array it is decoded into,
+	// and the Decoder requires them to match.
+	// See Decoder.SetStrictArrayLengths.
+	ErrArrayLength = errors.New("array length mismatch")
 )
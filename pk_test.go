@@ -1,14 +1,39 @@
 package pk
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/davecgh/go-spew/spew"
+	"github.com/pkg/errors"
 	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
 	"perkeep.org/pkg/blobserver/memory"
+	"perkeep.org/pkg/constants"
+	"perkeep.org/pkg/jsonsign"
+	"perkeep.org/pkg/schema"
 )
 
 func TestPk(t *testing.T) {
@@ -106,3 +131,6061 @@ type astruct struct {
 	H bool `pk:"inline"`
 	I bool `pk:"-"`
 }
+
+func TestMissingBlobHandler(t *testing.T) {
+	type withMissing struct {
+		A string
+		B string
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+	ref, err := Marshal(ctx, storage, withMissing{A: "present", B: "absent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.RemoveBlobs(ctx, []blob.Ref{blob.RefFromString("absent")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got withMissing
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err == nil {
+		t.Fatal("got no error decoding with missing blob, want error")
+	}
+
+	dec := NewDecoder(storage)
+	dec.SetMissingBlobHandler(func(ref blob.Ref, dst reflect.Type) (reflect.Value, bool, error) {
+		if dst.Kind() != reflect.String {
+			return reflect.Value{}, false, nil
+		}
+		return reflect.ValueOf("placeholder"), true, nil
+	})
+	got = withMissing{}
+	err = dec.Decode(ctx, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := withMissing{A: "present", B: "placeholder"}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+type point struct {
+	X, Y int
+}
+
+func TestInterfaceMap(t *testing.T) {
+	Register(point{})
+
+	type config struct {
+		Settings map[string]interface{}
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	want := config{
+		Settings: map[string]interface{}{
+			"n":   17,
+			"s":   "hello",
+			"pt":  point{X: 3, Y: 4},
+			"nil": nil,
+		},
+	}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got config
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	_, err = Marshal(ctx, storage, map[string]interface{}{"x": struct{ Z int }{Z: 1}})
+	if _, ok := errors.Cause(err).(ErrUnregisteredType); !ok {
+		t.Errorf("got error %v, want ErrUnregisteredType", err)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	obj := &astruct{A: 1, C: "hello", D: []string{"foo", "bar"}}
+	root, manifest, err := MarshalWithManifest(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := storage.Fetch(ctx, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var refs []blob.Ref
+	err = json.NewDecoder(r).Decode(&refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var all []blob.Ref
+	ch := make(chan blob.SizedRef)
+	go storage.EnumerateBlobs(ctx, ch, "", -1)
+	for sref := range ch {
+		if sref.Ref != manifest {
+			all = append(all, sref.Ref)
+		}
+	}
+	if !reflect.DeepEqual(refs, all) {
+		t.Errorf("got manifest %v, want %v", refs, all)
+	}
+
+	var found bool
+	for _, ref := range refs {
+		if ref == root {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("root %s not in manifest", root)
+	}
+
+	// Blobs skipped by the dedup cache are still listed.
+	enc := NewEncoder(storage)
+	enc.SetDedupCache(100)
+	_, manifest1, err := enc.EncodeWithManifest(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, manifest2, err := enc.EncodeWithManifest(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest2 != manifest1 {
+		t.Errorf("second manifest %s differs from first %s", mustFetch(t, storage, manifest2), mustFetch(t, storage, manifest1))
+	}
+	if manifest1 != manifest {
+		t.Errorf("manifest with dedup cache %s differs from %s", mustFetch(t, storage, manifest1), mustFetch(t, storage, manifest))
+	}
+}
+
+type box[T any] struct {
+	Val T
+}
+
+type pair[K comparable, V any] struct {
+	Key K
+	Val V `pk:"val,omitempty"`
+}
+
+type gnode[T any] struct {
+	Val  T
+	Next *gnode[T]
+}
+
+func TestGeneric(t *testing.T) {
+	cases := []struct {
+		name string
+		obj  interface{}
+	}{
+		{name: "box of int", obj: box[int]{Val: 7}},
+		{name: "box of strings", obj: box[[]string]{Val: []string{"a", "b"}}},
+		{name: "pointer to box of int", obj: &box[int]{Val: 8}},
+		{
+			name: "map of boxes of slices of nodes",
+			obj: map[string]box[[]gnode[string]]{
+				"a": {Val: []gnode[string]{{Val: "x", Next: &gnode[string]{Val: "y"}}}},
+				"b": {},
+			},
+		},
+		{
+			name: "box of map of boxes",
+			obj:  box[map[string]box[int]]{Val: map[string]box[int]{"one": {Val: 1}}},
+		},
+		{
+			name: "pairs of pairs",
+			obj: []pair[string, pair[int, []box[float64]]]{
+				{Key: "k", Val: pair[int, []box[float64]]{Key: 1, Val: []box[float64]{{Val: 1.5}}}},
+				{Key: "empty"},
+			},
+		},
+		{
+			name: "box of pointer to box",
+			obj:  box[*box[[2]pair[string, bool]]]{Val: &box[[2]pair[string, bool]]{Val: [2]pair[string, bool]{{Key: "t", Val: true}}}},
+		},
+		{
+			name: "generic list",
+			obj:  &gnode[box[int]]{Val: box[int]{Val: 1}, Next: &gnode[box[int]]{Val: box[int]{Val: 2}}},
+		},
+	}
+
+	ctx := context.Background()
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			storage := new(memory.Storage)
+			ref, err := Marshal(ctx, storage, c.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dupVal := reflect.New(reflect.TypeOf(c.obj))
+			err = Unmarshal(ctx, storage, ref, dupVal.Interface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(dupVal.Elem().Interface(), c.obj) {
+				t.Errorf("got %v, want %v", dupVal.Elem().Interface(), c.obj)
+			}
+		})
+	}
+}
+
+func TestGenericErrorNamesType(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+	_, err := Marshal(ctx, storage, box[func()]{})
+	if err == nil {
+		t.Fatal("got no error, want error")
+	}
+	if !strings.Contains(err.Error(), "box[func()]") {
+		t.Errorf("error %q does not name the generic type", err)
+	}
+
+	_, err = Marshal(ctx, storage, map[string]box[[]pair[string, chan int]]{"x": {Val: []pair[string, chan int]{{Key: "k", Val: make(chan int)}}}})
+	if err == nil {
+		t.Fatal("got no error, want error")
+	}
+	if !strings.Contains(err.Error(), "pair[string,chan int]") {
+		t.Errorf("error %q does not name the nested generic type", err)
+	}
+}
+
+func TestUnsupportedTypeName(t *testing.T) {
+	type withChan struct {
+		C chan int
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	_, err := Marshal(ctx, storage, withChan{C: make(chan int)})
+	uerr, ok := errors.Cause(err).(ErrUnsupportedType)
+	if !ok {
+		t.Fatalf("got error %v, want ErrUnsupportedType", err)
+	}
+	if uerr.Name != "chan int" {
+		t.Errorf("got name %q, want \"chan int\"", uerr.Name)
+	}
+
+	ref, err := Marshal(ctx, storage, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c chan int
+	err = Unmarshal(ctx, storage, ref, &c)
+	uerr, ok = errors.Cause(err).(ErrUnsupportedType)
+	if !ok {
+		t.Fatalf("got error %v, want ErrUnsupportedType", err)
+	}
+	if uerr.Name != "chan int" {
+		t.Errorf("got name %q, want \"chan int\"", uerr.Name)
+	}
+}
+
+func TestSkipUnsupported(t *testing.T) {
+	type withHelpers struct {
+		Name     string
+		Callback func() string
+		Done     chan struct{}
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	obj := withHelpers{
+		Name:     "x",
+		Callback: func() string { return "y" },
+		Done:     make(chan struct{}),
+	}
+
+	_, err := Marshal(ctx, storage, obj)
+	if _, ok := errors.Cause(err).(ErrUnsupportedType); !ok {
+		t.Fatalf("got error %v, want ErrUnsupportedType", err)
+	}
+
+	enc := NewEncoder(storage)
+	enc.SetSkipUnsupported(true)
+	ref, err := enc.Encode(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got withHelpers
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "x" || got.Callback != nil || got.Done != nil {
+		t.Errorf("got %+v, want Name x and nil Callback and Done", got)
+	}
+}
+
+type pathRecorder struct {
+	marshalPath, unmarshalPath string
+}
+
+func (p *pathRecorder) PkMarshal(ctx context.Context, dst blobserver.BlobReceiver) (blob.Ref, error) {
+	p.marshalPath = PathFromContext(ctx)
+	sref, err := blobserver.ReceiveString(ctx, dst, "x")
+	return sref.Ref, err
+}
+
+func (p *pathRecorder) PkUnmarshal(ctx context.Context, src blob.Fetcher, ref blob.Ref) error {
+	p.unmarshalPath = PathFromContext(ctx)
+	return nil
+}
+
+func TestPathFromContext(t *testing.T) {
+	type inner struct {
+		R *pathRecorder `pk:"rec"`
+	}
+	type outer struct {
+		Items []inner
+		ByKey map[string]*pathRecorder
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	obj := outer{
+		Items: []inner{{R: new(pathRecorder)}, {R: new(pathRecorder)}},
+		ByKey: map[string]*pathRecorder{"k": new(pathRecorder)},
+	}
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := obj.Items[1].R.marshalPath; got != "Items[1].rec" {
+		t.Errorf("got marshal path %q, want Items[1].rec", got)
+	}
+	if got := obj.ByKey["k"].marshalPath; got != "ByKey[k]" {
+		t.Errorf("got marshal path %q, want ByKey[k]", got)
+	}
+
+	var got outer
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := got.Items[1].R.unmarshalPath; p != "Items[1].rec" {
+		t.Errorf("got unmarshal path %q, want Items[1].rec", p)
+	}
+	if p := got.ByKey["k"].unmarshalPath; p != "ByKey[k]" {
+		t.Errorf("got unmarshal path %q, want ByKey[k]", p)
+	}
+}
+
+func TestIntKeyInterfaceMap(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	want := map[int]interface{}{1: "a", 2: 42, 3: nil}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[int]interface{}
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	type withMap struct {
+		M map[int]interface{}
+	}
+	ref, err = Marshal(ctx, storage, withMap{M: want})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotStruct withMap
+	err = Unmarshal(ctx, storage, ref, &gotStruct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotStruct.M, want) {
+		t.Errorf("got %#v, want %#v", gotStruct.M, want)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyStorage fails every other blob write and fetch with a temporary error.
+type flakyStorage struct {
+	*memory.Storage
+	receives, fetches int
+}
+
+func (f *flakyStorage) ReceiveBlob(ctx context.Context, ref blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	f.receives++
+	if f.receives%2 == 1 {
+		return blob.SizedRef{}, temporaryError{}
+	}
+	return f.Storage.ReceiveBlob(ctx, ref, source)
+}
+
+func (f *flakyStorage) Fetch(ctx context.Context, ref blob.Ref) (io.ReadCloser, uint32, error) {
+	f.fetches++
+	if f.fetches%2 == 1 {
+		return nil, 0, temporaryError{}
+	}
+	return f.Storage.Fetch(ctx, ref)
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	storage := &flakyStorage{Storage: new(memory.Storage)}
+	obj := []string{"foo", "bar"}
+
+	_, err := Marshal(ctx, storage, obj)
+	if err == nil {
+		t.Fatal("got no error without retries, want error")
+	}
+
+	enc := NewEncoder(storage)
+	enc.SetRetry(2, nil)
+	enc.SetIsTransient(func(error) bool { return false })
+	_, err = enc.Encode(ctx, obj)
+	if err == nil {
+		t.Fatal("got no error with non-transient errors, want error")
+	}
+
+	var backoffs []int
+	enc.SetIsTransient(nil)
+	enc.SetRetry(2, func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	})
+	ref, err := enc.Encode(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backoffs) == 0 {
+		t.Error("backoff never called")
+	}
+
+	dec := NewDecoder(storage)
+	dec.SetRetry(2, nil)
+	var got []string
+	err = dec.Decode(ctx, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %v, want %v", got, obj)
+	}
+}
+
+func TestNestedMap(t *testing.T) {
+	type withNested struct {
+		M map[string]map[string]int
+		E map[string]map[string]int `pk:",external"`
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	nested := map[string]map[string]int{
+		"a": {"x": 1, "y": 2},
+		"b": {},
+		"c": nil,
+	}
+	want := withNested{M: nested, E: nested}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got withNested
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestEncoderCallOptions(t *testing.T) {
+	ctx := context.Background()
+
+	obj := struct {
+		S []int
+		M map[string][]string
+	}{
+		M: make(map[string][]string),
+	}
+	for i := 0; i < 100; i++ {
+		obj.S = append(obj.S, i)
+		obj.M[strconv.Itoa(i)] = []string{"x", strconv.Itoa(i * i)}
+	}
+
+	plain := new(memory.Storage)
+	want, err := Marshal(ctx, plain, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("concurrency", func(t *testing.T) {
+		storage := new(memory.Storage)
+		enc := NewEncoder(storage)
+		enc.SetConcurrency(8)
+		got, err := enc.Encode(ctx, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got ref %s, want %s", got, want)
+		}
+		if storage.NumBlobs() != plain.NumBlobs() {
+			t.Errorf("got %d blobs, want %d", storage.NumBlobs(), plain.NumBlobs())
+		}
+
+		storage = new(memory.Storage)
+		enc = NewEncoder(storage)
+		got, err = enc.Encode(WithContextConcurrency(ctx, 4), obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got ref %s with context concurrency, want %s", got, want)
+		}
+	})
+
+	t.Run("dry run and progress", func(t *testing.T) {
+		var (
+			mu    sync.Mutex
+			count int
+		)
+		progress := func(blob.SizedRef) {
+			mu.Lock()
+			count++
+			mu.Unlock()
+		}
+
+		storage := new(memory.Storage)
+		enc := NewEncoder(storage)
+		enc.SetDryRun(true)
+		enc.SetProgress(progress)
+		got, err := enc.Encode(ctx, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got ref %s, want %s", got, want)
+		}
+		if n := storage.NumBlobs(); n != 0 {
+			t.Errorf("dry run wrote %d blobs", n)
+		}
+		if count < plain.NumBlobs() {
+			t.Errorf("progress called %d times, want at least %d", count, plain.NumBlobs())
+		}
+
+		// The context overrides the encoder's settings.
+		count = 0
+		got, err = enc.Encode(WithContextProgress(WithContextDryRun(ctx, false), nil), obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got ref %s, want %s", got, want)
+		}
+		if storage.NumBlobs() != plain.NumBlobs() {
+			t.Errorf("got %d blobs, want %d", storage.NumBlobs(), plain.NumBlobs())
+		}
+		if count != 0 {
+			t.Errorf("progress called %d times after override, want 0", count)
+		}
+	})
+}
+
+func TestRefMap(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	refs := make(map[string]blob.Ref)
+	for _, s := range []string{"foo", "bar"} {
+		ref, err := Marshal(ctx, storage, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs[s] = ref
+	}
+
+	mapRef, err := NewEncoder(storage).EncodeRefMap(ctx, refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]string
+	err = Unmarshal(ctx, storage, mapRef, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"foo": "foo", "bar": "bar"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	gotRefs, err := NewDecoder(storage).DecodeRefMap(ctx, mapRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotRefs, refs) {
+		t.Errorf("got refs %v, want %v", gotRefs, refs)
+	}
+}
+
+type (
+	status string
+	level  int
+)
+
+func TestNamedStringAndInt(t *testing.T) {
+	type withNamed struct {
+		S  status
+		L  level
+		SS []status
+		LM map[status]level
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	want := withNamed{
+		S:  "active",
+		L:  3,
+		SS: []status{"a", "b"},
+		LM: map[status]level{"low": 1, "high": 9},
+	}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got withNamed
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+type (
+	namedBool    bool
+	namedInt     int
+	namedInt8    int8
+	namedInt16   int16
+	namedInt32   int32
+	namedInt64   int64
+	namedUint    uint
+	namedUint8   uint8
+	namedUint16  uint16
+	namedUint32  uint32
+	namedUint64  uint64
+	namedFloat32 float32
+	namedFloat64 float64
+	namedString  string
+)
+
+func TestNamedScalars(t *testing.T) {
+	cases := []interface{}{
+		namedBool(true),
+		namedBool(false),
+		namedInt(-1),
+		namedInt8(-128),
+		namedInt16(-32768),
+		namedInt32(-2147483648),
+		namedInt64(-9223372036854775808),
+		namedUint(1),
+		namedUint8(255),
+		namedUint16(65535),
+		namedUint32(4294967295),
+		namedUint64(18446744073709551615),
+		namedFloat32(1.5),
+		namedFloat64(-2.25),
+		namedString("hello"),
+	}
+
+	ctx := context.Background()
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%T(%v)", c, c), func(t *testing.T) {
+			storage := new(memory.Storage)
+			ref, err := Marshal(ctx, storage, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dupVal := reflect.New(reflect.TypeOf(c))
+			err = Unmarshal(ctx, storage, ref, dupVal.Interface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := dupVal.Elem().Interface(); got != c {
+				t.Errorf("got %v, want %v", got, c)
+			}
+
+			// Also as a slice element.
+			sliceVal := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(c)), 0, 1)
+			sliceVal = reflect.Append(sliceVal, reflect.ValueOf(c))
+			ref, err = Marshal(ctx, storage, sliceVal.Interface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			dupSlice := reflect.New(sliceVal.Type())
+			err = Unmarshal(ctx, storage, ref, dupSlice.Interface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(dupSlice.Elem().Interface(), sliceVal.Interface()) {
+				t.Errorf("got %v, want %v", dupSlice.Elem().Interface(), sliceVal.Interface())
+			}
+		})
+	}
+}
+
+func TestEncodeNamedScalars(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	cases := []struct {
+		obj  interface{}
+		want string
+	}{
+		{obj: status("active"), want: "active"},
+		{obj: level(-3), want: "-3"},
+		{obj: namedUint16(7), want: "7"},
+		{obj: namedFloat32(0.5), want: "0.5"},
+		{obj: namedBool(true), want: "true"},
+	}
+	for _, c := range cases {
+		ref, err := Marshal(ctx, storage, c.obj)
+		if err != nil {
+			t.Fatalf("marshaling %T: %s", c.obj, err)
+		}
+		if want := blob.RefFromString(c.want); ref != want {
+			t.Errorf("marshaling %T(%v): got ref %s, want %s (the blob %q)", c.obj, c.obj, ref, want, c.want)
+		}
+	}
+}
+
+func TestUintptr(t *testing.T) {
+	type withUintptr struct {
+		P uintptr `pk:",uintptr"`
+	}
+	type withUntaggedUintptr struct {
+		P uintptr
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	want := withUintptr{P: 0xdeadbeef}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got withUintptr
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	_, err = Marshal(ctx, storage, withUntaggedUintptr{P: 1})
+	if _, ok := errors.Cause(err).(ErrUnsupportedType); !ok {
+		t.Errorf("got error %v, want ErrUnsupportedType", err)
+	}
+}
+
+func TestLenientNumbers(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	cases := []struct {
+		blob string
+		dst  interface{}
+		want interface{}
+	}{
+		{blob: "17\n", dst: new(int), want: 17},
+		{blob: " 255 ", dst: new(uint8), want: uint8(255)},
+		{blob: "\t-1.5\r\n", dst: new(float64), want: -1.5},
+	}
+	for _, c := range cases {
+		sref, err := blobserver.ReceiveString(ctx, storage, c.blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Unmarshal(ctx, storage, sref.Ref, c.dst)
+		if err == nil {
+			t.Errorf("got no error strictly decoding %q, want error", c.blob)
+		}
+
+		dec := NewDecoder(storage)
+		dec.SetLenientNumbers(true)
+		err = dec.Decode(ctx, sref.Ref, c.dst)
+		if err != nil {
+			t.Fatalf("decoding %q: %s", c.blob, err)
+		}
+		if got := reflect.ValueOf(c.dst).Elem().Interface(); got != c.want {
+			t.Errorf("decoding %q: got %v, want %v", c.blob, got, c.want)
+		}
+	}
+}
+
+func TestChunkedSlice(t *testing.T) {
+	ctx := context.Background()
+
+	var want []int
+	for i := 0; i < 1000; i++ {
+		want = append(want, i)
+	}
+	wantArr := [25]string{"a", "b", "c"}
+
+	for _, fanout := range []int{0, 2, 10, 999, 1000} {
+		t.Run(fmt.Sprintf("fanout %d", fanout), func(t *testing.T) {
+			storage := new(memory.Storage)
+			enc := NewEncoder(storage)
+			enc.SetChunkFanout(fanout)
+
+			ref, err := enc.Encode(ctx, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int
+			err = Unmarshal(ctx, storage, ref, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+
+			ref, err = enc.Encode(ctx, wantArr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotArr [25]string
+			err = Unmarshal(ctx, storage, ref, &gotArr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotArr != wantArr {
+				t.Errorf("got %v, want %v", gotArr, wantArr)
+			}
+
+			if fanout < 2 {
+				return
+			}
+
+			// No blob may hold more than fanout refs.
+			ch := make(chan blob.SizedRef)
+			go storage.EnumerateBlobs(ctx, ch, "", -1)
+			for sref := range ch {
+				r, _, err := storage.Fetch(ctx, sref.Ref)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := strings.Count(string(b), "sha"); n > fanout {
+					t.Errorf("blob %s has %d refs, want at most %d", sref.Ref, n, fanout)
+				}
+			}
+		})
+	}
+}
+
+type color int
+
+const (
+	red color = iota
+	green
+	blue
+)
+
+func init() {
+	RegisterEnum(map[color]string{
+		red:   "red",
+		green: "green",
+		blue:  "blue",
+	})
+}
+
+func TestEnum(t *testing.T) {
+	type withEnum struct {
+		C  color
+		CS []color
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	want := withEnum{C: green, CS: []color{blue, red, 17}}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got withEnum
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	ref, err = Marshal(ctx, storage, green)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != blob.RefFromString("green") {
+		t.Errorf("enum value not stored by name")
+	}
+	ref, err = Marshal(ctx, storage, color(17))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != blob.RefFromString("17") {
+		t.Errorf("unknown enum value not stored numerically")
+	}
+}
+
+func TestLog(t *testing.T) {
+	type event struct {
+		Kind  string
+		Value int
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	want := []event{{"open", 1}, {"deposit", 100}, {"close", 0}}
+
+	evlog := NewLog(NewEncoder(storage), blob.Ref{})
+	var heads []blob.Ref
+	for _, ev := range want {
+		head, err := evlog.Append(ctx, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		heads = append(heads, head)
+	}
+	if evlog.Head() != heads[len(heads)-1] {
+		t.Errorf("got head %s, want %s", evlog.Head(), heads[len(heads)-1])
+	}
+
+	dec := NewDecoder(storage)
+	var got []event
+	err := dec.Replay(ctx, evlog.Head(), func(objRef blob.Ref) error {
+		var ev event
+		if err := dec.Decode(ctx, objRef, &ev); err != nil {
+			return err
+		}
+		got = append(got, ev)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Replaying from an earlier head yields a prefix.
+	got = nil
+	err = dec.Replay(ctx, heads[1], func(objRef blob.Ref) error {
+		var ev event
+		if err := dec.Decode(ctx, objRef, &ev); err != nil {
+			return err
+		}
+		got = append(got, ev)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("got %v, want %v", got, want[:2])
+	}
+}
+
+func TestGroupedFields(t *testing.T) {
+	type person struct {
+		Name   string
+		Street string   `pk:"addr.street"`
+		City   string   `pk:"addr.city"`
+		Lat    float64  `pk:"addr.geo.lat"`
+		Lon    float64  `pk:"addr.geo.lon"`
+		Tags   []string `pk:"meta.tags"`
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	want := person{
+		Name:   "Alice",
+		Street: "1 Main St",
+		City:   "Springfield",
+		Lat:    1.5,
+		Lon:    -2.5,
+		Tags:   []string{"x"},
+	}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := storage.Fetch(ctx, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	err = json.NewDecoder(r).Decode(&raw)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, ok := raw["addr"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no addr group in %v", raw)
+	}
+	if _, ok := addr["geo"].(map[string]interface{}); !ok {
+		t.Errorf("no addr.geo group in %v", raw)
+	}
+	if _, ok := addr["street"]; !ok {
+		t.Errorf("no addr.street in %v", raw)
+	}
+
+	var got person
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	type conflicting struct {
+		Addr   string
+		Street string `pk:"Addr.street"`
+	}
+	_, err = Marshal(ctx, storage, conflicting{Addr: "x", Street: "y"})
+	if err == nil {
+		t.Error("got no error for conflicting group name, want error")
+	}
+}
+
+func TestRawField(t *testing.T) {
+	type item struct {
+		Name string
+		Qty  int `pk:"qty,inline"`
+	}
+	type order struct {
+		Items   []item
+		ByName  map[string]item
+		Ext     []string `pk:",external"`
+		Comment string   `pk:"meta.comment"`
+	}
+	type wrapper struct {
+		Order order
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	obj := wrapper{
+		Order: order{
+			Items:   []item{{"a", 1}, {"b", 2}, {"c", 3}},
+			ByName:  map[string]item{"x": {"xx", 4}},
+			Ext:     []string{"e0", "e1"},
+			Comment: "hi",
+		},
+	}
+	root, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(storage)
+
+	cases := []struct {
+		path    string
+		want    string
+		wantRef bool
+	}{
+		{path: "Order.Items[2].Name", want: "c", wantRef: true},
+		{path: "Order.Items[0].qty", want: "1"},
+		{path: "Order.ByName[x].Name", want: "xx", wantRef: true},
+		{path: "Order.Ext[1]", want: "e1", wantRef: true},
+		{path: "Order.meta.comment", want: "hi", wantRef: true},
+	}
+	for _, c := range cases {
+		b, ref, err := dec.RawField(ctx, root, c.path)
+		if err != nil {
+			t.Errorf("%s: %s", c.path, err)
+			continue
+		}
+		if string(b) != c.want {
+			t.Errorf("%s: got %q, want %q", c.path, string(b), c.want)
+		}
+		if ref.Valid() != c.wantRef {
+			t.Errorf("%s: got ref %s, want valid=%v", c.path, ref, c.wantRef)
+		}
+		if c.wantRef && ref != blob.RefFromString(c.want) {
+			t.Errorf("%s: got ref %s, want ref of %q", c.path, ref, c.want)
+		}
+	}
+
+	enc := NewEncoder(storage)
+	enc.SetChunkFanout(2)
+	chunked, err := enc.Encode(ctx, []string{"c0", "c1", "c2", "c3", "c4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := dec.RawField(ctx, chunked, "[3]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "c3" {
+		t.Errorf("got %q from chunked array, want c3", string(b))
+	}
+
+	enc = NewEncoder(storage)
+	enc.SetMapSharding(2, 4)
+	sharded, err := enc.Encode(ctx, map[int]item{1: {"one", 1}, 2: {"two", 2}, 3: {"three", 3}, 4: {"four", 4}, 5: {"five", 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err = dec.RawField(ctx, sharded, "[3].Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "three" {
+		t.Errorf("got %q from sharded map, want three", string(b))
+	}
+	if _, _, err := dec.RawField(ctx, sharded, "[6]"); err == nil {
+		t.Error("got no error for a missing key of a sharded map")
+	}
+
+	for _, bad := range []string{"Order.Nope", "Order.Items[3]", "Order.Items[x]", "Order..Items", "Order.Items[1"} {
+		_, _, err := dec.RawField(ctx, root, bad)
+		if err == nil {
+			t.Errorf("%s: got no error, want error", bad)
+		}
+	}
+}
+
+func TestTimes(t *testing.T) {
+	type series struct {
+		When    time.Time
+		Default []time.Time
+	}
+	type compactSeries struct {
+		When    time.Time
+		Default []time.Time `pk:",compact"`
+	}
+
+	ctx := context.Background()
+
+	base := time.Date(2020, 1, 2, 3, 4, 5, 6, time.FixedZone("X", -5*3600))
+	var times []time.Time
+	for i := 0; i < 50; i++ {
+		times = append(times, base.Add(time.Duration(i)*time.Minute))
+	}
+
+	check := func(t *testing.T, gotWhen time.Time, gotTimes []time.Time) {
+		if !gotWhen.Equal(base) {
+			t.Errorf("got %s, want %s", gotWhen, base)
+		}
+		if _, off := gotWhen.Zone(); off != -5*3600 {
+			t.Errorf("got offset %d, want %d", off, -5*3600)
+		}
+		if len(gotTimes) != len(times) {
+			t.Fatalf("got %d times, want %d", len(gotTimes), len(times))
+		}
+		for i, tm := range gotTimes {
+			if !tm.Equal(times[i]) {
+				t.Errorf("time %d: got %s, want %s", i, tm, times[i])
+			}
+		}
+	}
+
+	defaultStorage := new(memory.Storage)
+	ref, err := Marshal(ctx, defaultStorage, series{When: base, Default: times})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got series
+	err = Unmarshal(ctx, defaultStorage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, got.When, got.Default)
+
+	compactStorage := new(memory.Storage)
+	ref, err = Marshal(ctx, compactStorage, compactSeries{When: base, Default: times})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotCompact compactSeries
+	err = Unmarshal(ctx, compactStorage, ref, &gotCompact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, gotCompact.When, gotCompact.Default)
+
+	if d, c := defaultStorage.NumBlobs(), compactStorage.NumBlobs(); c >= d {
+		t.Errorf("compact encoding used %d blobs, default %d", c, d)
+	} else {
+		t.Logf("default encoding used %d blobs, compact %d", d, c)
+	}
+}
+
+type (
+	objectIDAlias = blob.Ref
+	objectIDNamed blob.Ref
+)
+
+func TestRefTypes(t *testing.T) {
+	type withRefs struct {
+		R     blob.Ref
+		Alias objectIDAlias
+		Named objectIDNamed
+		Zero  blob.Ref
+		Refs  []objectIDAlias
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	r1 := blob.RefFromString("one")
+	r2 := blob.RefFromString("two")
+	want := withRefs{
+		R:     r1,
+		Alias: r2,
+		Named: objectIDNamed(r1),
+		Refs:  []objectIDAlias{r2, r1},
+	}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got withRefs
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	ref, err = Marshal(ctx, storage, r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != blob.RefFromString(r1.String()) {
+		t.Error("blob.Ref not stored as its string form")
+	}
+}
+
+type scalarStruct struct {
+	A int
+	B string
+	C float64
+	D bool
+	E uint16
+	F string `pk:"g.f"`
+}
+
+func TestInlineScalarStructs(t *testing.T) {
+	ctx := context.Background()
+	want := scalarStruct{A: 7, B: "x", C: 2.5, D: true, E: 9, F: "grouped"}
+
+	for _, fast := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fast=%v", fast), func(t *testing.T) {
+			storage := new(memory.Storage)
+			enc := NewEncoder(storage)
+			enc.SetInlineScalarStructs(fast)
+			ref, err := enc.Encode(ctx, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantBlobs := 1
+			if !fast {
+				wantBlobs = 7
+			}
+			if n := storage.NumBlobs(); n != wantBlobs {
+				t.Errorf("got %d blobs, want %d", n, wantBlobs)
+			}
+
+			var got scalarStruct
+			err = Unmarshal(ctx, storage, ref, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+
+			// A string field holding a blobref is not mistaken for a ref.
+			type child struct {
+				Parent string
+			}
+			wantChild := child{Parent: blob.RefFromString("parent").String()}
+			ref, err = enc.Encode(ctx, wantChild)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotChild child
+			if err := Unmarshal(ctx, storage, ref, &gotChild); err != nil {
+				t.Fatal(err)
+			}
+			if gotChild != wantChild {
+				t.Errorf("got %+v, want %+v", gotChild, wantChild)
+			}
+		})
+	}
+}
+
+func BenchmarkScalarStruct(b *testing.B) {
+	ctx := context.Background()
+	obj := scalarStruct{A: 7, B: "x", C: 2.5, D: true, E: 9, F: "grouped"}
+
+	for _, fast := range []bool{false, true} {
+		b.Run(fmt.Sprintf("encode/fast=%v", fast), func(b *testing.B) {
+			enc := NewEncoder(new(memory.Storage))
+			enc.SetInlineScalarStructs(fast)
+			for i := 0; i < b.N; i++ {
+				if _, err := enc.Encode(ctx, obj); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("decode/fast=%v", fast), func(b *testing.B) {
+			storage := new(memory.Storage)
+			enc := NewEncoder(storage)
+			enc.SetInlineScalarStructs(fast)
+			ref, err := enc.Encode(ctx, obj)
+			if err != nil {
+				b.Fatal(err)
+			}
+			dec := NewDecoder(storage)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var got scalarStruct
+				if err := dec.Decode(ctx, ref, &got); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBlobHash(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+	enc := NewEncoder(storage)
+	enc.SetBlobHash(sha1.New)
+
+	want := map[string][]int{"a": {1, 2}, "b": {3}}
+	ref, err := enc.Encode(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.HashName() != "sha1" {
+		t.Errorf("got hash %s, want sha1", ref.HashName())
+	}
+	var got map[string][]int
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestJSONNumber(t *testing.T) {
+	type withNumbers struct {
+		I json.Number
+		F json.Number
+		S []json.Number
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	want := withNumbers{I: "12345678901234567890", F: "-2.5e-3", S: []json.Number{"0", "7.25"}}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got withNumbers
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	_, err = Marshal(ctx, storage, json.Number("twelve"))
+	if err == nil {
+		t.Error("got no error marshaling invalid json.Number")
+	}
+
+	for _, s := range []string{"twelve", "", "1 2", "0x10", " 5", "NaN"} {
+		sref, err := blobserver.ReceiveString(ctx, storage, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n json.Number
+		err = Unmarshal(ctx, storage, sref.Ref, &n)
+		if err == nil {
+			t.Errorf("got no error unmarshaling %q as json.Number", s)
+		}
+	}
+}
+
+// countingStorage counts the blobs written to it.
+type countingStorage struct {
+	memory.Storage
+	mu     sync.Mutex
+	writes int
+}
+
+func (s *countingStorage) ReceiveBlob(ctx context.Context, ref blob.Ref, r io.Reader) (blob.SizedRef, error) {
+	s.mu.Lock()
+	s.writes++
+	s.mu.Unlock()
+	return s.Storage.ReceiveBlob(ctx, ref, r)
+}
+
+// countingFetcher counts the blobs fetched from it.
+type countingFetcher struct {
+	memory.Storage
+	mu      sync.Mutex
+	fetches int
+}
+
+func (f *countingFetcher) Fetch(ctx context.Context, ref blob.Ref) (io.ReadCloser, uint32, error) {
+	f.mu.Lock()
+	f.fetches++
+	f.mu.Unlock()
+	return f.Storage.Fetch(ctx, ref)
+}
+
+func TestEncodeDelta(t *testing.T) {
+	type (
+		leaf struct {
+			Name string
+			N    int
+		}
+		tree struct {
+			Title  string
+			Leaves []leaf
+			ByName map[string]leaf
+			Any    interface{}
+			Grp    string `pk:"g.x"`
+		}
+	)
+
+	ctx := context.Background()
+	storage := new(countingStorage)
+	enc := NewEncoder(storage)
+
+	obj := tree{
+		Title:  "t",
+		ByName: map[string]leaf{},
+		Any:    "anything",
+		Grp:    "grouped",
+	}
+	for i := 0; i < 20; i++ {
+		l := leaf{Name: fmt.Sprintf("leaf%d", i), N: i}
+		obj.Leaves = append(obj.Leaves, l)
+		obj.ByName[l.Name] = l
+	}
+	prev, err := enc.Encode(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj.Leaves[3].N = 1000
+	l := obj.ByName["leaf7"]
+	l.N = 1001
+	obj.ByName["leaf7"] = l
+
+	storage.writes = 0
+	root, err := enc.EncodeDelta(ctx, obj, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New blobs: the two changed leaf structs, their new N values, and the root.
+	const wantWrites = 5
+	if storage.writes != wantWrites {
+		t.Errorf("got %d writes, want %d", storage.writes, wantWrites)
+	}
+
+	var got tree
+	err = Unmarshal(ctx, storage, root, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %+v, want %+v", got, obj)
+	}
+
+	full, err := NewEncoder(new(memory.Storage)).Encode(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != full {
+		t.Errorf("delta root %s differs from full encoding %s", root, full)
+	}
+}
+
+func TestFile(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "src.txt")
+	content := strings.Repeat("file contents\n", 10000)
+	if err := ioutil.WriteFile(src, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2019, 9, 26, 18, 45, 43, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := NewEncoder(storage).EncodeFile(ctx, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "dest.txt")
+	err = NewDecoder(storage).RestoreFile(ctx, ref, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("restored file has %d bytes, want %d", len(got), len(content))
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("got modtime %s, want %s", info.ModTime(), mtime)
+	}
+}
+
+func TestOrderedMap(t *testing.T) {
+	type config struct {
+		Name    string
+		Entries OrderedMap[string, []int]
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	var want config
+	want.Name = "cfg"
+	for _, k := range []string{"zeta", "alpha", "mu", "beta"} {
+		want.Entries.Set(k, []int{len(k)})
+	}
+	want.Entries.Set("alpha", []int{1, 2, 3}) // keeps its position
+	want.Entries.Delete("mu")
+
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got config
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	var keys []string
+	got.Entries.Range(func(k string, _ []int) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if wantKeys := []string{"zeta", "alpha", "beta"}; !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("got keys %v, want %v", keys, wantKeys)
+	}
+	if v, ok := got.Entries.Get("alpha"); !ok || !reflect.DeepEqual(v, []int{1, 2, 3}) {
+		t.Errorf("got alpha = %v, %v", v, ok)
+	}
+
+	var om OrderedMap[int, string]
+	om.Set(3, "three")
+	om.Set(1, "one")
+	ref, err = Marshal(ctx, storage, &om)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDecoder(storage).fetch(ctx, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pairs [][2]json.RawMessage
+	if err := json.Unmarshal(s, &pairs); err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || string(pairs[0][0]) != "3" || string(pairs[1][0]) != "1" {
+		t.Errorf("unexpected ordered map blob %s", string(s))
+	}
+}
+
+func TestNumericCoercion(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	cases := []struct {
+		s       string
+		dst     interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{s: "3.0", dst: new(int), want: 3},
+		{s: "3.5", dst: new(int), wantErr: true},
+		{s: "-2.000", dst: new(int8), want: int8(-2)},
+		{s: "3e2", dst: new(uint16), want: uint16(300)},
+		{s: "1.5e1", dst: new(int), want: 15},
+		{s: "128.0", dst: new(int8), wantErr: true},
+		{s: "-1.0", dst: new(uint), wantErr: true},
+		{s: "9007199254740993.0", dst: new(int64), want: int64(9007199254740993)},
+		{s: "1e400", dst: new(int64), wantErr: true},
+		{s: "NaN", dst: new(int), wantErr: true},
+		{s: "6/3", dst: new(int), wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.s, func(t *testing.T) {
+			sref, err := blobserver.ReceiveString(ctx, storage, c.s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Strict by default.
+			err = Unmarshal(ctx, storage, sref.Ref, reflect.New(reflect.TypeOf(c.dst).Elem()).Interface())
+			if err == nil {
+				t.Error("got no error without coercion")
+			}
+
+			dec := NewDecoder(storage)
+			dec.SetNumericCoercion(true)
+			err = dec.Decode(ctx, sref.Ref, c.dst)
+			if c.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want error", reflect.ValueOf(c.dst).Elem())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := reflect.ValueOf(c.dst).Elem().Interface(); got != c.want {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSparseArray(t *testing.T) {
+	type grid struct {
+		Cells [1000]string `pk:",sparse"`
+		Dense [4]int
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	var want grid
+	want.Cells[0] = "first"
+	want.Cells[517] = "middle"
+	want.Cells[999] = "last"
+	want.Dense = [4]int{1, 0, 3, 0}
+
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewDecoder(storage).fetch(ctx, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw struct{ Cells sparseArray }
+	if err := json.Unmarshal(s, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw.Cells.Len != 1000 || len(raw.Cells.Elems) != 3 {
+		t.Errorf("got sparse len %d with %d elems, want 1000 with 3", raw.Cells.Len, len(raw.Cells.Elems))
+	}
+
+	got := grid{Cells: [1000]string{5: "stale"}}
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %v, want %v", got.Cells[:10], want.Cells[:10])
+	}
+}
+
+func TestCaches(t *testing.T) {
+	type rec struct {
+		A, B, C string
+	}
+
+	ctx := context.Background()
+	storage := new(countingStorage)
+	obj := []rec{{A: "x", B: "x", C: "y"}, {A: "x", B: "x", C: "y"}}
+
+	enc := NewEncoder(storage)
+	enc.SetDedupCache(100)
+	ref, err := enc.Encode(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Distinct blobs: "x", "y", the rec, and the slice.
+	if storage.writes != 4 {
+		t.Errorf("got %d writes, want 4", storage.writes)
+	}
+	stats := enc.CacheStats()
+	if stats.Hits != 5 || stats.Misses != 4 || stats.Entries != 4 {
+		t.Errorf("got encoder cache stats %+v, want 5 hits, 4 misses, 4 entries", stats)
+	}
+
+	dec := NewDecoder(storage)
+	dec.SetFetchCache(2)
+	var got []rec
+	err = dec.Decode(ctx, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %v, want %v", got, obj)
+	}
+	stats = dec.CacheStats()
+	if stats.Hits+stats.Misses != 9 || stats.Hits == 0 || stats.Entries != 2 {
+		t.Errorf("got decoder cache stats %+v, want 9 lookups, some hits, 2 entries", stats)
+	}
+
+	if stats := NewDecoder(storage).CacheStats(); stats != (CacheStats{}) {
+		t.Errorf("got stats %+v for disabled cache", stats)
+	}
+}
+
+func TestExtraFields(t *testing.T) {
+	type (
+		v1 struct {
+			Name  string
+			Extra map[string]interface{} `pk:",inline"`
+		}
+		v2 struct {
+			Name  string
+			Count int
+			Flag  bool `pk:",inline"`
+		}
+	)
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	// A blob written by a newer version of the type.
+	ref, err := Marshal(ctx, storage, v2{Name: "n", Count: 3, Flag: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var old v1
+	err = Unmarshal(ctx, storage, ref, &old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Name != "n" || len(old.Extra) != 2 || old.Extra["Flag"] != true {
+		t.Errorf("got %+v", old)
+	}
+
+	// Round-tripping through the old version preserves the new fields.
+	ref2, err := Marshal(ctx, storage, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref2 != ref {
+		t.Errorf("round trip through old version changed ref from %s to %s", ref, ref2)
+	}
+	var got v2
+	err = Unmarshal(ctx, storage, ref2, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (v2{Name: "n", Count: 3, Flag: true}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Declared fields win over extra keys.
+	ref, err = Marshal(ctx, storage, v1{Name: "real", Extra: map[string]interface{}{"Name": "shadow", "x": "y"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got1 v1
+	err = Unmarshal(ctx, storage, ref, &got1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (v1{Name: "real", Extra: map[string]interface{}{"x": "y"}}); !reflect.DeepEqual(got1, want) {
+		t.Errorf("got %+v, want %+v", got1, want)
+	}
+
+	// Dotted extra keys are not grouped,
+	// even alongside grouped fields and a field named like their prefix.
+	type grouped struct {
+		A     string
+		City  string                 `pk:"addr.city"`
+		Extra map[string]interface{} `pk:",inline"`
+	}
+	want := grouped{A: "a", City: "c", Extra: map[string]interface{}{"A.b": "x", "addr.zip": "z", "q.r": "s"}}
+	ref, err = Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotGrouped grouped
+	err = Unmarshal(ctx, storage, ref, &gotGrouped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotGrouped, want) {
+		t.Errorf("got %+v, want %+v", gotGrouped, want)
+	}
+}
+
+// upper marshals as its upper-cased string,
+// via a pointer receiver.
+type upper struct {
+	S string
+}
+
+func (u *upper) PkMarshal(ctx context.Context, dst blobserver.BlobReceiver) (blob.Ref, error) {
+	sref, err := blobserver.ReceiveString(ctx, dst, strings.ToUpper(u.S))
+	return sref.Ref, err
+}
+
+func TestPointerReceiverMarshaler(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+	want := blob.RefFromString("HELLO")
+
+	// By value at top level (not addressable).
+	ref, err := Marshal(ctx, storage, upper{S: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != want {
+		t.Errorf("by value: got %s, want %s", ref, want)
+	}
+
+	// As a field of a struct reached through a pointer (addressable),
+	// and in a slice.
+	type holder struct {
+		U  upper
+		Us []upper
+	}
+	h := &holder{U: upper{S: "hello"}, Us: []upper{{S: "hello"}}}
+	ref, err = Marshal(ctx, storage, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"U", "Us[0]"} {
+		_, fieldRef, err := NewDecoder(storage).RawField(ctx, ref, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fieldRef != want {
+			t.Errorf("%s: got %s, want %s", path, fieldRef, want)
+		}
+	}
+}
+
+func TestEmptyBlobInInterface(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	want := []interface{}{"", false, nil, "x", true, 0}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestReadableRoot(t *testing.T) {
+	type (
+		item struct {
+			N int
+		}
+		doc struct {
+			Title string `pk:"title"`
+			Items []item
+		}
+	)
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+	enc := NewEncoder(storage)
+	enc.SetReadableRoot(true)
+
+	want := doc{Title: "t", Items: []item{{N: 1}, {N: 2}}}
+	ref, err := enc.Encode(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _, err := NewDecoder(storage).RawField(ctx, ref, summaryKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum summary
+	if err := json.Unmarshal(b, &sum); err != nil {
+		t.Fatal(err)
+	}
+	wantSum := summary{Type: "pk.doc", Fields: []summaryField{{Name: "title", Type: "string"}, {Name: "Items", Type: "[]pk.item"}}}
+	if !reflect.DeepEqual(sum, wantSum) {
+		t.Errorf("got summary %+v, want %+v", sum, wantSum)
+	}
+	if !strings.Contains(string(b), "\n  ") {
+		t.Errorf("summary not indented: %s", b)
+	}
+
+	var got doc
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Only the root gets a summary.
+	ref, err = enc.Encode(ctx, []item{{N: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewDecoder(storage).RawField(ctx, ref, "[0]."+summaryKey); err == nil {
+		t.Error("got summary for non-root struct")
+	}
+}
+
+func TestCollectErrors(t *testing.T) {
+	type order struct {
+		ID  int
+		Qty int
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	orders := []order{{ID: 1, Qty: 10}, {ID: 2, Qty: 20}, {ID: 3, Qty: 30}}
+	ref, err := Marshal(ctx, storage, orders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the middle order's Qty.
+	refs, err := NewDecoder(storage).readRefArray(ctx, mustFetch(t, storage, ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	badQty, err := blobserver.ReceiveString(ctx, storage, "twenty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	badOrder, err := blobserver.ReceiveString(ctx, storage, fmt.Sprintf(`{"ID":%q,"Qty":%q}`, blob.RefFromString("2"), badQty.Ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs[1] = badOrder.Ref
+	j, err := json.Marshal(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sref, err := blobserver.ReceiveString(ctx, storage, string(j))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []order
+	err = Unmarshal(ctx, storage, sref.Ref, &got)
+	if err == nil {
+		t.Error("got no error in fail-fast mode")
+	}
+
+	dec := NewDecoder(storage)
+	dec.SetErrorMode(Collect)
+	got = nil
+	err = dec.Decode(ctx, sref.Ref, &got)
+	collected, ok := errors.Cause(err).(ErrCollected)
+	if !ok {
+		t.Fatalf("got error %v, want ErrCollected", err)
+	}
+	if len(collected.Errs) != 1 || collected.Errs[0].Path != "[1]" {
+		t.Errorf("got collected errors %v, want one at [1]", collected.Errs)
+	}
+	if want := []order{orders[0], orders[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var arr [3]order
+	err = dec.Decode(ctx, sref.Ref, &arr)
+	if _, ok := errors.Cause(err).(ErrCollected); !ok {
+		t.Fatalf("got error %v, want ErrCollected", err)
+	}
+	if want := [3]order{orders[0], {}, orders[2]}; arr != want {
+		t.Errorf("got %v, want %v", arr, want)
+	}
+}
+
+func mustFetch(t *testing.T, storage *memory.Storage, ref blob.Ref) []byte {
+	t.Helper()
+	s, err := NewDecoder(storage).fetch(context.Background(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNilPointers(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	n := 7
+	want := map[string]*int{"a": &n, "b": nil}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]*int
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if p, ok := got["b"]; !ok || p != nil {
+		t.Errorf("got b = %v, %v; want nil, true", p, ok)
+	}
+
+	type ptrs struct {
+		I *int
+		F *float64
+		S *string
+		T *struct{ X int }
+	}
+	empty := ""
+	wantPtrs := ptrs{S: &empty}
+	ref, err = Marshal(ctx, storage, wantPtrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotPtrs ptrs
+	err = Unmarshal(ctx, storage, ref, &gotPtrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotPtrs, wantPtrs) {
+		t.Errorf("got %+v, want %+v", gotPtrs, wantPtrs)
+	}
+}
+
+func TestStrictTags(t *testing.T) {
+	type (
+		good struct {
+			A int    `pk:"a,omitempty"`
+			B string `pk:",inline,"`
+		}
+		typo struct {
+			A int `pk:",ommitempty"`
+		}
+		outer struct {
+			G  good
+			Ts map[string][]*typo
+		}
+	)
+
+	if err := ValidateType(reflect.TypeOf(good{})); err != nil {
+		t.Errorf("good: %s", err)
+	}
+	err := ValidateType(reflect.TypeOf(outer{}))
+	want := ErrUnknownTagOption{Type: "pk.typo", Field: "A", Option: "ommitempty"}
+	if err != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	// Lenient by default.
+	ref, err := Marshal(ctx, storage, typo{A: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := NewEncoder(storage)
+	enc.SetStrictTags(true)
+	_, err = enc.Encode(ctx, typo{A: 1})
+	if errors.Cause(err) != want {
+		t.Errorf("encoding: got %v, want %v", err, want)
+	}
+
+	dec := NewDecoder(storage)
+	dec.SetStrictTags(true)
+	var got typo
+	err = dec.Decode(ctx, ref, &got)
+	if errors.Cause(err) != want {
+		t.Errorf("decoding: got %v, want %v", err, want)
+	}
+}
+
+func TestRefInInterface(t *testing.T) {
+	type dyn struct {
+		V interface{}
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	r := blob.RefFromString("target")
+	ref, err := Marshal(ctx, storage, dyn{V: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, vref, err := NewDecoder(storage).RawField(ctx, ref, "V")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != r.String() {
+		t.Errorf("got %q stored for %s (at %s), want the bare ref", b, r, vref)
+	}
+
+	var got dyn
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.V != r {
+		t.Errorf("got %#v, want %#v", got.V, r)
+	}
+
+	// A string that looks like a ref stays a string.
+	ref, err = Marshal(ctx, storage, dyn{V: r.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = dyn{}
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.V != r.String() {
+		t.Errorf("got %#v, want %#v", got.V, r.String())
+	}
+}
+
+func TestMaxRefArrayLen(t *testing.T) {
+	type withContainers struct {
+		S []int
+		M map[string]int
+	}
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	enc := NewEncoder(storage)
+	enc.SetChunkFanout(2)
+	sref, err := enc.Encode(ctx, []int{1, 2, 3, 4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stref, err := Marshal(ctx, storage, withContainers{S: []int{1, 2, 3}, M: map[string]int{"a": 1, "b": 2, "c": 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mref, err := Marshal(ctx, storage, map[int]bool{1: true, 2: true, 3: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		ref  blob.Ref
+		dst  interface{}
+	}{
+		{"chunked slice", sref, new([]int)},
+		{"array", sref, new([5]int)},
+		{"struct", stref, new(withContainers)},
+		{"map", mref, new(map[int]bool)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dec := NewDecoder(storage)
+			if err := dec.Decode(ctx, c.ref, c.dst); err != nil {
+				t.Fatalf("with default limit: %s", err)
+			}
+			dec.SetMaxRefArrayLen(2)
+			err := dec.Decode(ctx, c.ref, c.dst)
+			if errors.Cause(err) != ErrTooManyRefs {
+				t.Errorf("got %v, want ErrTooManyRefs", err)
+			}
+		})
+	}
+}
+
+type invoice struct {
+	Lines []int
+	Total int    `pk:",compute"`
+	Label string `pk:",compute"`
+}
+
+func (inv invoice) ComputeTotal() int {
+	var sum int
+	for _, l := range inv.Lines {
+		sum += l
+	}
+	return sum
+}
+
+func (inv *invoice) ComputeLabel() (string, error) {
+	if len(inv.Lines) == 0 {
+		return "", errors.New("empty invoice")
+	}
+	return fmt.Sprintf("%d lines", len(inv.Lines)), nil
+}
+
+type badCompute struct {
+	X int `pk:",compute"`
+}
+
+func (badCompute) ComputeX(int) int { return 0 }
+
+func TestComputedFields(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	ref, err := Marshal(ctx, storage, invoice{Lines: []int{3, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got invoice
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (invoice{Lines: []int{3, 4}, Total: 7, Label: "2 lines"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	_, err = Marshal(ctx, storage, invoice{})
+	if err == nil || !strings.Contains(err.Error(), "empty invoice") {
+		t.Errorf("got %v, want the compute method's error", err)
+	}
+
+	_, err = Marshal(ctx, storage, badCompute{})
+	if err == nil || !strings.Contains(err.Error(), "method ComputeX has type") {
+		t.Errorf("got %v, want signature error", err)
+	}
+
+	type missing struct {
+		Y int `pk:",compute"`
+	}
+	_, err = Marshal(ctx, storage, missing{})
+	if err == nil || !strings.Contains(err.Error(), "no method ComputeY") {
+		t.Errorf("got %v, want missing-method error", err)
+	}
+}
+
+func TestTee(t *testing.T) {
+	ctx := context.Background()
+	a, b := new(memory.Storage), new(memory.Storage)
+
+	obj := map[string][]string{"x": {"one", "two"}, "y": {"three"}}
+	ref, err := NewEncoder(TeeReceiver(a, b)).Encode(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.NumBlobs() == 0 || a.NumBlobs() != b.NumBlobs() || a.SumBlobSize() != b.SumBlobSize() {
+		t.Errorf("stores differ: %d blobs (%d bytes) vs. %d blobs (%d bytes)", a.NumBlobs(), a.SumBlobSize(), b.NumBlobs(), b.SumBlobSize())
+	}
+	for _, s := range []*memory.Storage{a, b} {
+		var got map[string][]string
+		err = Unmarshal(ctx, s, ref, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, obj) {
+			t.Errorf("got %v, want %v", got, obj)
+		}
+	}
+
+	// A flaky destination fails half its writes.
+	flaky := &flakyStorage{Storage: new(memory.Storage)}
+	_, err = NewEncoder(TeeReceiver(new(memory.Storage), flaky)).Encode(ctx, obj)
+	if err == nil {
+		t.Error("got no error from tee with a failing destination")
+	}
+
+	flaky = &flakyStorage{Storage: new(memory.Storage)}
+	tee := TeeReceiver(new(memory.Storage), flaky)
+	var failures int
+	tee.SetOnError(func(dst int, _ blob.Ref, err error) {
+		if dst != 1 {
+			t.Errorf("got failure in destination %d", dst)
+		}
+		failures++
+	})
+	_, err = NewEncoder(tee).Encode(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures == 0 {
+		t.Error("got no failures reported")
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	type (
+		v1 struct {
+			Name string
+		}
+		v2 struct {
+			Name    string        `pk:",default=anon"`
+			Retries int           `pk:",default=3"`
+			Timeout time.Duration `pk:",default=30s"`
+			Color   color         `pk:",default=green"`
+			Verbose bool          `pk:",default=true"`
+		}
+		bad struct {
+			N int `pk:",default=lots"`
+		}
+	)
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	ref, err := Marshal(ctx, storage, v1{Name: "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got v2
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (v2{Name: "n", Retries: 3, Timeout: 30 * time.Second, Color: green, Verbose: true}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Present fields, even zero ones, override defaults.
+	ref, err = Marshal(ctx, storage, v2{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = v2{}
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != (v2{}) {
+		t.Errorf("got %+v, want zero value", got)
+	}
+
+	_, err = Marshal(ctx, storage, bad{})
+	if err == nil || !strings.Contains(err.Error(), `invalid default "lots"`) {
+		t.Errorf("got %v, want invalid-default error", err)
+	}
+	var b bad
+	err = Unmarshal(ctx, storage, ref, &b)
+	if err == nil {
+		t.Error("got no error decoding into type with invalid default")
+	}
+}
+
+func TestShardedMap(t *testing.T) {
+	ctx := context.Background()
+
+	want := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		want[fmt.Sprintf("key%d", i)] = i
+	}
+	wantInts := map[int]string{1: "one", 2: "two", 3: "three", 40: "forty"}
+
+	for _, shards := range []int{0, 1, 8, 64} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			storage := new(memory.Storage)
+			enc := NewEncoder(storage)
+			enc.SetMapSharding(100, shards)
+
+			ref, err := enc.Encode(ctx, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]int
+			err = Unmarshal(ctx, storage, ref, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %d entries, want %d", len(got), len(want))
+			}
+
+			refMap, err := NewDecoder(storage).DecodeRefMap(ctx, ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(refMap) != len(want) {
+				t.Errorf("got %d refs, want %d", len(refMap), len(want))
+			}
+
+			// Small maps are not sharded.
+			ref, err = enc.Encode(ctx, wantInts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotInts map[int]string
+			err = Unmarshal(ctx, storage, ref, &gotInts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotInts, wantInts) {
+				t.Errorf("got %v, want %v", gotInts, wantInts)
+			}
+
+			if shards < 1 {
+				return
+			}
+
+			// No blob may hold all the keys.
+			ch := make(chan blob.SizedRef)
+			go storage.EnumerateBlobs(ctx, ch, "", -1)
+			for sref := range ch {
+				b := mustFetch(t, storage, sref.Ref)
+				if n := strings.Count(string(b), "sha"); n >= len(want) && shards > 1 {
+					t.Errorf("blob %s has %d refs, want fewer than %d", sref.Ref, n, len(want))
+				}
+			}
+		})
+	}
+
+	t.Run("keys resembling a directory", func(t *testing.T) {
+		storage := new(memory.Storage)
+		m := map[string]string{"len": "3", "shards": "[]"}
+		ref, err := Marshal(ctx, storage, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]string
+		err = Unmarshal(ctx, storage, ref, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("got %v, want %v", got, m)
+		}
+	})
+}
+
+func TestDecodeMapValue(t *testing.T) {
+	ctx := context.Background()
+
+	m := make(map[int]string)
+	for i := 0; i < 500; i++ {
+		m[i] = strconv.Itoa(i * i)
+	}
+
+	for _, shards := range []int{0, 16} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			storage := new(memory.Storage)
+			enc := NewEncoder(storage)
+			enc.SetMapSharding(100, shards)
+			ref, err := enc.Encode(ctx, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dec := NewDecoder(storage)
+			var got string
+			found, err := dec.DecodeMapValue(ctx, ref, 17, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found {
+				t.Fatal("key 17 not found")
+			}
+			if got != "289" {
+				t.Errorf("got %q, want \"289\"", got)
+			}
+
+			got = "untouched"
+			found, err = dec.DecodeMapValue(ctx, ref, 1000, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found {
+				t.Error("key 1000 found")
+			}
+			if got != "untouched" {
+				t.Errorf("got %q, want dst untouched", got)
+			}
+		})
+	}
+
+	t.Run("nil map", func(t *testing.T) {
+		storage := new(memory.Storage)
+		ref, err := Marshal(ctx, storage, map[string]int(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got int
+		found, err := NewDecoder(storage).DecodeMapValue(ctx, ref, "x", &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			t.Error("key found in nil map")
+		}
+	})
+}
+
+type countingInterner struct {
+	StringInterner
+	calls int
+}
+
+func (c *countingInterner) Intern(b []byte) string {
+	c.calls++
+	return c.StringInterner.Intern(b)
+}
+
+func TestStringInterner(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	want := []string{"red", "green", "red", "blue", "red", "green"}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := &countingInterner{StringInterner: NewStringInterner()}
+	dec := NewDecoder(storage)
+	dec.SetStringInterner(in)
+
+	var got []string
+	err = dec.Decode(ctx, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if in.calls != len(want) {
+		t.Errorf("got %d calls to Intern, want %d", in.calls, len(want))
+	}
+
+	def := NewStringInterner()
+	b := []byte("hello")
+	s1 := def.Intern(b)
+	b[0] = 'j'
+	if s1 != "hello" {
+		t.Errorf("interned string changed with its input to %q", s1)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { def.Intern([]byte("hello")) }); allocs > 0 {
+		t.Errorf("got %v allocations re-interning a string, want 0", allocs)
+	}
+}
+
+func BenchmarkStringInterner(b *testing.B) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	var obj []string
+	for i := 0; i < 1000; i++ {
+		obj = append(obj, fmt.Sprintf("a rather long enum-like value number %d", i%5))
+	}
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, intern := range []bool{false, true} {
+		b.Run(fmt.Sprintf("intern=%v", intern), func(b *testing.B) {
+			dec := NewDecoder(storage)
+			if intern {
+				dec.SetStringInterner(NewStringInterner())
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var got []string
+				if err := dec.Decode(ctx, ref, &got); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type listNode struct {
+	V    int
+	Next *listNode `pk:",omitempty"`
+}
+
+type treeNode struct {
+	V    int
+	Next *treeNode `pk:",omitempty"`
+	Alt  *treeNode
+}
+
+func TestLongLinkedList(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	const n = 100000
+	var head *listNode
+	for i := n - 1; i >= 0; i-- {
+		head = &listNode{V: i, Next: head}
+	}
+
+	ref, err := Marshal(ctx, storage, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *listNode
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	for node := got; node != nil; node = node.Next {
+		if node.V != i {
+			t.Fatalf("node %d has value %d", i, node.V)
+		}
+		i++
+	}
+	if i != n {
+		t.Errorf("got %d nodes, want %d", i, n)
+	}
+
+	// Each node refers to the separately marshaled next node.
+	short := &listNode{V: 1, Next: &listNode{V: 2}}
+	ref, err = Marshal(ctx, storage, short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextRef, err := Marshal(ctx, storage, short.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]blob.Ref
+	if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["Next"] != nextRef {
+		t.Errorf("got Next ref %s, want %s", fields["Next"], nextRef)
+	}
+
+	// With two self-pointers, a node is not part of a list.
+	var tree treeNode
+	err = Unmarshal(ctx, storage, ref, &tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.V != 1 || tree.Next == nil || tree.Next.V != 2 || tree.Next.Next != nil || tree.Alt != nil {
+		t.Errorf("got %+v", tree)
+	}
+
+	// A cycle is an error.
+	cyc := &listNode{V: 1}
+	cyc.Next = &listNode{V: 2, Next: cyc}
+	_, err = Marshal(ctx, storage, cyc)
+	if err == nil {
+		t.Error("got no error marshaling a cyclic list")
+	}
+}
+
+func TestStructuralCompression(t *testing.T) {
+	ctx := context.Background()
+
+	type inner struct {
+		Name string
+		Tags map[string]string
+	}
+	type outer struct {
+		Items []inner
+		Any   interface{}
+	}
+	want := outer{Any: "hello"}
+	for i := 0; i < 20; i++ {
+		want.Items = append(want.Items, inner{Name: fmt.Sprintf("item %d", i), Tags: map[string]string{"k": "v"}})
+	}
+	storage := new(memory.Storage)
+	enc := NewEncoder(storage)
+	enc.SetStructuralCompression(true)
+	ref, err := enc.Encode(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := mustFetch(t, storage, ref)
+	if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		t.Errorf("root blob is not compressed: %q", b)
+	}
+
+	var got outer
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Leaves are uncompressed.
+	raw, _, err := NewDecoder(storage).RawField(ctx, ref, "Items[3].Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "item 3" {
+		t.Errorf("got leaf %q, want \"item 3\"", raw)
+	}
+
+	// A blob that decompresses to more than the max blob size is rejected.
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(make([]byte, constants.MaxBlobSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unpackStructure(buf.Bytes()); err == nil {
+		t.Error("got no error decompressing an oversized blob")
+	}
+}
+
+func BenchmarkStructuralCompression(b *testing.B) {
+	ctx := context.Background()
+
+	obj := make(map[string][]int)
+	for i := 0; i < 100; i++ {
+		obj[strconv.Itoa(i)] = []int{i, i + 1, i + 2, i + 3, i + 4}
+	}
+
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%v", compress), func(b *testing.B) {
+			var size int64
+			for i := 0; i < b.N; i++ {
+				size = 0
+				enc := NewEncoder(new(memory.Storage))
+				enc.SetStructuralCompression(compress)
+				enc.SetProgress(func(sref blob.SizedRef) { size += int64(sref.Size) })
+				if _, err := enc.Encode(ctx, obj); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size), "bytes/tree")
+		})
+	}
+}
+
+func TestEncodeChannel(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+	enc := NewEncoder(storage)
+
+	ch := make(chan string)
+	go func() {
+		for _, s := range []string{"a", "b", "c"} {
+			ch <- s
+		}
+		close(ch)
+	}()
+	ref, err := enc.EncodeChannel(ctx, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = enc.EncodeChannel(cctx, make(chan int))
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+
+	_, err = enc.EncodeChannel(ctx, make(chan<- int))
+	if err == nil {
+		t.Error("got no error for a send-only channel")
+	}
+}
+
+// aeadCipher is a FieldCipher using AES-GCM with a random nonce prepended to each ciphertext.
+type aeadCipher struct {
+	aead cipher.AEAD
+}
+
+func newAEADCipher(t *testing.T) *aeadCipher {
+	block, err := aes.NewCipher(make([]byte, 32)) // an all-zero key, for testing only
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &aeadCipher{aead: aead}
+}
+
+func (c *aeadCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c *aeadCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return c.aead.Open(nil, ciphertext[:n], ciphertext[n:], nil)
+}
+
+type patient struct {
+	Name  string
+	SSN   string   `pk:",encrypt"`
+	Notes []string `pk:",encrypt"`
+}
+
+func TestEncryptedFields(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+	c := newAEADCipher(t)
+
+	want := patient{Name: "Pat", SSN: "123-45-6789", Notes: []string{"allergic to penicillin"}}
+
+	enc := NewEncoder(storage)
+	enc.SetFieldCipher(c)
+	ref, err := enc.Encode(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan blob.SizedRef)
+	go storage.EnumerateBlobs(ctx, ch, "", -1)
+	var sawName bool
+	for sref := range ch {
+		b := string(mustFetch(t, storage, sref.Ref))
+		if strings.Contains(b, "6789") || strings.Contains(b, "penicillin") {
+			t.Errorf("blob %s contains plaintext: %q", sref.Ref, b)
+		}
+		if b == "Pat" {
+			sawName = true
+		}
+	}
+	if !sawName {
+		t.Error("unencrypted field not stored in plaintext")
+	}
+
+	dec := NewDecoder(storage)
+	dec.SetFieldCipher(c)
+	var got patient
+	err = dec.Decode(ctx, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	err = Unmarshal(ctx, storage, ref, &got)
+	if errors.Cause(err) != ErrNoFieldCipher {
+		t.Errorf("got error %v decoding without a cipher, want %v", err, ErrNoFieldCipher)
+	}
+	_, err = Marshal(ctx, storage, want)
+	if errors.Cause(err) != ErrNoFieldCipher {
+		t.Errorf("got error %v encoding without a cipher, want %v", err, ErrNoFieldCipher)
+	}
+}
+
+func TestNestedArrays(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type matrix struct {
+		M [3][2]int
+	}
+	want := matrix{M: [3][2]int{{1, 2}, {3, 4}, {5, 6}}}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(storage)
+	dec.SetStrictArrayLengths(true)
+	var got matrix
+	err = dec.Decode(ctx, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A blob whose inner arrays are too long.
+	type wide struct {
+		M [3][3]int
+	}
+	ref, err = Marshal(ctx, storage, wide{M: [3][3]int{{1, 2, 9}, {3, 4, 9}, {5, 6, 9}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dec.Decode(ctx, ref, &got)
+	if errors.Cause(err) != ErrArrayLength {
+		t.Errorf("got error %v, want %v", err, ErrArrayLength)
+	}
+
+	// And one whose outer array is too short.
+	type short struct {
+		M [2][2]int
+	}
+	ref, err = Marshal(ctx, storage, short{M: [2][2]int{{1, 2}, {3, 4}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dec.Decode(ctx, ref, &got)
+	if errors.Cause(err) != ErrArrayLength {
+		t.Errorf("got error %v, want %v", err, ErrArrayLength)
+	}
+
+	// Without strict lengths, the extra elements are dropped.
+	ref, err = Marshal(ctx, storage, wide{M: [3][3]int{{1, 2, 9}, {3, 4, 9}, {5, 6, 9}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = matrix{}
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestListRoots(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	unmarked, err := Marshal(ctx, storage, []string{"not", "marked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := NewEncoder(storage)
+	enc.SetMarkRoots(true)
+	var want []blob.Ref
+	for _, obj := range []interface{}{"x", map[string]int{"a": 1}, []string{"not", "marked", "either"}} {
+		ref, err := enc.Encode(ctx, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, ref)
+	}
+	// Encoding a tree again does not list it twice.
+	if _, err := enc.Encode(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].String() < want[j].String() })
+
+	got, err := ListRoots(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, ref := range got {
+		if ref == unmarked {
+			t.Errorf("unmarked root %s listed", ref)
+		}
+	}
+}
+
+func BenchmarkScalarSlice(b *testing.B) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	obj := make([]int, 1000)
+	for i := range obj {
+		obj[i] = i
+	}
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dec := NewDecoder(storage)
+
+	// []int takes the fast path;
+	// []*int, whose elements have the same blobs, takes the generic one.
+	b.Run("fast", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var got []int
+			if err := dec.Decode(ctx, ref, &got); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("generic", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var got []*int
+			if err := dec.Decode(ctx, ref, &got); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestScalarSliceErrors(t *testing.T) {
+	ctx := context.Background()
+	storage := new(countingFetcher)
+
+	var refs []blob.Ref
+	for _, s := range []string{"1", "two", "3"} {
+		sref, err := blobserver.ReceiveString(ctx, storage, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, sref.Ref)
+	}
+	refs = append(refs, blob.RefFromString("missing"))
+	j, err := json.Marshal(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sref, err := blobserver.ReceiveString(ctx, storage, string(j))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	if err := Unmarshal(ctx, storage, sref.Ref, &got); err == nil {
+		t.Error("got no error for an unparseable element")
+	}
+
+	dec := NewDecoder(storage)
+	dec.SetErrorMode(Collect)
+	got = nil
+	storage.fetches = 0
+	err = dec.Decode(ctx, sref.Ref, &got)
+	collected, ok := errors.Cause(err).(ErrCollected)
+	if !ok {
+		t.Fatalf("got error %v, want ErrCollected", err)
+	}
+	if len(collected.Errs) != 2 || collected.Errs[0].Path != "[1]" || collected.Errs[1].Path != "[3]" {
+		t.Errorf("got collected errors %v, want ones at [1] and [3]", collected.Errs)
+	} else if !os.IsNotExist(errors.Cause(collected.Errs[1].Err)) {
+		t.Errorf("got error %v for the missing element, want a not-exist error", collected.Errs[1].Err)
+	}
+	if storage.fetches != 5 {
+		t.Errorf("got %d fetches, want 5 (each blob once)", storage.fetches)
+	}
+	if want := []int{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestZonedTimes(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	type appointment struct {
+		Plain time.Time
+		Zoned time.Time `pk:",tzname"`
+		Fixed time.Time `pk:",tzname"`
+	}
+	tm := time.Date(2021, 3, 14, 1, 30, 0, 0, ny) // just before a DST transition
+	want := appointment{
+		Plain: tm,
+		Zoned: tm,
+		Fixed: time.Date(2021, 3, 14, 1, 30, 0, 0, time.FixedZone("XYZ", 3600)),
+	}
+	ref, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got appointment
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.Plain.Equal(tm) {
+		t.Errorf("got plain time %s, want %s", got.Plain, tm)
+	}
+	if name := got.Plain.Location().String(); name == "America/New_York" {
+		t.Error("plain time kept its location name")
+	}
+	if !got.Zoned.Equal(tm) || got.Zoned.Location().String() != "America/New_York" {
+		t.Errorf("got zoned time %s in %s, want %s in America/New_York", got.Zoned, got.Zoned.Location(), tm)
+	}
+
+	// After the DST transition, the zoned time gives the right offset
+	// and the plain one does not.
+	later := tm.Add(24 * time.Hour)
+	if _, off := got.Zoned.Add(24 * time.Hour).Zone(); off != -4*3600 {
+		t.Errorf("got zoned offset %d a day later, want %d", off, -4*3600)
+	}
+	if _, off := got.Plain.Add(24 * time.Hour).Zone(); off != -5*3600 {
+		t.Errorf("got plain offset %d a day later, want %d", off, -5*3600)
+	}
+	if !got.Zoned.Add(24 * time.Hour).Equal(later) {
+		t.Error("zoned times differ a day later")
+	}
+
+	_, wantOff := want.Fixed.Zone()
+	if _, off := got.Fixed.Zone(); !got.Fixed.Equal(want.Fixed) || off != wantOff {
+		t.Errorf("got fixed-zone time %s, want %s", got.Fixed, want.Fixed)
+	}
+
+	// A plain time reads into a tzname field.
+	type appointment2 struct {
+		Plain time.Time `pk:",tzname"`
+	}
+	var got2 appointment2
+	err = Unmarshal(ctx, storage, ref, &got2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got2.Plain.Equal(tm) {
+		t.Errorf("got %s, want %s", got2.Plain, tm)
+	}
+}
+
+func TestFieldFilter(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type reading struct {
+		Temp  int
+		Humid int
+		Label string `pk:"label"`
+	}
+	enc := NewEncoder(storage)
+	enc.SetFieldFilter(func(structType reflect.Type, fieldName string, value reflect.Value) bool {
+		if structType != reflect.TypeOf(reading{}) {
+			return true
+		}
+		if fieldName == "Label" {
+			return value.String() != "secret"
+		}
+		return value.Int() >= 0
+	})
+
+	ref, err := enc.Encode(ctx, reading{Temp: -5, Humid: 40, Label: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["Humid"]; len(fields) != 1 || !ok {
+		t.Errorf("got fields %v, want only Humid", fields)
+	}
+
+	var got reading
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (reading{Humid: 40}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPointersToContainers(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type containers struct {
+		S  *[]int          `pk:",omitempty"`
+		M  *map[string]int `pk:",omitempty"`
+		S2 *[]int
+		M2 *map[string]int
+	}
+
+	var (
+		nilSlice   []int
+		emptySlice = []int{}
+		fullSlice  = []int{1, 2}
+		nilMap     map[string]int
+		emptyMap   = map[string]int{}
+		fullMap    = map[string]int{"a": 1}
+	)
+
+	cases := []struct {
+		name string
+		obj  containers
+		want containers
+	}{
+		{
+			name: "nil pointers",
+			obj:  containers{},
+			// Without omitempty,
+			// a nil pointer is indistinguishable from a pointer to nil.
+			want: containers{S2: &nilSlice, M2: &nilMap},
+		},
+		{
+			name: "pointers to nil",
+			obj:  containers{S: &nilSlice, M: &nilMap, S2: &nilSlice, M2: &nilMap},
+			want: containers{S: &nilSlice, M: &nilMap, S2: &nilSlice, M2: &nilMap},
+		},
+		{
+			name: "pointers to empty",
+			obj:  containers{S: &emptySlice, M: &emptyMap, S2: &emptySlice, M2: &emptyMap},
+			want: containers{S: &emptySlice, M: &emptyMap, S2: &emptySlice, M2: &emptyMap},
+		},
+		{
+			name: "pointers to non-empty",
+			obj:  containers{S: &fullSlice, M: &fullMap, S2: &fullSlice, M2: &fullMap},
+			want: containers{S: &fullSlice, M: &fullMap, S2: &fullSlice, M2: &fullMap},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ref, err := Marshal(ctx, storage, c.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got containers
+			err = Unmarshal(ctx, storage, ref, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// reflect.DeepEqual distinguishes nil from empty slices and maps.
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %s, want %s", spew.Sdump(got), spew.Sdump(c.want))
+			}
+		})
+	}
+}
+
+func TestCanMarshal(t *testing.T) {
+	type node struct {
+		Name string
+		Next *node
+	}
+	type order struct {
+		Items []node
+		Attrs map[string]interface{}
+		F     func() `pk:"-"`
+	}
+
+	loop := &node{Name: "a"}
+	loop.Next = &node{Name: "b", Next: loop}
+
+	shared := &node{Name: "s"}
+
+	type badTag struct {
+		A int `pk:",ommitempty"`
+	}
+	type unregistered struct{ X int }
+	type badRefOf struct {
+		Ref blob.Ref `pk:",refof=Nope"`
+	}
+	type badSelf struct {
+		ID string `pk:",self"`
+	}
+	type priced struct {
+		Price money `pk:",money"`
+	}
+
+	cases := []struct {
+		name     string
+		obj      interface{}
+		wantPath string
+		wantErr  error // compared with errors.Cause; nil means any error
+		ok       bool
+	}{
+		{
+			name: "ok",
+			obj:  order{Items: []node{{Name: "x"}}, Attrs: map[string]interface{}{"k": nil}},
+			ok:   true,
+		},
+		{
+			name: "shared but acyclic",
+			obj:  []*node{shared, {Next: shared}, shared},
+			ok:   true,
+		},
+		{
+			name:     "cycle",
+			obj:      order{Items: []node{{}, *loop}},
+			wantPath: "Items[1].Next.Next.Next",
+			wantErr:  ErrCycle,
+		},
+		{
+			name:     "unsupported",
+			obj:      map[string]interface{}{"c": make(chan int)},
+			wantPath: "[c]",
+		},
+		{
+			name:     "unregistered",
+			obj:      order{Attrs: map[string]interface{}{"u": unregistered{}}},
+			wantPath: "Attrs[u]",
+			wantErr:  ErrUnregisteredType{Name: "pk.unregistered"},
+		},
+		{
+			name:    "bad tag",
+			obj:     &badTag{},
+			wantErr: ErrUnknownTagOption{Type: "pk.badTag", Field: "A", Option: "ommitempty"},
+		},
+		{
+			name:     "bad key",
+			obj:      []map[[2]int]string{{}},
+			wantPath: "[0]",
+			wantErr:  ErrUnsupportedType{Name: "[2]int"},
+		},
+		{
+			name:     "bad refof",
+			obj:      []badRefOf{{}},
+			wantPath: "[0]",
+		},
+		{
+			name:     "bad self",
+			obj:      map[string]badSelf{"x": {}},
+			wantPath: "[x]",
+		},
+		{
+			name:     "bad money",
+			obj:      &priced{Price: money{Amount: 100}},
+			wantPath: "Price",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := CanMarshal(c.obj)
+			if c.ok {
+				if err != nil {
+					t.Errorf("got error %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if c.wantErr != nil && errors.Cause(err) != c.wantErr {
+				t.Errorf("got error %v, want %v", errors.Cause(err), c.wantErr)
+			}
+			if c.wantPath != "" && !strings.HasPrefix(err.Error(), "at "+c.wantPath+": ") {
+				t.Errorf("got error %q, want path %s", err, c.wantPath)
+			}
+		})
+	}
+}
+
+type factoryLog struct {
+	Name string
+	buf  []byte `pk:"-"`
+}
+
+func newFactoryLog() *factoryLog {
+	return &factoryLog{buf: make([]byte, 0, 64)}
+}
+
+func TestRegisterFactory(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	RegisterFactory(reflect.TypeOf(factoryLog{}), func() interface{} { return newFactoryLog() })
+
+	type holder struct {
+		P   *factoryLog
+		V   factoryLog
+		S   []factoryLog
+		A   [1]factoryLog
+		M   map[string]*factoryLog
+		Nil *factoryLog
+	}
+	obj := holder{
+		P: &factoryLog{Name: "p"},
+		V: factoryLog{Name: "v"},
+		S: []factoryLog{{Name: "s0"}, {Name: "s1"}},
+		A: [1]factoryLog{{Name: "a0"}},
+		M: map[string]*factoryLog{"k": {Name: "m"}},
+	}
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got holder
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(what string, l *factoryLog, name string) {
+		if l == nil {
+			t.Errorf("%s: got nil", what)
+			return
+		}
+		if l.Name != name {
+			t.Errorf("%s: got name %q, want %q", what, l.Name, name)
+		}
+		if l.buf == nil {
+			t.Errorf("%s: factory did not initialize buffer", what)
+		}
+	}
+	check("P", got.P, "p")
+	check("V", &got.V, "v")
+	if len(got.S) != 2 {
+		t.Fatalf("got %d elements in S, want 2", len(got.S))
+	}
+	check("S[0]", &got.S[0], "s0")
+	check("S[1]", &got.S[1], "s1")
+	check("A[0]", &got.A[0], "a0")
+	check("M[k]", got.M["k"], "m")
+	if got.Nil != nil {
+		t.Errorf("got %+v for nil pointer, want nil", got.Nil)
+	}
+
+	type wrongFactory struct{ X int }
+	RegisterFactory(reflect.TypeOf(wrongFactory{}), func() interface{} { return "oops" })
+	ref, err = Marshal(ctx, storage, []wrongFactory{{X: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrong []wrongFactory
+	if err = Unmarshal(ctx, storage, ref, &wrong); err == nil {
+		t.Error("got no error from factory returning the wrong type")
+	}
+}
+
+func TestPacked(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type samples struct {
+		U8  []uint8   `pk:",packed"`
+		I16 []int16   `pk:",packed"`
+		U32 []uint32  `pk:",packed"`
+		I64 []int64   `pk:",packed"`
+		I   []int     `pk:",packed"`
+		F32 []float32 `pk:",packed"`
+		F64 []float64 `pk:",packed"`
+		Nil []uint32  `pk:",packed"`
+		S   []string  `pk:",packed"` // not numeric, so stored as usual
+	}
+	obj := samples{
+		U8:  []uint8{0, 1, 255},
+		I16: []int16{-32768, -1, 0, 32767},
+		U32: []uint32{1, 2, math.MaxUint32},
+		I64: []int64{math.MinInt64, -7, math.MaxInt64},
+		I:   []int{-1, 0, 1 << 40},
+		F32: []float32{-1.5, 0, float32(math.Inf(1))},
+		F64: []float64{math.Pi, -0.25, math.MaxFloat64},
+		S:   []string{"a", "b"},
+	}
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+		t.Fatal(err)
+	}
+	var u32Ref blob.Ref
+	if err := json.Unmarshal(fields["U32"], &u32Ref); err != nil {
+		t.Fatalf("U32 is %s, want a single blobref", fields["U32"])
+	}
+	if got := mustFetch(t, storage, u32Ref); len(got) != 12 {
+		t.Errorf("got %d bytes for packed []uint32 of length 3, want 12", len(got))
+	}
+
+	var got samples
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %s, want %s", spew.Sdump(got), spew.Sdump(obj))
+	}
+
+	// A corrupt packed blob is an error.
+	badRef, err := blobserver.ReceiveString(ctx, storage, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields["U32"], _ = json.Marshal(badRef.Ref)
+	bad, _ := json.Marshal(fields)
+	badRootRef, err := blobserver.ReceiveString(ctx, storage, string(bad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Unmarshal(ctx, storage, badRootRef.Ref, &got); err == nil {
+		t.Error("got no error for a packed []uint32 of 3 bytes")
+	}
+}
+
+// tagSet is stored as a sorted slice of its tags,
+// and decodes that slice with the Decoder that invokes it.
+type tagSet struct {
+	tags map[string]bool
+	dec  *Decoder
+}
+
+func (s *tagSet) PkMarshal(ctx context.Context, dst blobserver.BlobReceiver) (blob.Ref, error) {
+	var tags []string
+	for tag := range s.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return Marshal(ctx, dst, tags)
+}
+
+func (s *tagSet) PkUnmarshal(ctx context.Context, src blob.Fetcher, ref blob.Ref) error {
+	return errors.New("PkUnmarshal called instead of PkUnmarshalWithDecoder")
+}
+
+func (s *tagSet) PkUnmarshalWithDecoder(ctx context.Context, d *Decoder, ref blob.Ref) error {
+	s.dec = d
+	var tags []string
+	if err := d.Decode(ctx, ref, &tags); err != nil {
+		return err
+	}
+	s.tags = make(map[string]bool)
+	for _, tag := range tags {
+		s.tags[tag] = true
+	}
+	return nil
+}
+
+func TestUnmarshalerWithDecoder(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type doc struct {
+		Title string
+		Tags  *tagSet
+	}
+	ref, err := Marshal(ctx, storage, doc{Title: "x", Tags: &tagSet{tags: map[string]bool{"a": true, "b": true, "c": true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(storage)
+	var got doc
+	if err = dec.Decode(ctx, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Tags.dec != dec {
+		t.Error("PkUnmarshalWithDecoder did not receive the calling Decoder")
+	}
+	if want := map[string]bool{"a": true, "b": true, "c": true}; !reflect.DeepEqual(got.Tags.tags, want) {
+		t.Errorf("got tags %v, want %v", got.Tags.tags, want)
+	}
+
+	// The nested decoding honors the Decoder's limits.
+	dec.SetMaxRefArrayLen(2)
+	err = dec.Decode(ctx, ref, &got)
+	if errors.Cause(err) != ErrTooManyRefs {
+		t.Errorf("got error %v, want %v", err, ErrTooManyRefs)
+	}
+}
+
+// chapter stores its paragraphs with the Encoder that invokes it.
+type chapter struct {
+	Paras []string
+}
+
+func (c *chapter) PkMarshal(ctx context.Context, dst blobserver.BlobReceiver) (blob.Ref, error) {
+	return blob.Ref{}, errors.New("PkMarshal called instead of PkMarshalWithEncoder")
+}
+
+func (c *chapter) PkMarshalWithEncoder(ctx context.Context, e *Encoder) (blob.Ref, error) {
+	return e.Encode(ctx, c.Paras)
+}
+
+func (c *chapter) PkUnmarshalWithDecoder(ctx context.Context, d *Decoder, ref blob.Ref) error {
+	return d.Decode(ctx, ref, &c.Paras)
+}
+
+func TestMarshalerWithEncoder(t *testing.T) {
+	ctx := context.Background()
+	storage := new(countingStorage)
+
+	enc := NewEncoder(storage)
+	enc.SetDedupCache(100)
+	enc.SetMarkRoots(true)
+
+	book := []chapter{
+		{Paras: []string{"It was", "a dark", "and stormy night."}},
+		{Paras: []string{"It was", "a dark", "and stormy night."}},
+	}
+	ref, err := enc.Encode(ctx, book)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Three paragraphs, one chapter, the book, and its root marker.
+	if storage.writes != 6 {
+		t.Errorf("got %d writes, want 6", storage.writes)
+	}
+	if stats := enc.CacheStats(); stats.Hits < 4 {
+		t.Errorf("got %d dedup cache hits, want at least 4", stats.Hits)
+	}
+
+	roots, err := ListRoots(ctx, &storage.Storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0] != ref {
+		t.Errorf("got roots %v, want [%s]", roots, ref)
+	}
+
+	var got []chapter
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, book) {
+		t.Errorf("got %v, want %v", got, book)
+	}
+}
+
+func TestBitset(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type flags struct {
+		B []bool `pk:",bitset"`
+	}
+	for _, n := range []int{0, 1, 7, 8, 9, 16, 1000} {
+		t.Run(fmt.Sprintf("len_%d", n), func(t *testing.T) {
+			var obj flags
+			for i := 0; i < n; i++ {
+				obj.B = append(obj.B, i%3 == 0 || i == n-1)
+			}
+			ref, err := Marshal(ctx, storage, obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fields map[string]blob.Ref
+			if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+				t.Fatal(err)
+			}
+			if n > 0 {
+				if got, want := len(mustFetch(t, storage, fields["B"])), 1+(n+7)/8; got != want {
+					t.Errorf("got %d-byte bitset, want %d", got, want)
+				}
+			}
+
+			var got flags
+			err = Unmarshal(ctx, storage, ref, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, obj) {
+				t.Errorf("got %v, want %v", got.B, obj.B)
+			}
+		})
+	}
+}
+
+func TestLegacyNameFallback(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type (
+		before struct {
+			FullName string
+			Age      int
+			Email    string
+		}
+		after struct {
+			FullName string `pk:"full_name"`
+			Age      int    `pk:"years"`
+			Email    string
+		}
+	)
+
+	ref, err := Marshal(ctx, storage, before{FullName: "Ada", Age: 36, Email: "ada@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got after
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (after{Email: "ada@example.com"}); got != want {
+		t.Errorf("without fallback, got %+v, want %+v", got, want)
+	}
+
+	dec := NewDecoder(storage)
+	dec.SetLegacyNameFallback(true)
+	got = after{}
+	err = dec.Decode(ctx, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (after{FullName: "Ada", Age: 36, Email: "ada@example.com"}); got != want {
+		t.Errorf("with fallback, got %+v, want %+v", got, want)
+	}
+
+	// The stored name takes precedence over the Go name.
+	ref, err = Marshal(ctx, storage, struct {
+		FullName string
+		Renamed  string `pk:"full_name"`
+	}{"old", "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = after{}
+	err = dec.Decode(ctx, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FullName != "new" {
+		t.Errorf("got FullName %q, want %q", got.FullName, "new")
+	}
+}
+
+func TestNetip(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type network struct {
+		Gateway netip.Addr
+		Zero    netip.Addr
+		Ptr     *netip.Addr
+		Subnets []netip.Prefix
+		Hosts   map[netip.Addr]string
+		ByName  map[string]netip.Addr
+	}
+	gw := netip.MustParseAddr("fe80::1%eth0")
+	obj := network{
+		Gateway: netip.MustParseAddr("192.0.2.1"),
+		Ptr:     &gw,
+		Subnets: []netip.Prefix{
+			netip.MustParsePrefix("192.0.2.0/24"),
+			netip.MustParsePrefix("2001:db8::/32"),
+			{},
+		},
+		Hosts: map[netip.Addr]string{
+			netip.MustParseAddr("10.0.0.1"):        "v4",
+			netip.MustParseAddr("::ffff:10.0.0.1"): "v4-mapped",
+			netip.MustParseAddr("2001:db8::1"):     "v6",
+			netip.MustParseAddr("fe80::2%wlan0"):   "zoned",
+			netip.MustParseAddr("fe80::2%wlan1"):   "other zone",
+		},
+		ByName: map[string]netip.Addr{"lo": netip.MustParseAddr("127.0.0.1"), "none": {}},
+	}
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+		t.Fatal(err)
+	}
+	var gwRef blob.Ref
+	if err := json.Unmarshal(fields["Gateway"], &gwRef); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(mustFetch(t, storage, gwRef)); got != "192.0.2.1" {
+		t.Errorf("got Gateway blob %q, want %q", got, "192.0.2.1")
+	}
+
+	var got network
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %s, want %s", spew.Sdump(got), spew.Sdump(obj))
+	}
+}
+
+func TestMarshalIndent(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type item struct {
+		Name string
+		Tags []string
+	}
+	type inventory struct {
+		Items  []item `pk:",external"`
+		ByName map[string]int
+		Any    interface{}
+		Note   string `pk:"note,inline"`
+	}
+	obj := inventory{
+		Items:  []item{{Name: "x", Tags: []string{"a", "b"}}},
+		ByName: map[string]int{"x": 1},
+		Any:    "dynamic",
+		Note:   "hi",
+	}
+	ref, err := MarshalIndent(ctx, storage, obj, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := string(mustFetch(t, storage, ref))
+	if !strings.HasPrefix(root, "{\n  \"") {
+		t.Errorf("root blob is not indented:\n%s", root)
+	}
+	if !strings.Contains(root, "\n  \"note\": \"hi\"") {
+		t.Errorf("root blob lacks indented inline field:\n%s", root)
+	}
+
+	var got inventory
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %s, want %s", spew.Sdump(got), spew.Sdump(obj))
+	}
+}
+
+func TestAnyFields(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type anyPoint struct{ X, Y int }
+	type anyColor int
+	Register(anyPoint{})
+	Register(&anyPoint{})
+	Register([]int(nil))
+	Register(anyColor(0))
+
+	type holder struct {
+		V any
+	}
+	cases := []any{
+		nil,
+		false,
+		true,
+		int(-1),
+		int8(-8),
+		int16(16),
+		int32(-32),
+		int64(1 << 40),
+		uint(1),
+		uint8(8),
+		uint16(16),
+		uint32(32),
+		uint64(1 << 63),
+		float32(1.5),
+		float64(-2.25),
+		"",
+		"hello",
+		anyColor(3),
+		anyPoint{X: 1, Y: 2},
+		&anyPoint{X: 3, Y: 4},
+		[]int{1, 2, 3},
+		[]interface{}{"a", 1, nil, anyPoint{}},
+		map[string]interface{}{"k": int64(7), "nested": map[string]interface{}{"p": anyPoint{X: 5}}},
+		blob.RefFromString("x"),
+	}
+	for _, v := range cases {
+		t.Run(fmt.Sprintf("%T(%v)", v, v), func(t *testing.T) {
+			ref, err := Marshal(ctx, storage, holder{V: v})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got holder
+			err = Unmarshal(ctx, storage, ref, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.V, v) {
+				t.Errorf("got %#v (%T), want %#v (%T)", got.V, got.V, v, v)
+			}
+		})
+	}
+
+	type unregisteredAny struct{ Z int }
+	_, err := Marshal(ctx, storage, holder{V: unregisteredAny{}})
+	if errors.Cause(err) != (ErrUnregisteredType{Name: "pk.unregisteredAny"}) {
+		t.Errorf("got error %v, want ErrUnregisteredType for pk.unregisteredAny", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "pk.Register") {
+		t.Errorf("error %v does not say how to register the type", err)
+	}
+
+	// Unmarshaling a type name that is not registered.
+	hint, err := json.Marshal(typeHint{Type: "no.such.Type", Ref: blob.RefFromString("")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hintRef, err := blobserver.ReceiveString(ctx, storage, string(hint))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got any
+	err = Unmarshal(ctx, storage, hintRef.Ref, &got)
+	if errors.Cause(err) != (ErrUnregisteredType{Name: "no.such.Type"}) {
+		t.Errorf("got error %v, want ErrUnregisteredType for no.such.Type", err)
+	}
+}
+
+func TestMaxOperations(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type cell struct {
+		Row, Col int
+	}
+	var grid [][]cell
+	for i := 0; i < 10; i++ {
+		var row []cell
+		for j := 0; j < 10; j++ {
+			row = append(row, cell{Row: i, Col: j})
+		}
+		grid = append(grid, row)
+	}
+	ref, err := Marshal(ctx, storage, grid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1 fetch for the outer slice,
+	// 10 for the rows,
+	// and 3 for each of the 100 cells.
+	const need = 1 + 10 + 3*100
+
+	dec := NewDecoder(storage)
+	dec.SetMaxOperations(need)
+	var got [][]cell
+	if err = dec.Decode(ctx, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, grid) {
+		t.Error("grids differ")
+	}
+
+	// Each call has its own budget.
+	if err = dec.Decode(ctx, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	dec.SetMaxOperations(need - 1)
+	err = dec.Decode(ctx, ref, &got)
+	if errors.Cause(err) != ErrOperationBudget {
+		t.Errorf("got error %v, want %v", err, ErrOperationBudget)
+	}
+
+	// The budget stops decoding even in Collect mode.
+	dec.SetErrorMode(Collect)
+	err = dec.Decode(ctx, ref, &got)
+	if errors.Cause(err) != ErrOperationBudget {
+		t.Errorf("in Collect mode, got error %v, want %v", err, ErrOperationBudget)
+	}
+}
+
+type (
+	namedTags   []string
+	namedCounts map[string]int
+	namedGrid   [2][2]int
+	namedPoints []point
+)
+
+func TestNamedContainerFields(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type doc struct {
+		Tags      namedTags
+		Counts    namedCounts
+		Grid      namedGrid
+		Points    namedPoints
+		ExtTags   namedTags   `pk:",external"`
+		ExtCounts namedCounts `pk:",external"`
+		PtrTags   *namedTags
+	}
+	tags := namedTags{"z"}
+	obj := doc{
+		Tags:      namedTags{"a", "b"},
+		Counts:    namedCounts{"a": 1, "b": 2},
+		Grid:      namedGrid{{1, 2}, {3, 4}},
+		Points:    namedPoints{{X: 1, Y: 2}},
+		ExtTags:   namedTags{"c"},
+		ExtCounts: namedCounts{"c": 3},
+		PtrTags:   &tags,
+	}
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got doc
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %s, want %s", spew.Sdump(got), spew.Sdump(obj))
+	}
+
+	// At top level too.
+	ref, err = Marshal(ctx, storage, obj.Counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counts namedCounts
+	err = Unmarshal(ctx, storage, ref, &counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, obj.Counts) {
+		t.Errorf("got %v, want %v", counts, obj.Counts)
+	}
+}
+
+func TestTolerateTruncation(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	words := []string{"alpha", "beta", "gamma", "delta"}
+	ref, err := Marshal(ctx, storage, words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := string(mustFetch(t, storage, ref))
+
+	// Cut the array partway through its third ref,
+	// and just after its second.
+	third := strings.Index(full, blob.RefFromString("gamma").String())
+	for _, cut := range []int{third + 10, third - 1, third} {
+		truncRef, err := blobserver.ReceiveString(ctx, storage, full[:cut])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		err = Unmarshal(ctx, storage, truncRef.Ref, &got)
+		if err == nil {
+			t.Fatalf("cut at %d: got no error by default", cut)
+		}
+
+		type doc struct {
+			Title string
+			Words *[]string
+		}
+		docRef, err := Marshal(ctx, storage, doc{Title: "t"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Point the Words field at the truncated array.
+		var fields map[string]blob.Ref
+		if err := json.Unmarshal(mustFetch(t, storage, docRef), &fields); err != nil {
+			t.Fatal(err)
+		}
+		fields["Words"] = truncRef.Ref
+		b, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docSref, err := blobserver.ReceiveString(ctx, storage, string(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dec := NewDecoder(storage)
+		dec.SetTolerateTruncation(true)
+		var gotDoc doc
+		err = dec.Decode(ctx, docSref.Ref, &gotDoc)
+		coll, ok := errors.Cause(err).(ErrCollected)
+		if !ok {
+			t.Fatalf("cut at %d: got error %v, want ErrCollected", cut, err)
+		}
+		if len(coll.Errs) != 1 || coll.Errs[0].Path != "Words" || errors.Cause(coll.Errs[0].Err) != ErrTruncated {
+			t.Errorf("cut at %d: got errors %v, want one ErrTruncated at Words", cut, coll.Errs)
+		}
+		if gotDoc.Title != "t" || gotDoc.Words == nil || !reflect.DeepEqual(*gotDoc.Words, words[:2]) {
+			t.Errorf("cut at %d: got %+v, want title t and words %v", cut, gotDoc, words[:2])
+		}
+	}
+
+	// An intact array decodes with no warnings.
+	dec := NewDecoder(storage)
+	dec.SetTolerateTruncation(true)
+	var got []string
+	if err = dec.Decode(ctx, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	// Malformed JSON is not mistaken for truncation.
+	badRef, err := blobserver.ReceiveString(ctx, storage, `["`+blob.RefFromString("alpha").String()+`", 17`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dec.Decode(ctx, badRef.Ref, &got); err == nil {
+		t.Error("got no error for malformed array")
+	} else if _, ok := errors.Cause(err).(ErrCollected); ok {
+		t.Errorf("got %v for malformed array, want a decoding error", err)
+	}
+}
+
+func TestMonthAndWeekday(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type schedule struct {
+		Month    time.Month
+		Day      time.Weekday
+		Off      []time.Weekday
+		Invalid  time.Month
+		Holidays map[time.Month]int
+	}
+	obj := schedule{
+		Month:    time.March,
+		Day:      time.Sunday,
+		Off:      []time.Weekday{time.Saturday, time.Sunday},
+		Invalid:  13,
+		Holidays: map[time.Month]int{time.December: 2},
+	}
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"Month": "March", "Day": "Sunday", "Invalid": "13"} {
+		var r blob.Ref
+		if err := json.Unmarshal(fields[name], &r); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(mustFetch(t, storage, r)); got != want {
+			t.Errorf("got %s blob %q, want %q", name, got, want)
+		}
+	}
+
+	var got schedule
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %+v, want %+v", got, obj)
+	}
+
+	// Numbers written before the names were used still decode.
+	numRef, err := blobserver.ReceiveString(ctx, storage, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m time.Month
+	if err = Unmarshal(ctx, storage, numRef.Ref, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m != time.July {
+		t.Errorf("got %v, want %v", m, time.July)
+	}
+}
+
+func TestCaseSensitiveFields(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type user struct {
+		ID   int
+		Name string `pk:"name"`
+	}
+	// Written by another tool, with differently cased keys.
+	ref, err := Marshal(ctx, storage, struct {
+		ID   int    `pk:"id"`
+		Name string `pk:"NAME"`
+	}{7, "ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got user
+	err = Unmarshal(ctx, storage, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (user{ID: 7, Name: "ada"}); got != want {
+		t.Errorf("by default, got %+v, want %+v", got, want)
+	}
+
+	dec := NewDecoder(storage)
+	dec.SetCaseSensitiveFields(true)
+	got = user{}
+	err = dec.Decode(ctx, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (user{}); got != want {
+		t.Errorf("case-sensitive, got %+v, want %+v", got, want)
+	}
+
+	// Exact matches work in both modes.
+	ref, err = Marshal(ctx, storage, user{ID: 8, Name: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = user{}
+	err = dec.Decode(ctx, ref, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (user{ID: 8, Name: "bob"}); got != want {
+		t.Errorf("case-sensitive exact, got %+v, want %+v", got, want)
+	}
+}
+
+func TestChunkAt(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type message struct {
+		Subject string
+		Body    string `pk:"body,chunkat=1k"`
+		Attach  []byte `pk:",chunkat=16"`
+	}
+
+	small := message{Subject: "hi", Body: "short", Attach: []byte("tiny")}
+	large := message{Subject: "hello", Body: strings.Repeat("long body ", 200), Attach: bytes.Repeat([]byte{1, 2, 3}, 10)}
+
+	for _, c := range []struct {
+		name    string
+		obj     message
+		chunked bool
+	}{
+		{"small", small, false},
+		{"large", large, true},
+		{"empty", message{}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ref, err := Marshal(ctx, storage, c.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"body", "Attach"} {
+				if chunked := fields[name][0] == '{'; chunked != c.chunked {
+					t.Errorf("field %s is %s, want chunked %v", name, fields[name], c.chunked)
+				}
+			}
+
+			var got message
+			err = Unmarshal(ctx, storage, ref, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Subject != c.obj.Subject || got.Body != c.obj.Body || !bytes.Equal(got.Attach, c.obj.Attach) {
+				t.Errorf("got %+v, want %+v", got, c.obj)
+			}
+		})
+	}
+
+	type badSize struct {
+		S string `pk:",chunkat=lots"`
+	}
+	if err := ValidateType(reflect.TypeOf(badSize{})); err == nil {
+		t.Error("got no error for invalid chunkat size")
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	type tagged struct {
+		A int
+		B int `pk:"-"`
+		C int `pk:"cee,inline,omitempty"`
+		D int `pk:",external,default=7,frob"`
+		E int `pk:",chunkat=2k"`
+	}
+
+	cases := []struct {
+		name string
+		opts Options
+	}{
+		{"A", Options{}},
+		{"B", Options{Omit: true}},
+		{"cee", Options{Inline: true, OmitEmpty: true}},
+		{"D", Options{External: true, HasDefault: true, Default: "7", Unknown: []string{"frob"}}},
+		{"E", Options{ChunkAt: 2048}},
+	}
+
+	typ := reflect.TypeOf(tagged{})
+	for i, c := range cases {
+		name, opts := ParseTag(typ.Field(i))
+		if name != c.name {
+			t.Errorf("field %d: got name %s, want %s", i, name, c.name)
+		}
+		if !reflect.DeepEqual(opts, c.opts) {
+			t.Errorf("field %d: got options %+v, want %+v", i, opts, c.opts)
+		}
+	}
+}
+
+// claimStorage records the attribute claims written to it,
+// standing in for a Perkeep server's index.
+type claimStorage struct {
+	memory.Storage
+	mu    sync.Mutex
+	attrs map[blob.Ref]url.Values
+}
+
+func (s *claimStorage) ReceiveBlob(ctx context.Context, ref blob.Ref, r io.Reader) (blob.SizedRef, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	var claim struct {
+		CamliType string `json:"camliType"`
+		ClaimType string `json:"claimType"`
+		PermaNode string `json:"permaNode"`
+		Attribute string `json:"attribute"`
+		Value     string `json:"value"`
+	}
+	if json.Unmarshal(b, &claim) == nil && claim.CamliType == "claim" {
+		pn, ok := blob.Parse(claim.PermaNode)
+		if !ok {
+			return blob.SizedRef{}, fmt.Errorf("invalid permanode %q", claim.PermaNode)
+		}
+		s.mu.Lock()
+		if s.attrs == nil {
+			s.attrs = make(map[blob.Ref]url.Values)
+		}
+		if s.attrs[pn] == nil {
+			s.attrs[pn] = make(url.Values)
+		}
+		switch claim.ClaimType {
+		case "set-attribute":
+			s.attrs[pn].Set(claim.Attribute, claim.Value)
+		case "add-attribute":
+			s.attrs[pn].Add(claim.Attribute, claim.Value)
+		case "del-attribute":
+			s.attrs[pn].Del(claim.Attribute)
+		}
+		s.mu.Unlock()
+	}
+	return s.Storage.ReceiveBlob(ctx, ref, bytes.NewReader(b))
+}
+
+func (s *claimStorage) permanodeAttrs(ctx context.Context, pn blob.Ref) (url.Values, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attrs[pn], nil
+}
+
+func TestPermanode(t *testing.T) {
+	ctx := context.Background()
+
+	ent, err := jsonsign.NewEntity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := jsonsign.ArmoredPublicKey(ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := schema.NewSigner(blob.RefFromString(armored), strings.NewReader(armored), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type contact struct {
+		Name    string
+		Age     int `pk:"age"`
+		Friend  bool
+		Born    time.Time
+		Tags    []string
+		Skipped string `pk:"-"`
+	}
+
+	storage := new(claimStorage)
+	enc := NewEncoder(storage)
+	enc.SetPermanodeSigner(signer)
+
+	in := contact{
+		Name:    "Alice",
+		Age:     31,
+		Friend:  true,
+		Born:    time.Date(1990, 5, 17, 12, 0, 0, 0, time.UTC),
+		Tags:    []string{"work", "chess"},
+		Skipped: "x",
+	}
+	pn, err := enc.Encode(ctx, &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPermanode(mustFetch(t, &storage.Storage, pn)) {
+		t.Fatalf("%s is not a permanode", pn)
+	}
+	attrs := storage.attrs[pn]
+	if got := attrs.Get("age"); got != "31" {
+		t.Errorf("got age attribute %q, want 31", got)
+	}
+	if _, ok := attrs["Skipped"]; ok {
+		t.Error("got attribute for omitted field")
+	}
+
+	dec := NewDecoder(&storage.Storage)
+	dec.SetPermanodeAttrs(storage.permanodeAttrs)
+
+	var got contact
+	if err := dec.Decode(ctx, pn, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := in
+	want.Skipped = ""
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Edit the object with new claims on the same permanode.
+	want.Age = 32
+	want.Tags = nil
+	if err := enc.EncodeToPermanode(ctx, pn, want); err != nil {
+		t.Fatal(err)
+	}
+	got = contact{}
+	if err := dec.Decode(ctx, pn, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after edit, got %+v, want %+v", got, want)
+	}
+
+	if _, err := enc.Encode(ctx, 7); err == nil {
+		t.Error("got no error storing a non-struct as a permanode")
+	}
+}
+
+func TestDecodePermanode(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type place struct {
+		Lat, Lon float64
+	}
+	type photo struct {
+		Title     string    `pk:"title"`
+		Tags      []string  `pk:"tag"`
+		Stars     int       `pk:"stars"`
+		Public    bool      `pk:"public"`
+		Taken     time.Time `pk:"taken"`
+		Where     *place    `pk:"where"`
+		Untouched string
+	}
+
+	where, err := Marshal(ctx, storage, place{Lat: 40.7, Lon: -74})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attributes as another Perkeep tool might have set them.
+	pn := blob.RefFromString("permanode")
+	attrs := url.Values{
+		"title":        {"Harbor", "ignored"},
+		"tag":          {"sea", "boats"},
+		"stars":        {"4"},
+		"public":       {"true"},
+		"taken":        {"2019-07-04T18:30:00Z"},
+		"where":        {where.String()},
+		"camliContent": {"sha224-0000"},
+	}
+	dec := NewDecoder(storage)
+
+	var got photo
+	if err := dec.DecodePermanode(ctx, pn, &got); err == nil {
+		t.Error("got no error without a source of attributes")
+	}
+
+	dec.SetPermanodeAttrs(func(ctx context.Context, ref blob.Ref) (url.Values, error) {
+		if ref != pn {
+			return nil, fmt.Errorf("unexpected permanode %s", ref)
+		}
+		return attrs, nil
+	})
+
+	got = photo{Untouched: "keep"}
+	if err := dec.DecodePermanode(ctx, pn, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := photo{
+		Title:     "Harbor",
+		Tags:      []string{"sea", "boats"},
+		Stars:     4,
+		Public:    true,
+		Taken:     time.Date(2019, 7, 4, 18, 30, 0, 0, time.UTC),
+		Where:     &place{Lat: 40.7, Lon: -74},
+		Untouched: "keep",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	attrs.Set("stars", "many")
+	if err := dec.DecodePermanode(ctx, pn, &got); err == nil {
+		t.Error("got no error for an invalid number")
+	}
+}
+
+func TestSignedRoot(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	ent, err := jsonsign.NewEntity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := jsonsign.ArmoredPublicKey(ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := blobserver.ReceiveNoHash(ctx, storage, blob.RefFromString(armored), strings.NewReader(armored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := schema.NewSigner(pubKey.Ref, strings.NewReader(armored), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type release struct {
+		Version string
+		Files   []string
+	}
+	want := release{Version: "1.2.3", Files: []string{"a.tgz", "b.tgz"}}
+
+	enc := NewEncoder(storage)
+	enc.SetSigner(signer, pubKey.Ref)
+	ref, err := enc.Encode(ctx, &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["camliSig"]; !ok {
+		t.Fatalf("root has no signature: %v", fields)
+	}
+
+	verifying := NewDecoder(storage)
+	verifying.SetVerifier(VerifySignature(storage))
+
+	for name, dec := range map[string]*Decoder{"plain": NewDecoder(storage), "verifying": verifying} {
+		var got release
+		if err := dec.Decode(ctx, ref, &got); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+
+	// Tamper with the signed root.
+	forged := strings.Replace(string(mustFetch(t, storage, ref)), `"Version"`, `"version"`, 1)
+	forgedRef, err := blobserver.ReceiveNoHash(ctx, storage, blob.RefFromString(forged), strings.NewReader(forged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got release
+	if err := verifying.Decode(ctx, forgedRef.Ref, &got); err == nil {
+		t.Error("got no error verifying a forged root")
+	}
+
+	// An unsigned root fails verification.
+	unsigned, err := Marshal(ctx, storage, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifying.Decode(ctx, unsigned, &got); err == nil {
+		t.Error("got no error verifying an unsigned root")
+	}
+}
+
+func TestKnownRefs(t *testing.T) {
+	type (
+		entry struct {
+			Key string
+			Val int
+		}
+		index struct {
+			Name    string
+			Entries []entry
+		}
+	)
+
+	ctx := context.Background()
+	storage := new(countingStorage)
+
+	obj := index{Name: "idx"}
+	for i := 0; i < 10; i++ {
+		obj.Entries = append(obj.Entries, entry{Key: fmt.Sprintf("k%d", i), Val: i})
+	}
+
+	// A prior run, recording a manifest.
+	_, manifest, err := NewEncoder(storage).EncodeWithManifest(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []blob.Ref
+	if err := json.Unmarshal(mustFetch(t, &storage.Storage, manifest), &refs); err != nil {
+		t.Fatal(err)
+	}
+	known := make(map[blob.Ref]bool)
+	for _, ref := range refs {
+		known[ref] = true
+	}
+
+	// A fresh encoder seeded with the manifest.
+	enc := NewEncoder(storage)
+	enc.SetKnownRefs(known)
+
+	storage.writes = 0
+	if _, err := enc.Encode(ctx, obj); err != nil {
+		t.Fatal(err)
+	}
+	if storage.writes != 0 {
+		t.Errorf("got %d writes re-encoding an unchanged tree, want 0", storage.writes)
+	}
+
+	obj.Entries[4].Val = 400
+	storage.writes = 0
+	root, err := enc.Encode(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New blobs: the new Val, the changed entry, and the root.
+	const wantWrites = 3
+	if storage.writes != wantWrites {
+		t.Errorf("got %d writes, want %d", storage.writes, wantWrites)
+	}
+
+	var got index
+	if err := Unmarshal(ctx, storage, root, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %+v, want %+v", got, obj)
+	}
+}
+
+func TestProtobufTagFallback(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	// In the style of protoc-generated code.
+	type account struct {
+		UserName string   `protobuf:"bytes,1,opt,name=user_name,json=userName,proto3" json:"user_name,omitempty"`
+		Id       int64    `protobuf:"varint,2,opt,name=id,proto3" json:"id,omitempty"`
+		Emails   []string `protobuf:"bytes,3,rep,name=emails,proto3" json:"emails,omitempty"`
+		Nick     string   `protobuf:"bytes,4,opt,name=nick,proto3" json:"nick,omitempty" pk:"nickname"`
+		Local    bool
+	}
+	want := account{UserName: "pat", Id: 17, Emails: []string{"pat@example.com"}, Nick: "P", Local: true}
+
+	for _, fallback := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fallback=%v", fallback), func(t *testing.T) {
+			enc := NewEncoder(storage)
+			enc.SetProtobufTagFallback(fallback)
+			ref, err := enc.Encode(ctx, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for k := range fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			wantKeys := []string{"Emails", "Id", "Local", "UserName", "nickname"}
+			if fallback {
+				wantKeys = []string{"Local", "emails", "id", "nickname", "user_name"}
+			}
+			if !reflect.DeepEqual(keys, wantKeys) {
+				t.Errorf("got keys %v, want %v", keys, wantKeys)
+			}
+
+			dec := NewDecoder(storage)
+			dec.SetProtobufTagFallback(fallback)
+			var got account
+			if err := dec.Decode(ctx, ref, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeLazy(t *testing.T) {
+	type (
+		track struct {
+			Title string
+			Secs  int
+		}
+		album struct {
+			Name   string
+			Year   int `pk:",inline"`
+			Tracks []track
+			Notes  map[string]string
+			Cover  *track
+		}
+	)
+
+	ctx := context.Background()
+	storage := new(countingFetcher)
+	obj := album{
+		Name:   "Blue",
+		Year:   1971,
+		Tracks: []track{{"All I Want", 214}, {"My Old Man", 215}, {"Little Green", 207}},
+		Notes:  map[string]string{"label": "Reprise"},
+	}
+	ref, err := Marshal(ctx, &storage.Storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(storage)
+	root, err := dec.DecodeLazy(ctx, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.fetches != 0 {
+		t.Errorf("got %d fetches before exploring, want 0", storage.fetches)
+	}
+
+	keys, err := root.Keys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Cover", "Name", "Notes", "Tracks", "Year"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+
+	tracks, err := root.Field(ctx, "Tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := tracks.Len(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(obj.Tracks) {
+		t.Errorf("got %d tracks, want %d", n, len(obj.Tracks))
+	}
+
+	storage.fetches = 0
+	second, err := tracks.Index(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := second.Path(); got != "Tracks[1]" {
+		t.Errorf("got path %q, want Tracks[1]", got)
+	}
+	var tr track
+	if err := second.Load(ctx, &tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr != obj.Tracks[1] {
+		t.Errorf("got %+v, want %+v", tr, obj.Tracks[1])
+	}
+	// The track struct and its two fields.
+	if storage.fetches != 3 {
+		t.Errorf("got %d fetches loading one track, want 3", storage.fetches)
+	}
+
+	var all []track
+	if err := tracks.Load(ctx, &all); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(all, obj.Tracks) {
+		t.Errorf("got %+v, want %+v", all, obj.Tracks)
+	}
+
+	year, err := root.Field(ctx, "Year")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var y int
+	if err := year.Load(ctx, &y); err != nil {
+		t.Fatal(err)
+	}
+	if y != obj.Year {
+		t.Errorf("got year %d, want %d", y, obj.Year)
+	}
+
+	notes, err := root.Field(ctx, "Notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]string
+	if err := notes.Load(ctx, &m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, obj.Notes) {
+		t.Errorf("got notes %v, want %v", m, obj.Notes)
+	}
+
+	if _, err := tracks.Keys(ctx); err == nil {
+		t.Error("got no error for the keys of an array")
+	}
+	if _, err := tracks.Index(ctx, 3); err == nil {
+		t.Error("got no error for an index out of range")
+	}
+}
+
+type money struct {
+	Amount   int64
+	Currency string
+}
+
+func TestMoney(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type ledgerEntry struct {
+		Memo  string
+		Price money `pk:",money"`
+		Plain money
+	}
+
+	cases := []struct {
+		m    money
+		want string
+	}{
+		{money{1234, "USD"}, "USD 12.34"},
+		{money{-1234, "EUR"}, "EUR -12.34"},
+		{money{5, "GBP"}, "GBP 0.05"},
+		{money{-5, "CHF"}, "CHF -0.05"},
+		{money{0, "USD"}, "USD 0.00"},
+		{money{100, "JPY"}, "JPY 1.00"},
+		{money{math.MinInt64, "XTS"}, "XTS -92233720368547758.08"},
+	}
+	for _, c := range cases {
+		t.Run(c.want, func(t *testing.T) {
+			obj := ledgerEntry{Memo: "x", Price: c.m, Plain: c.m}
+			ref, err := Marshal(ctx, storage, obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]blob.Ref
+			if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(mustFetch(t, storage, fields["Price"])); got != c.want {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+			var got ledgerEntry
+			if err := Unmarshal(ctx, storage, ref, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != obj {
+				t.Errorf("got %+v, want %+v", got, obj)
+			}
+		})
+	}
+
+	if _, err := Marshal(ctx, storage, ledgerEntry{Price: money{Amount: 1}}); err == nil {
+		t.Error("got no error for a missing currency")
+	}
+
+	for _, bad := range []string{"USD", "USD 12.3", "USD 12", "USD .34", "USD 1.2.34", "USD +1.00", " 1.00", "USD 99999999999999999999.00"} {
+		var m money
+		if err := parseMoney(bad, reflect.ValueOf(&m).Elem()); err == nil {
+			t.Errorf("got no error parsing %q", bad)
+		}
+	}
+}
+
+func TestRefOf(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type (
+		section struct {
+			Heading string
+			Text    string
+		}
+		doc struct {
+			IntroRef blob.Ref `pk:"intro_ref,refof=Intro"`
+			Intro    *section `pk:"intro"`
+			Tags     []string `pk:",external"`
+			TagsRef  blob.Ref `pk:",refof=Tags"`
+		}
+	)
+
+	obj := &doc{Intro: &section{Heading: "Hello", Text: "World"}, Tags: []string{"a", "b"}}
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]blob.Ref
+	if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if !fields["intro"].Valid() || fields["intro_ref"] != fields["intro"] {
+		t.Errorf("got intro %s and intro_ref %s, want equal valid refs", fields["intro"], fields["intro_ref"])
+	}
+	if obj.IntroRef != fields["intro"] || obj.TagsRef != fields["Tags"] {
+		t.Errorf("got IntroRef %s and TagsRef %s, want %s and %s", obj.IntroRef, obj.TagsRef, fields["intro"], fields["Tags"])
+	}
+
+	var intro section
+	if err := Unmarshal(ctx, storage, obj.IntroRef, &intro); err != nil {
+		t.Fatal(err)
+	}
+	if intro != *obj.Intro {
+		t.Errorf("got %+v via IntroRef, want %+v", intro, *obj.Intro)
+	}
+
+	var got doc
+	if err := Unmarshal(ctx, storage, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, obj) {
+		t.Errorf("got %+v, want %+v", got, *obj)
+	}
+
+	// A blob holding only the ref field still yields the target.
+	linkOnly := `{"intro_ref":"` + obj.IntroRef.String() + `"}`
+	sref, err := blobserver.ReceiveString(ctx, storage, linkOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = doc{}
+	if err := Unmarshal(ctx, storage, sref.Ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Intro == nil || *got.Intro != *obj.Intro {
+		t.Errorf("got intro %+v from the ref field alone, want %+v", got.Intro, *obj.Intro)
+	}
+
+	type badTarget struct {
+		Items    []string
+		ItemsRef blob.Ref `pk:",refof=Items"`
+	}
+	if _, err := Marshal(ctx, storage, badTarget{}); err == nil {
+		t.Error("got no error for a refof target stored as a list of refs")
+	}
+
+	type badType struct {
+		Name    string
+		NameRef string `pk:",refof=Name"`
+	}
+	if _, err := Marshal(ctx, storage, badType{}); err == nil {
+		t.Error("got no error for a refof field that is not a blob.Ref")
+	}
+}
+
+// intervalLimiter lets one waiter through per interval,
+// recording the tokens requested.
+type intervalLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+	tokens   []int
+}
+
+func (l *intervalLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.tokens = append(l.tokens, n)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	obj := []string{"alpha", "beta", "gamma", "delta"}
+
+	const interval = 20 * time.Millisecond
+
+	for _, perByte := range []bool{false, true} {
+		t.Run(fmt.Sprintf("perByte=%v", perByte), func(t *testing.T) {
+			storage := new(countingStorage)
+			lim := &intervalLimiter{interval: interval}
+			enc := NewEncoder(storage)
+			enc.SetConcurrency(4)
+			enc.SetRateLimiter(lim, perByte)
+
+			start := time.Now()
+			if _, err := enc.Encode(ctx, obj); err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+
+			if len(lim.tokens) != storage.writes {
+				t.Errorf("got %d waits for %d writes", len(lim.tokens), storage.writes)
+			}
+			if min := time.Duration(storage.writes-1) * interval; elapsed < min {
+				t.Errorf("encoding took %s, want at least %s", elapsed, min)
+			}
+			var total int
+			for _, n := range lim.tokens {
+				total += n
+			}
+			want := storage.writes
+			if perByte {
+				want = 0
+				ch := make(chan blob.SizedRef)
+				go storage.EnumerateBlobs(ctx, ch, "", -1)
+				for sref := range ch {
+					want += int(sref.Size)
+				}
+			}
+			if total != want {
+				t.Errorf("got %d tokens, want %d", total, want)
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		enc := NewEncoder(new(memory.Storage))
+		enc.SetRateLimiter(&intervalLimiter{interval: time.Hour}, false)
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := enc.Encode(ctx, obj); errors.Cause(err) != context.DeadlineExceeded {
+			t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+type (
+	versioned struct {
+		Version int
+		Name    string
+		Age     int
+	}
+	versionedV0 struct {
+		Version int
+		Name    string `pk:"nm"`
+		Age     int    `pk:"years"`
+	}
+	versionedV1 struct {
+		Version int
+		Name    string `pk:"full_name"`
+		Age     int    `pk:"years"`
+	}
+
+	versionedNode struct {
+		Version int
+		Name    string
+		Next    *versionedNode
+	}
+	versionedNodeV0 struct {
+		Version int
+		Name    string `pk:"nm"`
+		Next    *versionedNode
+	}
+	unversionedNode struct {
+		Name string `pk:"nm"`
+		Next *unversionedNode
+	}
+)
+
+func TestRegisterVersion(t *testing.T) {
+	ctx := context.Background()
+	st := new(memory.Storage)
+	enc := NewEncoder(st)
+
+	dec := NewDecoder(st)
+	dec.RegisterVersion(reflect.TypeOf(versioned{}), "Version", 0, versionedV0{})
+	dec.RegisterVersion(reflect.TypeOf(versioned{}), "Version", 1, versionedV1{})
+
+	cases := []struct {
+		name string
+		obj  interface{}
+		want versioned
+	}{
+		{"v0", versionedV0{Name: "Ada", Age: 36}, versioned{Version: 0, Name: "Ada", Age: 36}},
+		{"v0 unversioned", struct {
+			Name string `pk:"nm"`
+			Age  int    `pk:"years"`
+		}{Name: "Alan", Age: 41}, versioned{Name: "Alan", Age: 41}},
+		{"v1", versionedV1{Version: 1, Name: "Grace Hopper", Age: 85}, versioned{Version: 1, Name: "Grace Hopper", Age: 85}},
+		{"v2 unregistered", versioned{Version: 2, Name: "Edsger", Age: 72}, versioned{Version: 2, Name: "Edsger", Age: 72}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ref, err := enc.Encode(ctx, c.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got versioned
+			if err := dec.Decode(ctx, ref, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+
+	t.Run("nested", func(t *testing.T) {
+		obj := []versionedV1{{Version: 1, Name: "Barbara Liskov", Age: 86}}
+		ref, err := enc.Encode(ctx, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []versioned
+		if err := dec.Decode(ctx, ref, &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0] != (versioned{Version: 1, Name: "Barbara Liskov", Age: 86}) {
+			t.Errorf("got %+v", got)
+		}
+	})
+
+	t.Run("linked list", func(t *testing.T) {
+		obj := &unversionedNode{Name: "a", Next: &unversionedNode{Name: "b", Next: &unversionedNode{Name: "c"}}}
+		ref, err := enc.Encode(ctx, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := NewDecoder(st)
+		dec.RegisterVersion(reflect.TypeOf(versionedNode{}), "Version", 0, versionedNodeV0{})
+		var got *versionedNode
+		if err := dec.Decode(ctx, ref, &got); err != nil {
+			t.Fatal(err)
+		}
+		want := &versionedNode{Name: "a", Next: &versionedNode{Name: "b", Next: &versionedNode{Name: "c"}}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+}
+
+func TestScalarKindsInInterface(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	cases := []interface{}{
+		false, true,
+		int(0), int8(-8), int16(16), int32(-32), int64(64),
+		uint(0), uint8(8), uint16(16), uint32(32), uint64(64),
+		float32(0), float32(1.5), float64(0), float64(-2.25),
+		"", "7",
+	}
+	for _, want := range cases {
+		t.Run(fmt.Sprintf("%T(%v)", want, want), func(t *testing.T) {
+			ref, err := Marshal(ctx, storage, &want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got interface{}
+			if err := Unmarshal(ctx, storage, ref, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("got %T(%#v), want %T(%#v)", got, got, want, want)
+			}
+		})
+	}
+}
+
+func TestBytesSchema(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type payload struct {
+		Data []byte `pk:"data,chunkat=64k"`
+	}
+
+	data := make([]byte, 3<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	for _, bytesSchema := range []bool{false, true} {
+		t.Run(fmt.Sprintf("bytesSchema=%v", bytesSchema), func(t *testing.T) {
+			enc := NewEncoder(storage)
+			enc.SetBytesSchema(bytesSchema)
+			ref, err := enc.Encode(ctx, payload{Data: data})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+				t.Fatal(err)
+			}
+			var cf map[string]blob.Ref
+			if err := json.Unmarshal(fields["data"], &cf); err != nil {
+				t.Fatal(err)
+			}
+			key, camliType := "file", "file"
+			if bytesSchema {
+				key, camliType = "bytes", "bytes"
+			}
+			if len(cf) != 1 || !cf[key].Valid() {
+				t.Fatalf("got field JSON %s, want a %q ref", fields["data"], key)
+			}
+			var schemaBlob struct {
+				CamliType string `json:"camliType"`
+			}
+			if err := json.Unmarshal(mustFetch(t, storage, cf[key]), &schemaBlob); err != nil {
+				t.Fatal(err)
+			}
+			if schemaBlob.CamliType != camliType {
+				t.Errorf("got camliType %q, want %q", schemaBlob.CamliType, camliType)
+			}
+
+			var got payload
+			if err := NewDecoder(storage).Decode(ctx, ref, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Data, data) {
+				t.Errorf("got %d bytes back, want the original %d", len(got.Data), len(data))
+			}
+		})
+	}
+}
+
+func TestRefPassthrough(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type address struct {
+		Street string
+		City   string
+	}
+	type person struct {
+		Name    string
+		Address address
+		Tags    map[string]int
+	}
+	type partial struct {
+		Name    string
+		Address blob.Ref
+		Tags    map[string]blob.Ref
+	}
+
+	obj := person{Name: "Ada", Address: address{Street: "1 Main St", City: "London"}, Tags: map[string]int{"x": 1}}
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(storage)
+	var got partial
+	if err := dec.Decode(ctx, ref, &got); err == nil {
+		t.Fatal("got no error decoding an object into blob.Ref without passthrough")
+	}
+
+	dec.SetRefPassthrough(true)
+	got = partial{}
+	if err := dec.Decode(ctx, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != obj.Name {
+		t.Errorf("got name %q, want %q", got.Name, obj.Name)
+	}
+
+	var addr address
+	if err := dec.Decode(ctx, got.Address, &addr); err != nil {
+		t.Fatal(err)
+	}
+	if addr != obj.Address {
+		t.Errorf("got address %+v, want %+v", addr, obj.Address)
+	}
+	var x int
+	if err := dec.Decode(ctx, got.Tags["x"], &x); err != nil {
+		t.Fatal(err)
+	}
+	if x != obj.Tags["x"] {
+		t.Errorf("got tag x=%d, want %d", x, obj.Tags["x"])
+	}
+
+	// A real blob.Ref field still decodes to the ref it holds.
+	inner := blob.RefFromString("inner")
+	ref, err = Marshal(ctx, storage, partial{Name: "Bob", Address: inner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = partial{}
+	if err := dec.Decode(ctx, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Address != inner || len(got.Tags) != 0 {
+		t.Errorf("got %+v, want Address %s and no Tags", got, inner)
+	}
+}
+
+func TestMapOfSlices(t *testing.T) {
+	ctx := context.Background()
+
+	type holder struct {
+		Ints  map[string][]int
+		Bytes map[string][]byte
+	}
+
+	obj := holder{
+		Ints:  map[string][]int{"primes": {2, 3, 5, 7}, "empty": {}, "nil": nil},
+		Bytes: map[string][]byte{"hello": []byte("hello"), "zeros": make([]byte, 300)},
+	}
+
+	storage := new(memory.Storage)
+	ref, err := Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each map value is a ref-array blob,
+	// and equal elements share a blob,
+	// so there are at most 256 blobs for all the bytes.
+	var fields struct {
+		Ints  map[string]blob.Ref
+		Bytes map[string]blob.Ref
+	}
+	if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+		t.Fatal(err)
+	}
+	var zeros []blob.Ref
+	if err := json.Unmarshal(mustFetch(t, storage, fields.Bytes["zeros"]), &zeros); err != nil {
+		t.Fatal(err)
+	}
+	if len(zeros) != 300 {
+		t.Errorf("got %d refs for the zeros, want 300", len(zeros))
+	}
+	for _, r := range zeros {
+		if r != zeros[0] {
+			t.Fatalf("zero bytes are stored in different blobs %s and %s", zeros[0], r)
+		}
+	}
+
+	var got holder
+	if err := Unmarshal(ctx, storage, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %+v, want %+v", got, obj)
+	}
+
+	// The same shapes at the root.
+	ref, err = Marshal(ctx, storage, obj.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotBytes map[string][]byte
+	if err := Unmarshal(ctx, storage, ref, &gotBytes); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotBytes, obj.Bytes) {
+		t.Errorf("got %v, want %v", gotBytes, obj.Bytes)
+	}
+}
+
+func TestEncodeIsSynchronous(t *testing.T) {
+	ctx := context.Background()
+
+	obj := map[string][]string{
+		"a": {"one", "two", "three"},
+		"b": {"four", "five"},
+		"c": nil,
+	}
+
+	storage := new(memory.Storage)
+	enc := NewEncoder(storage)
+	enc.SetConcurrency(8)
+	enc.SetRateLimiter(&intervalLimiter{interval: time.Millisecond}, false)
+	ref, err := enc.Encode(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every blob of the tree is present as soon as Encode returns.
+	var got map[string][]string
+	if err := Unmarshal(ctx, storage, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %v, want %v", got, obj)
+	}
+}
+
+func TestJSONTagFallback(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type item struct {
+		Name  string            `json:"name"`
+		Price int               `json:"price,omitempty"`
+		Notes []string          `json:"notes,omitempty"`
+		Attrs map[string]string `json:",omitempty"`
+		Count int               `json:"count,string"`
+		SKU   string            `json:"sku,omitempty" pk:"code"`
+		Skip  string            `json:"-"`
+		Plain bool
+	}
+
+	cases := []struct {
+		obj      item
+		fallback bool
+		wantKeys []string
+		want     *item // if different from obj
+	}{
+		{
+			obj:      item{Name: "widget", Price: 3, Notes: []string{"new"}, Attrs: map[string]string{"color": "red"}, Count: 2, SKU: "W1", Skip: "s", Plain: true},
+			fallback: false,
+			wantKeys: []string{"Attrs", "Count", "Name", "Notes", "Plain", "Price", "Skip", "code"},
+		},
+		{
+			obj:      item{Name: "widget", Price: 3, Notes: []string{"new"}, Attrs: map[string]string{"color": "red"}, Count: 2, SKU: "W1", Skip: "s", Plain: true},
+			fallback: true,
+			wantKeys: []string{"Attrs", "Plain", "Skip", "code", "count", "name", "notes", "price"},
+		},
+		{
+			obj:      item{Name: "gadget"},
+			fallback: true,
+			wantKeys: []string{"Plain", "Skip", "code", "count", "name"},
+			// An absent map field decodes as empty, as with pk's omitempty.
+			want: &item{Name: "gadget", Attrs: map[string]string{}},
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("case_%d", i), func(t *testing.T) {
+			enc := NewEncoder(storage)
+			enc.SetJSONTagFallback(c.fallback)
+			ref, err := enc.Encode(ctx, c.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for k := range fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, c.wantKeys) {
+				t.Errorf("got keys %v, want %v", keys, c.wantKeys)
+			}
+
+			dec := NewDecoder(storage)
+			dec.SetJSONTagFallback(c.fallback)
+			var got item
+			if err := dec.Decode(ctx, ref, &got); err != nil {
+				t.Fatal(err)
+			}
+			want := c.obj
+			if c.want != nil {
+				want = *c.want
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+type resolvedPoint struct {
+	X, Y int
+}
+
+func TestTypeResolver(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	// A type hint naming a type that no program has registered,
+	// as written by an encoder in another process.
+	pref, err := Marshal(ctx, storage, resolvedPoint{X: 3, Y: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hint, err := json.Marshal(typeHint{Type: "plugin.Point", Ref: pref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := blobserver.ReceiveString(ctx, storage, string(hint))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got interface{}
+	err = NewDecoder(storage).Decode(ctx, ref.Ref, &got)
+	if _, ok := errors.Cause(err).(ErrUnregisteredType); !ok {
+		t.Fatalf("got error %v, want ErrUnregisteredType", err)
+	}
+
+	var asked []string
+	dec := NewDecoder(storage)
+	dec.SetTypeResolver(func(name string) (reflect.Type, error) {
+		asked = append(asked, name)
+		switch name {
+		case "plugin.Point":
+			return reflect.TypeOf(resolvedPoint{}), nil
+		case "plugin.Broken":
+			return nil, errors.New("schema service unavailable")
+		}
+		return nil, nil
+	})
+	if err := dec.Decode(ctx, ref.Ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != (resolvedPoint{X: 3, Y: 4}) {
+		t.Errorf("got %#v, want resolvedPoint{3, 4}", got)
+	}
+
+	// Registered names do not reach the resolver.
+	ref2, err := Marshal(ctx, storage, []interface{}{"x", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got2 []interface{}
+	if err := dec.Decode(ctx, ref2, &got2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(asked, []string{"plugin.Point"}) {
+		t.Errorf("resolver was asked for %v, want only plugin.Point", asked)
+	}
+
+	for _, name := range []string{"plugin.Broken", "plugin.Unknown"} {
+		hint, err := json.Marshal(typeHint{Type: name, Ref: pref})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := blobserver.ReceiveString(ctx, storage, string(hint))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dec.Decode(ctx, ref.Ref, &got)
+		if err == nil {
+			t.Errorf("got no error decoding %s", name)
+		}
+		_, unregistered := errors.Cause(err).(ErrUnregisteredType)
+		if unregistered != (name == "plugin.Unknown") {
+			t.Errorf("decoding %s: got error %v", name, err)
+		}
+	}
+}
+
+func TestSelfRef(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	type record struct {
+		ID    blob.Ref `pk:"id,self"`
+		Title string
+		Tags  []string
+	}
+
+	rec := record{Title: "hello", Tags: []string{"a", "b"}}
+	ref, err := Marshal(ctx, storage, &rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != ref {
+		t.Errorf("got ID %s, want the root ref %s", rec.ID, ref)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(mustFetch(t, storage, ref), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["id"]; ok {
+		t.Errorf("self field is stored: %v", fields)
+	}
+
+	// Recomputing, with the ID already set (or set to anything else), gives the same ref.
+	for _, id := range []blob.Ref{rec.ID, {}, blob.RefFromString("other")} {
+		again := rec
+		again.ID = id
+		enc := NewEncoder(nil)
+		enc.SetDryRun(true)
+		ref2, err := enc.Encode(ctx, again)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref2 != ref {
+			t.Errorf("with ID %s, recomputed ref %s, want %s", id, ref2, ref)
+		}
+	}
+
+	var got record
+	if err := Unmarshal(ctx, storage, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rec) {
+		t.Errorf("got %+v, want %+v", got, rec)
+	}
+
+	// Elements of a slice each get their own ID.
+	recs := []record{{Title: "x"}, {Title: "y"}}
+	if _, err := Marshal(ctx, storage, recs); err != nil {
+		t.Fatal(err)
+	}
+	var gotRecs []record
+	for i, r := range recs {
+		if !r.ID.Valid() {
+			t.Fatalf("element %d has no ID", i)
+		}
+		var el record
+		if err := Unmarshal(ctx, storage, r.ID, &el); err != nil {
+			t.Fatal(err)
+		}
+		gotRecs = append(gotRecs, el)
+	}
+	if !reflect.DeepEqual(gotRecs, recs) {
+		t.Errorf("got %+v, want %+v", gotRecs, recs)
+	}
+
+	// So does each node of a linked list.
+	type node struct {
+		ID   blob.Ref `pk:",self"`
+		V    int
+		Next *node
+	}
+	list := &node{V: 1, Next: &node{V: 2, Next: &node{V: 3}}}
+	ref, err = Marshal(ctx, storage, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.ID != ref {
+		t.Errorf("got head ID %s, want %s", list.ID, ref)
+	}
+	var gotList *node
+	if err := Unmarshal(ctx, storage, ref, &gotList); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotList, list) {
+		t.Errorf("got %+v, want %+v", gotList, list)
+	}
+	for n := gotList; n != nil; n = n.Next {
+		if !n.ID.Valid() {
+			t.Errorf("node %d has no ID", n.V)
+		}
+	}
+
+	type badSelf struct {
+		ID string `pk:",self"`
+	}
+	if _, err := Marshal(ctx, storage, badSelf{}); err == nil {
+		t.Error("got no error for a self field that is not a blob.Ref")
+	}
+}
+
+func TestInlineSmallScalars(t *testing.T) {
+	ctx := context.Background()
+
+	ints := make([]int, 100)
+	for i := range ints {
+		ints[i] = i * i
+	}
+	type record struct {
+		Plain    []int
+		External []int `pk:",external"`
+	}
+
+	cases := []struct {
+		name       string
+		obj        interface{}
+		wantBlobs  int // with inlining
+		decodeInto interface{}
+	}{
+		{"ints", ints, 1, new([]int)},
+		{"bools", [3]bool{true, false, true}, 1, new([3]bool)},
+		{"strings", []string{"a", "", "ccc"}, 1, new([]string)},
+		{"long string", []string{"a", strings.Repeat("x", 100)}, 3, new([]string)},
+		{"floats", []float32{0.5, -2, 1e3}, 1, new([]float32)},
+		{"interfaces", []interface{}{1, 2}, 5, new([]interface{})},
+		// A struct's own list of refs is unaffected.
+		{"struct", record{Plain: []int{1, 2}, External: []int{3, 4}}, 4, new(record)},
+		{"empty", []int{}, 1, new([]int)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			storage := new(countingStorage)
+			enc := NewEncoder(storage)
+			enc.SetInlineSmallScalars(8)
+			ref, err := enc.Encode(ctx, c.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if storage.writes != c.wantBlobs {
+				t.Errorf("got %d blobs, want %d", storage.writes, c.wantBlobs)
+			}
+			if err := NewDecoder(storage).Decode(ctx, ref, c.decodeInto); err != nil {
+				t.Fatal(err)
+			}
+			if got := reflect.ValueOf(c.decodeInto).Elem().Interface(); !reflect.DeepEqual(got, c.obj) {
+				t.Errorf("got %#v, want %#v", got, c.obj)
+			}
+		})
+	}
+
+	t.Run("strict array length", func(t *testing.T) {
+		storage := new(memory.Storage)
+		enc := NewEncoder(storage)
+		enc.SetInlineSmallScalars(8)
+		ref, err := enc.Encode(ctx, []int{1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var short [2]int
+		if err := NewDecoder(storage).Decode(ctx, ref, &short); err != nil {
+			t.Fatal(err)
+		}
+		if short != [2]int{1, 2} {
+			t.Errorf("got %v, want [1 2]", short)
+		}
+		dec := NewDecoder(storage)
+		dec.SetStrictArrayLengths(true)
+		if err := dec.Decode(ctx, ref, &short); errors.Cause(err) != ErrArrayLength {
+			t.Errorf("got error %v, want ErrArrayLength", err)
+		}
+	})
+
+	t.Run("RawField", func(t *testing.T) {
+		storage := new(memory.Storage)
+		enc := NewEncoder(storage)
+		enc.SetInlineSmallScalars(8)
+		ref, err := enc.Encode(ctx, record{Plain: []int{1, 2}, External: []int{3, 4, 5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := NewDecoder(storage)
+		b, elRef, err := dec.RawField(ctx, ref, "External[2]")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "5" || elRef.Valid() {
+			t.Errorf("got %q, %s; want \"5\" and no ref", b, elRef)
+		}
+		for _, bad := range []string{"External[3]", "External[x]", "External.x", "External[1].x"} {
+			if _, _, err := dec.RawField(ctx, ref, bad); err == nil {
+				t.Errorf("%s: got no error", bad)
+			}
+		}
+	})
+
+	t.Run("DecodeLazy", func(t *testing.T) {
+		storage := new(memory.Storage)
+		enc := NewEncoder(storage)
+		enc.SetInlineSmallScalars(8)
+		ref, err := enc.Encode(ctx, record{Plain: []int{1, 2}, External: []int{3, 4, 5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := NewDecoder(storage).DecodeLazy(ctx, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ext, err := root.Field(ctx, "External")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ext.Keys(ctx); err == nil {
+			t.Error("got keys for inline scalar values")
+		}
+		n, err := ext.Len(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Errorf("got length %d, want 3", n)
+		}
+		el, err := ext.Index(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if el.Ref().Valid() || el.Path() != "External[1]" {
+			t.Errorf("got ref %s, path %s; want no ref, path External[1]", el.Ref(), el.Path())
+		}
+		var got int
+		if err := el.Load(ctx, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != 4 {
+			t.Errorf("got %d, want 4", got)
+		}
+		if _, err := el.Len(ctx); err == nil {
+			t.Error("got length of a scalar element")
+		}
+	})
+}
+
+func BenchmarkInlineSmallScalars(b *testing.B) {
+	ctx := context.Background()
+
+	obj := make([]int, 1000)
+	for i := range obj {
+		obj[i] = i
+	}
+
+	for _, n := range []int{0, 8} {
+		b.Run(fmt.Sprintf("threshold=%d", n), func(b *testing.B) {
+			var blobs int
+			for i := 0; i < b.N; i++ {
+				blobs = 0
+				enc := NewEncoder(new(memory.Storage))
+				enc.SetInlineSmallScalars(n)
+				enc.SetProgress(func(blob.SizedRef) { blobs++ })
+				if _, err := enc.Encode(ctx, obj); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(blobs), "blobs/tree")
+		})
+	}
+}
+
+// tamperingFetcher serves altered content for the blobs in bad.
+type tamperingFetcher struct {
+	memory.Storage
+	bad map[blob.Ref]string
+}
+
+func (f *tamperingFetcher) Fetch(ctx context.Context, ref blob.Ref) (io.ReadCloser, uint32, error) {
+	if s, ok := f.bad[ref]; ok {
+		return ioutil.NopCloser(strings.NewReader(s)), uint32(len(s)), nil
+	}
+	return f.Storage.Fetch(ctx, ref)
+}
+
+func TestVerifyRefs(t *testing.T) {
+	ctx := context.Background()
+	storage := &tamperingFetcher{bad: make(map[blob.Ref]string)}
+
+	type account struct {
+		Owner   string
+		Balance int
+	}
+	ref, err := Marshal(ctx, storage, account{Owner: "pat", Balance: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, verify := range []bool{false, true} {
+		dec := NewDecoder(storage)
+		dec.SetVerifyRefs(verify)
+		var got account
+		if err := dec.Decode(ctx, ref, &got); err != nil {
+			t.Fatalf("verify=%v: %s", verify, err)
+		}
+	}
+
+	// Tamper with the balance.
+	var fields map[string]blob.Ref
+	if err := json.Unmarshal(mustFetch(t, &storage.Storage, ref), &fields); err != nil {
+		t.Fatal(err)
+	}
+	storage.bad[fields["Balance"]] = "1000000"
+
+	dec := NewDecoder(storage)
+	var got account
+	if err := dec.Decode(ctx, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 1000000 {
+		t.Fatalf("got balance %d from the tampering fetcher, want 1000000", got.Balance)
+	}
+
+	dec.SetVerifyRefs(true)
+	got = account{}
+	if err := dec.Decode(ctx, ref, &got); errors.Cause(err) != ErrRefMismatch {
+		t.Errorf("got error %v, want ErrRefMismatch", err)
+	}
+
+	// Unmarshalers fetch through a verifying source too.
+	u := new(unmarshalBlob)
+	if err := dec.Decode(ctx, fields["Balance"], u); errors.Cause(err) != ErrRefMismatch {
+		t.Errorf("got error %v from an Unmarshaler, want ErrRefMismatch", err)
+	}
+}
+
+// unmarshalBlob is an Unmarshaler that reads its blob's content.
+type unmarshalBlob struct {
+	s string
+}
+
+func (u *unmarshalBlob) PkUnmarshal(ctx context.Context, src blob.Fetcher, ref blob.Ref) error {
+	r, _, err := src.Fetch(ctx, ref)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	u.s = string(b)
+	return err
+}
+
+func TestEncodeSeq(t *testing.T) {
+	ctx := context.Background()
+	storage := new(memory.Storage)
+	enc := NewEncoder(storage)
+
+	// Written as an iter.Seq[int] would be.
+	countTo := func(n int) func(yield func(int) bool) {
+		return func(yield func(int) bool) {
+			for i := 1; i <= n; i++ {
+				if !yield(i) {
+					return
+				}
+			}
+		}
+	}
+
+	ref, err := EncodeSeq(ctx, enc, countTo(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	if err := Unmarshal(ctx, storage, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	ref, err = EncodeSeq(ctx, enc, countTo(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	if err := Unmarshal(ctx, storage, ref, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || len(got) != 0 {
+		t.Errorf("got %#v, want an empty slice", got)
+	}
+
+	// Cancellation stops the iteration.
+	cctx, cancel := context.WithCancel(ctx)
+	var yielded int
+	_, err = EncodeSeq(cctx, enc, func(yield func(int) bool) {
+		for i := 0; ; i++ {
+			if i == 3 {
+				cancel()
+			}
+			if !yield(i) {
+				return
+			}
+			yielded++
+		}
+	})
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if yielded != 3 {
+		t.Errorf("got %d values accepted before cancellation, want 3", yielded)
+	}
+}
@@ -0,0 +1,102 @@
+// Package pktest contains helpers for testing types that are marshaled with pk.
+package pktest
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"perkeep.org/pkg/blobserver/memory"
+
+	"github.com/bobg/pk"
+)
+
+// AssertRoundTrip marshals obj into a fresh in-memory Perkeep store,
+// unmarshals the result into a new value of the same type,
+// and reports a test error if that is not reflect.DeepEqual to obj,
+// with a line-by-line diff of the two values.
+// Failure to marshal or unmarshal is also reported as a test error.
+//
+// This is a quick way to check that a type is pk-safe:
+// that nothing about it is lost or altered in Perkeep.
+// Note that, as with reflect.DeepEqual,
+// a nil slice or map and an empty one are considered different.
+func AssertRoundTrip(t testing.TB, obj interface{}) {
+	t.Helper()
+
+	ctx := context.Background()
+	storage := new(memory.Storage)
+
+	ref, err := pk.Marshal(ctx, storage, obj)
+	if err != nil {
+		t.Errorf("marshaling %T: %s", obj, err)
+		return
+	}
+
+	got := reflect.New(reflect.TypeOf(obj))
+	err = pk.Unmarshal(ctx, storage, ref, got.Interface())
+	if err != nil {
+		t.Errorf("unmarshaling %T: %s", obj, err)
+		return
+	}
+
+	if !reflect.DeepEqual(got.Elem().Interface(), obj) {
+		t.Errorf("%T does not round-trip (- want, + got):\n%s", obj, diff(dump(obj), dump(got.Elem().Interface())))
+	}
+}
+
+var spewConfig = spew.ConfigState{
+	Indent:                  "  ",
+	DisablePointerAddresses: true,
+	DisableCapacities:       true,
+	SortKeys:                true,
+}
+
+func dump(obj interface{}) []string {
+	return strings.Split(strings.TrimRight(spewConfig.Sdump(obj), "\n"), "\n")
+}
+
+// Produces a line diff of a and b,
+// from a longest-common-subsequence alignment,
+// with removed lines prefixed by "-", added ones by "+",
+// and common ones by " ".
+func diff(a, b []string) string {
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var (
+		buf  strings.Builder
+		i, j int
+	)
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			buf.WriteString(" " + a[i] + "\n")
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			buf.WriteString("-" + a[i] + "\n")
+			i++
+		default:
+			buf.WriteString("+" + b[j] + "\n")
+			j++
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,59 @@
+package pktest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// recorder is a testing.TB that records errors instead of failing.
+type recorder struct {
+	testing.TB
+	errs []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+type inner struct {
+	A int
+	B []string
+}
+
+type outer struct {
+	Name  string
+	In    *inner
+	Extra map[string]int
+}
+
+// lossy loses its unexported field in the round trip.
+type lossy struct {
+	Public  string
+	private string
+}
+
+func TestAssertRoundTrip(t *testing.T) {
+	AssertRoundTrip(t, outer{Name: "x", In: &inner{A: 1, B: []string{"a", "b"}}, Extra: map[string]int{"k": 7}})
+	AssertRoundTrip(t, []int{1, 2, 3})
+	AssertRoundTrip(t, "hello")
+
+	r := &recorder{TB: t}
+	AssertRoundTrip(r, lossy{Public: "pub", private: "priv"})
+	if len(r.errs) != 1 {
+		t.Fatalf("got %d errors, want 1", len(r.errs))
+	}
+	if !strings.Contains(r.errs[0], `-  private: (string) (len=4) "priv"`) {
+		t.Errorf("diff missing expected line:\n%s", r.errs[0])
+	}
+}
+
+func TestDiff(t *testing.T) {
+	got := diff([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"})
+	want := " a\n-b\n+x\n c\n+d\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,50 @@
+package pk
+
+import (
+	"reflect"
+	"strings"
+)
+
+// SetProtobufTagFallback tells whether a struct field
+// that has no pk tag but does have a protobuf tag,
+// as in the structs generated by protoc,
+// should be stored under the field name from the protobuf tag
+// (its name= part)
+// instead of under its Go name.
+// A pk tag, when present, always wins.
+// Blobs written this way must be read with a Decoder
+// that has the same setting (see Decoder.SetProtobufTagFallback).
+// By default protobuf tags are ignored.
+func (e *Encoder) SetProtobufTagFallback(val bool) {
+	e.protoNames = val
+}
+
+// SetProtobufTagFallback tells whether a struct field
+// that has no pk tag but does have a protobuf tag
+// should be read from the key named in the protobuf tag,
+// as written by an Encoder with the same setting
+// (see Encoder.SetProtobufTagFallback).
+// By default protobuf tags are ignored.
+func (d *Decoder) SetProtobufTagFallback(val bool) {
+	d.protoNames = val
+}
+
+// Returns the name in the protobuf tag of tf,
+// if tf has a protobuf tag naming it and no pk tag.
+// A protobuf tag looks like `protobuf:"bytes,1,opt,name=user_name,json=userName,proto3"`.
+func protoName(tf reflect.StructField) (string, bool) {
+	if _, ok := tf.Tag.Lookup("pk"); ok {
+		return "", false
+	}
+	tag, ok := tf.Tag.Lookup("protobuf")
+	if !ok {
+		return "", false
+	}
+	for _, item := range strings.Split(tag, ",") {
+		if strings.HasPrefix(item, "name=") {
+			name := strings.TrimPrefix(item, "name=")
+			return name, name != ""
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,51 @@
+package pk
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// RateLimiter is the interface for throttling the uploads of an Encoder
+// (see Encoder.SetRateLimiter).
+// A *rate.Limiter from golang.org/x/time/rate satisfies it.
+type RateLimiter interface {
+	// WaitN blocks until n tokens are available,
+	// or returns an error if that is impossible
+	// or ctx is canceled first.
+	WaitN(ctx context.Context, n int) error
+}
+
+// SetRateLimiter throttles the blobs that the Encoder uploads
+// by waiting on l before each one.
+// If perByte is false, each blob costs one token,
+// so l limits blobs per second;
+// otherwise each blob costs as many tokens as it has bytes,
+// so l limits bytes per second,
+// and l must allow a burst at least as large as the largest blob.
+// The wait ends early, failing the upload, if the context passed to Encode is canceled.
+//
+// The limit applies across all calls to Encode,
+// and on top of the concurrency limit (see SetConcurrency).
+// Blobs that are not uploaded
+// (in a dry run, or because of the dedup cache or SetKnownRefs)
+// cost nothing,
+// and neither do blobs written by a Marshaler's own code.
+// A nil l (the default) means no limit.
+func (e *Encoder) SetRateLimiter(l RateLimiter, perByte bool) {
+	e.limiter = l
+	e.limitBytes = perByte
+}
+
+// Waits on the Encoder's rate limiter, if any,
+// before uploading a blob of n bytes.
+func (e *Encoder) waitToUpload(ctx context.Context, n int) error {
+	if e.limiter == nil {
+		return nil
+	}
+	tokens := 1
+	if e.limitBytes {
+		tokens = n
+	}
+	return errors.Wrap(e.limiter.WaitN(ctx, tokens), "waiting for rate limiter")
+}
@@ -0,0 +1,218 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// RawField navigates the tree of blobs rooted at root
+// to the value addressed by path,
+// and returns its raw bytes and blobref
+// without decoding it into a Go value.
+// This is useful for inspecting or extracting one leaf of a large tree cheaply.
+//
+// The path has the form reported by PathFromContext:
+// struct field names (as stored, i.e. after applying pk tags) separated by dots,
+// and bracketed slice or array indexes and map keys,
+// like "Order.Items[2].Name".
+// The empty path addresses the root.
+//
+// If the path ends at a value that is stored inline in its parent's blob
+// (such as a field with the "inline" option, or the blobref list of a slice field),
+// the result is the raw JSON of that value, with a zero blobref.
+// If it ends at an element of a slice or array of small scalars stored in one blob
+// (see Encoder.SetInlineSmallScalars),
+// the result is the content that the element's own blob would have had,
+// with a zero blobref.
+func (d *Decoder) RawField(ctx context.Context, root blob.Ref, path string) ([]byte, blob.Ref, error) {
+	segs, err := parsePath(path)
+	if err != nil {
+		return nil, blob.Ref{}, err
+	}
+	ctx = d.withBudget(ctx)
+
+	var (
+		ref    = root
+		inline json.RawMessage // non-nil when the current value is inline JSON rather than a blob
+		sofar  string
+	)
+	for k, seg := range segs {
+		container := inline
+		if container == nil {
+			container, err = d.fetchStructure(ctx, ref)
+			if err != nil {
+				return nil, blob.Ref{}, errors.Wrapf(err, "fetching %s at path %q", ref, sofar)
+			}
+			if vals, ok := parseScalarValues(container); ok {
+				return scalarValueAt(vals, segs[k:], sofar)
+			}
+		}
+
+		var (
+			next    json.RawMessage
+			isArray bool
+		)
+		if t := bytes.TrimSpace(container); len(t) > 0 && t[0] != '{' {
+			isArray = seg.bracket
+		} else {
+			// A struct field or map key,
+			// or an index into a chunked blobref array.
+			if dir, ok := parseShardDir(container); ok && seg.bracket && inline == nil {
+				// A key of a sharded map (see Encoder.SetMapSharding),
+				// found in the shard that its key hashes to.
+				if len(dir.Shards) == 0 {
+					return nil, blob.Ref{}, errors.Errorf("no %s at path %q", seg, sofar)
+				}
+				i, err := shardFor(reflect.ValueOf(seg.name), len(dir.Shards))
+				if err != nil {
+					return nil, blob.Ref{}, err
+				}
+				container, err = d.fetchStructure(ctx, dir.Shards[i])
+				if err != nil {
+					return nil, blob.Ref{}, errors.Wrapf(err, "fetching map shard %s at path %q", dir.Shards[i], sofar)
+				}
+			}
+			var m map[string]json.RawMessage
+			err = json.Unmarshal(container, &m)
+			if err != nil {
+				return nil, blob.Ref{}, errors.Wrapf(err, "JSON-decoding object at path %q", sofar)
+			}
+			var ok bool
+			next, ok = m[seg.name]
+			if !ok {
+				_, hasChunks := m["chunks"]
+				if !seg.bracket || !hasChunks || inline != nil {
+					return nil, blob.Ref{}, errors.Errorf("no %s at path %q", seg, sofar)
+				}
+				isArray = true
+			}
+		}
+
+		if isArray {
+			i, err := strconv.Atoi(seg.name)
+			if err != nil {
+				return nil, blob.Ref{}, errors.Errorf("invalid index [%s] at path %q", seg.name, sofar)
+			}
+			var refs []blob.Ref
+			if inline != nil {
+				err = json.Unmarshal(container, &refs)
+			} else {
+				refs, err = d.readRefArray(ctx, container)
+			}
+			if err != nil {
+				return nil, blob.Ref{}, errors.Wrapf(err, "reading blobref array at path %q", sofar)
+			}
+			if i < 0 || i >= len(refs) {
+				return nil, blob.Ref{}, errors.Errorf("index [%d] out of range at path %q (length %d)", i, sofar, len(refs))
+			}
+			next, err = json.Marshal(refs[i])
+			if err != nil {
+				return nil, blob.Ref{}, err
+			}
+		} else if next == nil {
+			return nil, blob.Ref{}, errors.Errorf("no %s at path %q", seg, sofar)
+		}
+
+		sofar += seg.String()
+
+		var s string
+		if json.Unmarshal(next, &s) == nil {
+			if r, ok := blob.Parse(s); ok {
+				ref, inline = r, nil
+				continue
+			}
+		}
+		inline = next
+	}
+
+	// Copy the result so that callers cannot alter the fetch cache.
+	if inline != nil {
+		return append([]byte(nil), inline...), blob.Ref{}, nil
+	}
+	b, err := d.fetch(ctx, ref)
+	if err != nil {
+		return nil, blob.Ref{}, err
+	}
+	return append([]byte(nil), b...), ref, nil
+}
+
+// Returns the element of vals,
+// the inline scalar values of a slice or array at path sofar,
+// addressed by segs.
+// The element is a leaf,
+// so segs must be a single index.
+func scalarValueAt(vals []string, segs []pathSeg, sofar string) ([]byte, blob.Ref, error) {
+	seg := segs[0]
+	if !seg.bracket {
+		return nil, blob.Ref{}, errors.Errorf("no %s at path %q", seg, sofar)
+	}
+	i, err := strconv.Atoi(seg.name)
+	if err != nil {
+		return nil, blob.Ref{}, errors.Errorf("invalid index [%s] at path %q", seg.name, sofar)
+	}
+	if i < 0 || i >= len(vals) {
+		return nil, blob.Ref{}, errors.Errorf("index [%d] out of range at path %q (length %d)", i, sofar, len(vals))
+	}
+	if len(segs) > 1 {
+		return nil, blob.Ref{}, errors.Errorf("no %s at path %q", segs[1], sofar+seg.String())
+	}
+	return []byte(vals[i]), blob.Ref{}, nil
+}
+
+type pathSeg struct {
+	name    string
+	bracket bool
+}
+
+func (seg pathSeg) String() string {
+	if seg.bracket {
+		return "[" + seg.name + "]"
+	}
+	return "." + seg.name
+}
+
+// Splits a path like "Order.Items[2].Name" into its segments.
+func parsePath(path string) ([]pathSeg, error) {
+	var (
+		result []pathSeg
+		rest   = path
+		first  = true
+	)
+	for rest != "" {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.Errorf("unterminated [ in path %q", path)
+			}
+			result = append(result, pathSeg{name: rest[1:end], bracket: true})
+			rest = rest[end+1:]
+
+		case rest[0] == '.' || first:
+			if rest[0] == '.' {
+				rest = rest[1:]
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, errors.Errorf("empty field name in path %q", path)
+			}
+			result = append(result, pathSeg{name: rest[:end]})
+			rest = rest[end:]
+
+		default:
+			return nil, errors.Errorf("invalid path %q", path)
+		}
+		first = false
+	}
+	return result, nil
+}
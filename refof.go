@@ -0,0 +1,72 @@
+package pk
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Caches the result of refOfFields by struct type.
+var refOfCache sync.Map // reflect.Type -> refOfResult
+
+type refOfResult struct {
+	fields map[int]int
+	err    error
+}
+
+// Returns a map from the index of each field of struct type t
+// that has the refof option
+// to the index of the field it names,
+// checking that the former is a blob.Ref
+// and that the latter is stored as a single blob.
+func refOfFields(t reflect.Type) (map[int]int, error) {
+	if r, ok := refOfCache.Load(t); ok {
+		r := r.(refOfResult)
+		return r.fields, r.err
+	}
+	fields, err := findRefOfFields(t)
+	refOfCache.Store(t, refOfResult{fields: fields, err: err})
+	return fields, err
+}
+
+func findRefOfFields(t reflect.Type) (map[int]int, error) {
+	var result map[int]int
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		_, o := parseTag(tf)
+		if o.Omit || o.RefOf == "" {
+			continue
+		}
+		if !isRefType(tf.Type) {
+			return nil, errors.Errorf("refof field %s of %s has type %s, want blob.Ref", tf.Name, t, tf.Type)
+		}
+		target, ok := t.FieldByName(o.RefOf)
+		if !ok || len(target.Index) != 1 || target.Index[0] == i {
+			return nil, errors.Errorf("refof field %s of %s names no other field %q", tf.Name, t, o.RefOf)
+		}
+		_, to := parseTag(target)
+		if to.Omit || to.Self || to.RefOf != "" || !isSingleBlob(target.Type, to) {
+			return nil, errors.Errorf("field %s of %s, named by refof field %s, is not stored as a single blob", target.Name, t, tf.Name)
+		}
+		if result == nil {
+			result = make(map[int]int)
+		}
+		result[i] = target.Index[0]
+	}
+	return result, nil
+}
+
+// Tells whether a struct field of type t with tag options o
+// is stored as a single blob,
+// so that the field's entry in its struct's JSON is that blob's ref.
+func isSingleBlob(t reflect.Type, o options) bool {
+	if o.Inline || isSparseArray(t, o) || isChunkable(t, o) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return o.External || isCompactTimes(t, o) || isPacked(t, o) || isBitset(t, o)
+	}
+	return true
+}
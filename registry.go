@@ -0,0 +1,148 @@
+package pk
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// typeHint is the JSON form in which an interface value is stored:
+// the registered name of its concrete type,
+// and the ref of the recursively marshaled concrete value.
+type typeHint struct {
+	Type string   `json:"type"`
+	Ref  blob.Ref `json:"ref"`
+}
+
+var registry = struct {
+	mu         sync.RWMutex
+	nameToType map[string]reflect.Type
+	typeToName map[reflect.Type]string
+}{
+	nameToType: make(map[string]reflect.Type),
+	typeToName: make(map[reflect.Type]string),
+}
+
+// Register records the concrete type of value
+// so that it can be marshaled and unmarshaled
+// when it appears in an interface-typed location
+// (such as a map[string]interface{} value, an []interface{} element, or an interface{} struct field).
+// The type is recorded under a default name derived from the type itself.
+// See RegisterName.
+//
+// Booleans, integers, floats, strings,
+// []interface{}, and map[string]interface{}
+// are registered automatically.
+func Register(value interface{}) {
+	RegisterName(defaultTypeName(reflect.TypeOf(value)), value)
+}
+
+// RegisterName is like Register but uses the given name for the type of value.
+// The name is stored alongside marshaled interface values
+// and is used to select the concrete type when unmarshaling them,
+// so it must be the same in the marshaling and unmarshaling programs.
+//
+// RegisterName panics if the name or the type is already registered differently.
+func RegisterName(name string, value interface{}) {
+	if name == "" {
+		panic("pk: attempt to register empty name")
+	}
+
+	t := reflect.TypeOf(value)
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if other, ok := registry.nameToType[name]; ok && other != t {
+		panic(fmt.Sprintf("pk: registering duplicate types for %q: %s != %s", name, other, t))
+	}
+	if other, ok := registry.typeToName[t]; ok && other != name {
+		panic(fmt.Sprintf("pk: registering duplicate names for %s: %q != %q", t, other, name))
+	}
+	registry.nameToType[name] = t
+	registry.typeToName[t] = name
+}
+
+func registeredName(t reflect.Type) (string, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	name, ok := registry.typeToName[t]
+	return name, ok
+}
+
+func registeredType(name string) (reflect.Type, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	t, ok := registry.nameToType[name]
+	return t, ok
+}
+
+// TypeResolver is the type of a callback that supplies the concrete type
+// for name, the type name stored with an interface value,
+// when name is not registered.
+// It returns a nil type if it does not know name either.
+type TypeResolver func(name string) (reflect.Type, error)
+
+// SetTypeResolver causes d to consult f
+// when it decodes an interface value whose stored type name
+// is not in the registry (see Register and RegisterName),
+// so that types can be resolved dynamically,
+// e.g. from a plugin system or a schema service.
+// Registered names are always tried first.
+// An error from f causes decoding to fail,
+// as does a nil type, with ErrUnregisteredType.
+// By default (and with a nil f) only registered names are recognized.
+func (d *Decoder) SetTypeResolver(f TypeResolver) {
+	d.resolver = f
+}
+
+// Returns the type registered as name,
+// or else the type that d's resolver supplies for it.
+func (d *Decoder) resolveType(name string) (reflect.Type, error) {
+	if t, ok := registeredType(name); ok {
+		return t, nil
+	}
+	if d.resolver == nil {
+		return nil, ErrUnregisteredType{Name: name}
+	}
+	t, err := d.resolver(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving type %q", name)
+	}
+	if t == nil {
+		return nil, ErrUnregisteredType{Name: name}
+	}
+	return t, nil
+}
+
+// Named types are qualified by their package path
+// (with a leading * for pointers to named types).
+// Others use the type's string representation.
+func defaultTypeName(t reflect.Type) string {
+	var star string
+	if t.Name() == "" && t.Kind() == reflect.Ptr {
+		star = "*"
+		t = t.Elem()
+	}
+	if t.Name() == "" || t.PkgPath() == "" {
+		return star + t.String()
+	}
+	return star + t.PkgPath() + "." + t.Name()
+}
+
+func init() {
+	for _, v := range []interface{}{
+		false,
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0),
+		"",
+		[]interface{}(nil),
+		map[string]interface{}(nil),
+	} {
+		Register(v)
+	}
+}
@@ -0,0 +1,56 @@
+package pk
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// retrier retries operations that fail with transient errors.
+// Its zero value performs each operation exactly once.
+type retrier struct {
+	attempts    int
+	backoff     func(attempt int) time.Duration
+	isTransient func(error) bool
+}
+
+// IsTransient is the default test for whether an error from a blob operation
+// is worth retrying (see Encoder.SetRetry and Decoder.SetRetry).
+// It reports true for network timeouts
+// and for errors with a Temporary method that returns true.
+func IsTransient(err error) bool {
+	err = errors.Cause(err)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return true
+	}
+	if terr, ok := err.(interface{ Temporary() bool }); ok {
+		return terr.Temporary()
+	}
+	return false
+}
+
+func (r retrier) do(ctx context.Context, f func() error) error {
+	isTransient := r.isTransient
+	if isTransient == nil {
+		isTransient = IsTransient
+	}
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= r.attempts || !isTransient(err) {
+			return err
+		}
+		var wait time.Duration
+		if r.backoff != nil {
+			wait = r.backoff(attempt)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// rootCamliType is the camliType of the marker blobs written by SetMarkRoots.
+const rootCamliType = "pk-root"
+
+// rootMarker is the form of a marker blob.
+type rootMarker struct {
+	CamliVersion int      `json:"camliVersion"`
+	CamliType    string   `json:"camliType"`
+	Root         blob.Ref `json:"root"`
+}
+
+// Marker blobs are small; ListRoots skips fetching larger blobs.
+const maxRootMarkerSize = 256
+
+// SetMarkRoots tells whether Encode should mark the root of each tree it writes,
+// so that ListRoots can find it.
+// The mark is a separate small blob,
+// a Perkeep-style schema blob with camliType "pk-root"
+// that refers to the root;
+// the root's own ref is unaffected.
+// By default roots are not marked.
+func (e *Encoder) SetMarkRoots(val bool) {
+	e.markRoots = val
+}
+
+// Writes the marker blob for root.
+func (e *Encoder) markRoot(ctx context.Context, root blob.Ref) error {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(rootMarker{CamliVersion: 1, CamliType: rootCamliType, Root: root})
+	if err != nil {
+		return errors.Wrap(err, "encoding root marker")
+	}
+	_, err = e.receiveString(ctx, buf.String())
+	return errors.Wrapf(err, "storing root marker for %s", root)
+}
+
+// ListRoots enumerates the blobs in src
+// and returns the refs of the roots of the trees
+// that were written by an Encoder with SetMarkRoots enabled,
+// sorted by their string form.
+// Trees written without that setting are not found.
+// The roots themselves need not be present in src.
+func ListRoots(ctx context.Context, src blobserver.FetcherEnumerator) ([]blob.Ref, error) {
+	var (
+		d     = NewDecoder(src)
+		seen  = make(map[blob.Ref]bool)
+		roots []blob.Ref
+	)
+	err := blobserver.EnumerateAll(ctx, src, func(sref blob.SizedRef) error {
+		if sref.Size > maxRootMarkerSize {
+			return nil
+		}
+		s, err := d.fetch(ctx, sref.Ref)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(s, []byte(rootCamliType)) {
+			return nil
+		}
+		var m rootMarker
+		if json.Unmarshal(s, &m) != nil || m.CamliType != rootCamliType || !m.Root.Valid() {
+			return nil
+		}
+		if !seen[m.Root] {
+			seen[m.Root] = true
+			roots = append(roots, m.Root)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "enumerating blobs")
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].String() < roots[j].String() })
+	return roots, nil
+}
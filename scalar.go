@@ -0,0 +1,120 @@
+package pk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SetInlineScalarStructs enables a fast path for structs
+// whose fields are all booleans, numbers, and strings
+// (not counting fields tagged `pk:"-"`):
+// such a struct is marshaled as a single plain JSON object
+// holding its field values directly,
+// like {"A":1,"B":"x"},
+// as if every field were tagged inline,
+// rather than with a separate blob per field.
+// This saves the per-field blobs when encoding and the per-field fetches when decoding.
+//
+// The object also holds the key "pk:inline" with the value true,
+// which marks it as being in this form,
+// so decoding recognizes both forms regardless of this setting.
+//
+// Integer types registered with RegisterEnum are not scalars for this purpose.
+// By default the fast path is disabled.
+func (e *Encoder) SetInlineScalarStructs(val bool) {
+	e.inlineScalarStructs = val
+}
+
+// Tells whether all (non-omitted) fields of struct type t are scalars.
+func isScalarStruct(t reflect.Type) bool {
+	if t.NumField() == 0 {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		_, o := parseTag(tf)
+		if o.Omit {
+			continue
+		}
+		if o.Encrypt || o.ChunkAt > 0 {
+			return false
+		}
+		switch tf.Type.Kind() {
+		case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			// ok
+
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			enums.mu.RLock()
+			_, isEnum := enums.types[tf.Type]
+			enums.mu.RUnlock()
+			if isEnum {
+				return false
+			}
+
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// inlineScalarsKey marks the JSON of a struct in inline-scalar form
+// (see SetInlineScalarStructs).
+// Like summaryKey, it cannot collide with a Go field name.
+const inlineScalarsKey = "pk:inline"
+
+// Tells whether s, the JSON of a struct, is marked as being in inline-scalar form.
+func hasInlineScalarsKey(s []byte) bool {
+	if !bytes.Contains(s, []byte(`"`+inlineScalarsKey+`"`)) {
+		// The usual case, decided without parsing s.
+		return false
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(s, &m); err != nil {
+		return false
+	}
+	return string(m[inlineScalarsKey]) == "true"
+}
+
+// Caches the intermediate types used for decoding inline scalar structs.
+var inlineScalarTypes sync.Map // reflect.Type -> reflect.Type
+
+func inlineScalarType(t reflect.Type) reflect.Type {
+	if it, ok := inlineScalarTypes.Load(t); ok {
+		return it.(reflect.Type)
+	}
+	ftypes := make([]reflect.StructField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		name, _ := parseTag(tf)
+		tf.Tag = reflect.StructTag(fmt.Sprintf(`json:"%s"`, name))
+		ftypes = append(ftypes, tf)
+	}
+	it := reflect.StructOf(ftypes)
+	inlineScalarTypes.Store(t, it)
+	return it
+}
+
+// Decodes s, a struct in inline-scalar form, into dst.
+func (d *Decoder) decodeInlineScalarStruct(s []byte, dst reflect.Value) error {
+	t := dst.Type()
+	tmp := reflect.New(inlineScalarType(t))
+	dec := d.newJSONDecoder(bytes.NewReader(s))
+	err := dec.Decode(tmp.Interface())
+	if err != nil {
+		return errors.Wrapf(err, "JSON-decoding inline struct type %s", t)
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if _, o := parseTag(t.Field(i)); o.Omit {
+			continue
+		}
+		dst.Field(i).Set(tmp.Elem().Field(i))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package pk
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// Caches the result of selfFields by struct type.
+var selfCache sync.Map // reflect.Type -> selfResult
+
+type selfResult struct {
+	fields []int
+	err    error
+}
+
+// Returns the indexes of the fields of struct type t
+// that have the self option,
+// checking that they are blob.Refs.
+func selfFields(t reflect.Type) ([]int, error) {
+	if r, ok := selfCache.Load(t); ok {
+		r := r.(selfResult)
+		return r.fields, r.err
+	}
+	fields, err := findSelfFields(t)
+	selfCache.Store(t, selfResult{fields: fields, err: err})
+	return fields, err
+}
+
+func findSelfFields(t reflect.Type) ([]int, error) {
+	var result []int
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		_, o := parseTag(tf)
+		if o.Omit || !o.Self {
+			continue
+		}
+		if !isRefType(tf.Type) {
+			return nil, errors.Errorf("self field %s of %s has type %s, want blob.Ref", tf.Name, t, tf.Type)
+		}
+		if o.RefOf != "" {
+			return nil, errors.Errorf("field %s of %s cannot have both self and refof", tf.Name, t)
+		}
+		result = append(result, i)
+	}
+	return result, nil
+}
+
+// Sets the fields of struct v at the given indexes to ref,
+// where they are settable.
+func setSelfRefs(v reflect.Value, fields []int, ref blob.Ref) {
+	for _, i := range fields {
+		if vf := v.Field(i); vf.CanSet() {
+			vf.Set(reflect.ValueOf(ref).Convert(vf.Type()))
+		}
+	}
+}
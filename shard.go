@@ -0,0 +1,198 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/json"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// shardDir is the root blob of a map that is split into shards
+// when sharding is enabled (see Encoder.SetMapSharding).
+// Each shard is a plain map[K]blob.Ref blob
+// holding the entries whose keys hash to it.
+type shardDir struct {
+	// Len is the total number of entries in all the shards.
+	Len    int        `json:"len"`
+	Shards []blob.Ref `json:"shards"`
+}
+
+// SetMapSharding enables the sharding of large maps.
+// Normally a map is stored as a single JSON object mapping each key to a blobref,
+// which for millions of entries becomes an enormous blob.
+// With threshold and shards both positive,
+// a map with more than threshold entries
+// is instead split into the given number of shard blobs,
+// each a JSON object of the usual form
+// holding the entries whose keys hash to it
+// (by the FNV-1a hash of the key's JSON form, modulo the number of shards),
+// and is stored as a directory blob of the form {"len": N, "shards": [ref,ref,...]},
+// where N is the total number of entries.
+// No single blob then holds every key,
+// and a single entry can be found by reading only its shard
+// (see Decoder.DecodeMapValue).
+//
+// Sharding applies to maps stored as blobs of their own:
+// top-level values, members of other containers,
+// struct fields with the "external" option,
+// and maps written with EncodeRefMap.
+// It does not apply to the key-to-blobref maps that struct fields hold by default.
+//
+// Decoding detects and reads sharded maps regardless of this setting.
+// By default sharding is disabled.
+func (e *Encoder) SetMapSharding(threshold, shards int) {
+	e.shardThreshold, e.shards = threshold, shards
+}
+
+// Stores mm, a map[K]blob.Ref, as a JSON object,
+// or as a directory of shards if it is large and sharding is enabled.
+func (e *Encoder) storeRefMap(ctx context.Context, mm reflect.Value) (blob.Ref, error) {
+	n := e.shards
+	if e.shardThreshold < 1 || n < 1 || mm.Len() <= e.shardThreshold {
+		sref, err := e.receiveJSON(ctx, mm.Interface())
+		return sref.Ref, errors.Wrap(err, "storing ref map")
+	}
+
+	shards := make([]reflect.Value, n)
+	for i := range shards {
+		shards[i] = reflect.MakeMap(mm.Type())
+	}
+	iter := mm.MapRange()
+	for iter.Next() {
+		i, err := shardFor(iter.Key(), n)
+		if err != nil {
+			return blob.Ref{}, err
+		}
+		shards[i].SetMapIndex(iter.Key(), iter.Value())
+	}
+
+	dir := shardDir{Len: mm.Len()}
+	for _, shard := range shards {
+		sref, err := e.receiveJSON(ctx, shard.Interface())
+		if err != nil {
+			return blob.Ref{}, errors.Wrap(err, "storing map shard")
+		}
+		dir.Shards = append(dir.Shards, sref.Ref)
+	}
+	sref, err := e.receiveJSON(ctx, dir)
+	return sref.Ref, errors.Wrap(err, "storing shard directory")
+}
+
+// Tells which of n shards holds the map key k.
+func shardFor(k reflect.Value, n int) (int, error) {
+	s, err := mapKeyString(k)
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return int(h.Sum32() % uint32(n)), nil
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// Returns the string that encoding/json uses for k as an object key.
+func mapKeyString(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if k.Type().Implements(textMarshalerType) {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		b, err := k.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(b), errors.Wrapf(err, "marshaling map key %v", k)
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", ErrUnsupportedType{Name: k.Type().String()}
+}
+
+// Parses s as a shard directory,
+// reporting false if it is not one
+// (such as an ordinary map blob, whose values are all refs).
+func parseShardDir(s []byte) (shardDir, bool) {
+	if t := bytes.TrimSpace(s); len(t) == 0 || t[0] != '{' {
+		return shardDir{}, false
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(s, &m); err != nil || len(m) != 2 {
+		return shardDir{}, false
+	}
+	if l := m["len"]; len(l) == 0 || l[0] < '0' || l[0] > '9' {
+		return shardDir{}, false
+	}
+	if sh := m["shards"]; len(sh) == 0 || sh[0] != '[' {
+		return shardDir{}, false
+	}
+	var dir shardDir
+	if err := json.Unmarshal(s, &dir); err != nil {
+		return shardDir{}, false
+	}
+	return dir, true
+}
+
+// Parses s as a map[K]blob.Ref for key type kt,
+// or as the directory of a sharded one,
+// whose shards are read and merged.
+func (d *Decoder) readRefMap(ctx context.Context, s []byte, kt reflect.Type) (reflect.Value, error) {
+	mt := reflect.MapOf(kt, reftype)
+
+	dir, ok := parseShardDir(s)
+	if !ok {
+		mm := reflect.New(mt)
+		dec := d.newJSONDecoder(bytes.NewReader(s))
+		err := dec.Decode(mm.Interface())
+		if err != nil {
+			return reflect.Value{}, errors.Wrap(err, "JSON-decoding map[K]blob.Ref")
+		}
+		return mm.Elem(), nil
+	}
+
+	if err := d.checkRefCount(dir.Len); err != nil {
+		return reflect.Value{}, err
+	}
+	result := reflect.MakeMap(mt)
+	for _, shardRef := range dir.Shards {
+		shard, err := d.readShard(ctx, shardRef, mt)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		iter := shard.MapRange()
+		for iter.Next() {
+			result.SetMapIndex(iter.Key(), iter.Value())
+		}
+		if result.Len() > dir.Len {
+			return reflect.Value{}, errors.Errorf("shard directory promised %d entries, found more", dir.Len)
+		}
+	}
+	if result.Len() != dir.Len {
+		return reflect.Value{}, errors.Errorf("shard directory promised %d entries, found %d", dir.Len, result.Len())
+	}
+	return result, nil
+}
+
+// Fetches and parses the shard at ref as a map of type mt.
+func (d *Decoder) readShard(ctx context.Context, ref blob.Ref, mt reflect.Type) (reflect.Value, error) {
+	s, err := d.fetchStructure(ctx, ref)
+	if err != nil {
+		return reflect.Value{}, errors.Wrapf(err, "fetching map shard %s", ref)
+	}
+	mm := reflect.New(mt)
+	dec := d.newJSONDecoder(bytes.NewReader(s))
+	err = dec.Decode(mm.Interface())
+	if err != nil {
+		return reflect.Value{}, errors.Wrapf(err, "JSON-decoding map shard %s", ref)
+	}
+	return mm.Elem(), nil
+}
@@ -0,0 +1,119 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/jsonsign"
+	"perkeep.org/pkg/schema"
+)
+
+// The keys that a signed root blob has beyond those of its struct's fields.
+const (
+	camliSignerKey = "camliSigner"
+	camliSigKey    = "camliSig"
+)
+
+// SetSigner causes Encode to sign the blob of a root struct value
+// in the way Perkeep signs its schema blobs,
+// so that readers can verify who wrote it (see Decoder.SetVerifier).
+// The root's JSON gets a "camliSigner" key holding pubKeyRef,
+// and is then signed by signer, which adds a "camliSig" key.
+//
+// The pubKeyRef must be the blobref of signer's armored public key
+// (the one given to schema.NewSigner),
+// and verifiers need to be able to fetch that blob,
+// so the caller should store it too.
+//
+// Only structs are signed, and only at the root.
+// A signed root is never compressed (see SetStructuralCompression).
+// A nil signer (the default) disables signing.
+func (e *Encoder) SetSigner(signer *schema.Signer, pubKeyRef blob.Ref) {
+	e.signer = signer
+	e.signerPubKey = pubKeyRef
+}
+
+// Signs and stores s, the JSON of a root struct.
+func (e *Encoder) receiveSigned(ctx context.Context, s string) (blob.Ref, error) {
+	signed, err := e.signer.SignJSON(ctx, s, time.Now())
+	if err != nil {
+		return blob.Ref{}, errors.Wrap(err, "signing root")
+	}
+	sref, err := e.receiveString(ctx, signed)
+	return sref.Ref, errors.Wrap(err, "storing signed root")
+}
+
+// VerifyFunc is the type of a callback that checks the signature on signed,
+// the JSON of a signed root blob,
+// returning an error if the signature is invalid
+// or the signer is not trusted.
+type VerifyFunc func(ctx context.Context, signed string) error
+
+// SetVerifier causes Decode to check the root blobs it reads
+// with f.
+// When f is non-nil,
+// a root struct blob must be signed (see Encoder.SetSigner)
+// and f must accept its signature,
+// or Decode fails.
+// Signatures below the root, and the roots of values other than structs, are not checked.
+// See VerifySignature for a VerifyFunc using jsonsign.
+//
+// Whether or not f is set,
+// the signing keys are removed from a signed blob before it is decoded.
+// By default f is nil.
+func (d *Decoder) SetVerifier(f VerifyFunc) {
+	d.verify = f
+}
+
+// VerifySignature returns a VerifyFunc that checks signatures with jsonsign,
+// fetching the signers' public keys from src.
+// It accepts any valid signature;
+// to trust only certain signers,
+// wrap it with a check of the blob's "camliSigner".
+func VerifySignature(src blob.Fetcher) VerifyFunc {
+	return func(ctx context.Context, signed string) error {
+		vr := jsonsign.NewVerificationRequest(signed, src)
+		ok, err := vr.Verify(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+}
+
+// Checks the signature on s, the struct blob at ref, if needed,
+// and returns s without its signing keys.
+func (d *Decoder) checkSignature(ctx context.Context, ref blob.Ref, s []byte) ([]byte, error) {
+	isRoot := pathFrom(ctx) == nil
+	if !bytes.Contains(s, []byte(`"`+camliSigKey+`"`)) {
+		if d.verify != nil && isRoot {
+			return nil, errors.Errorf("root %s is not signed", ref)
+		}
+		return s, nil
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(s, &m); err != nil {
+		return nil, errors.Wrapf(err, "decoding struct blob %s", ref)
+	}
+	if _, ok := m[camliSigKey]; !ok {
+		if d.verify != nil && isRoot {
+			return nil, errors.Errorf("root %s is not signed", ref)
+		}
+		return s, nil
+	}
+	if d.verify != nil && isRoot {
+		if err := d.verify(ctx, string(s)); err != nil {
+			return nil, errors.Wrapf(err, "verifying signature of %s", ref)
+		}
+	}
+	delete(m, camliSignerKey)
+	delete(m, camliSigKey)
+	return json.Marshal(m)
+}
@@ -0,0 +1,156 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// scalarValues is how a slice or array of small scalars is stored
+// when inlining is enabled (see Encoder.SetInlineSmallScalars):
+// each element appears as the string that would otherwise be its own blob.
+type scalarValues struct {
+	Values []string `json:"values"`
+}
+
+// SetInlineSmallScalars enables the inlining of small scalar elements.
+// Normally each element of a slice or array is stored as a blob of its own,
+// and the slice as a JSON array of their refs,
+// which for a slice of small numbers means many tiny blobs
+// and a ref array far larger than the values in it.
+// With a threshold n of 1 or more,
+// a slice or array whose elements are all booleans, numbers, or strings
+// and whose elements' blobs would be at most n bytes long
+// is instead stored as a single blob of the form {"values": [v,v,...]},
+// where each v is the content that the element's blob would have had,
+// as a JSON string.
+// Other slices and arrays,
+// including those of types implementing Marshaler,
+// are stored as usual.
+//
+// Like chunking (see SetChunkFanout),
+// this applies to slices and arrays stored as blobs of their own,
+// not to the blobref lists that struct fields hold by default.
+// It changes the format of the blobs written,
+// so inlined slices can be read only by Decoders that know this form,
+// though any Decoder recognizes it regardless of this setting.
+// By default (and with n less than 1) inlining is disabled.
+func (e *Encoder) SetInlineSmallScalars(n int) {
+	e.inlineScalars = n
+}
+
+// Returns the contents of the blobs that the elements of v,
+// a slice or array,
+// would be stored as,
+// if they are all small scalars
+// (see SetInlineSmallScalars).
+func (e *Encoder) smallScalars(v reflect.Value) ([]string, bool) {
+	if e.inlineScalars < 1 || v.Len() == 0 {
+		return nil, false
+	}
+	elTyp := v.Type().Elem()
+	if !isScalarKind(elTyp.Kind()) || isMarshaler(elTyp) || isMarshaler(reflect.PtrTo(elTyp)) {
+		return nil, false
+	}
+	vals := make([]string, v.Len())
+	for i := range vals {
+		s, ok := scalarText(v.Index(i))
+		if !ok || len(s) > e.inlineScalars {
+			return nil, false
+		}
+		vals[i] = s
+	}
+	return vals, true
+}
+
+// Returns the content of the blob that encodeValue would store for v,
+// which has a scalar kind.
+func scalarText(v reflect.Value) (string, bool) {
+	t := v.Type()
+	switch t.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return "true", true
+		}
+		return "", true
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if s, ok := enumName(t, v.Int()); ok {
+			return s, true
+		}
+		return strconv.FormatInt(v.Int(), 10), true
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), true
+
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, t.Bits()), true
+
+	case reflect.String:
+		if t == numberType && !isJSONNumber(v.String()) {
+			// Let encodeValue report it.
+			return "", false
+		}
+		return v.String(), true
+	}
+	return "", false
+}
+
+// Stores vals, the element contents of a slice or array of small scalars.
+func (e *Encoder) storeScalarValues(ctx context.Context, vals []string) (blob.Ref, error) {
+	sref, err := e.receiveJSON(ctx, scalarValues{Values: vals})
+	return sref.Ref, errors.Wrap(err, "storing inline scalar values")
+}
+
+// Parses s as inline scalar values,
+// reporting false if s has some other form.
+func parseScalarValues(s []byte) ([]string, bool) {
+	if t := bytes.TrimSpace(s); len(t) == 0 || t[0] != '{' {
+		return nil, false
+	}
+	var m map[string]json.RawMessage
+	if json.Unmarshal(s, &m) != nil || len(m) != 1 {
+		return nil, false
+	}
+	var sv scalarValues
+	if _, ok := m["values"]; !ok || json.Unmarshal(s, &sv) != nil {
+		return nil, false
+	}
+	return sv.Values, true
+}
+
+// Sets the elements of v, a slice or array with scalar elements,
+// from vals.
+// A slice is replaced by a new one of the right length;
+// an array's extra elements are zeroed.
+func (d *Decoder) setScalarValues(v reflect.Value, vals []string) error {
+	t := v.Type()
+	if !isScalarKind(t.Elem().Kind()) {
+		return errors.Errorf("cannot decode inline scalar values into %s", t)
+	}
+	if err := d.checkRefCount(len(vals)); err != nil {
+		return err
+	}
+	if t.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(t, len(vals), len(vals)))
+	} else {
+		if err := d.checkArrayLen(v, len(vals)); err != nil {
+			return err
+		}
+		v.Set(reflect.Zero(t))
+	}
+	for i, val := range vals {
+		if i >= v.Len() {
+			break
+		}
+		if err := d.setScalar(v.Index(i), []byte(val)); err != nil {
+			return errors.Wrapf(err, "decoding element %d", i)
+		}
+	}
+	return nil
+}
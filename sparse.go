@@ -0,0 +1,88 @@
+package pk
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"perkeep.org/pkg/blob"
+)
+
+// sparseArray is how an array field with the "sparse" option
+// appears in its struct's JSON:
+// the array's length,
+// and the refs of only its non-zero elements, by index.
+type sparseArray struct {
+	Len   int              `json:"len"`
+	Elems map[int]blob.Ref `json:"elems"`
+}
+
+var sparseArrayType = reflect.TypeOf(sparseArray{})
+
+// Tells whether a field of type t with options o is stored as a sparseArray.
+func isSparseArray(t reflect.Type, o options) bool {
+	return o.Sparse && !o.External && t.Kind() == reflect.Array
+}
+
+// During EncodeDelta, prev holds the previous version of the array.
+func (e *Encoder) encodeSparseArray(ctx context.Context, arr reflect.Value, prev sparseArray) (sparseArray, error) {
+	var indexes []int
+	for i := 0; i < arr.Len(); i++ {
+		if !arr.Index(i).IsZero() {
+			indexes = append(indexes, i)
+		}
+	}
+	refs := make([]blob.Ref, len(indexes))
+	err := e.forEach(ctx, len(indexes), func(ctx context.Context, j int) error {
+		i := indexes[j]
+		ref, err := e.encodeValue(withPrev(withPathIndex(ctx, i), prev.Elems[i]), arr.Index(i))
+		if err != nil {
+			return err
+		}
+		refs[j] = ref
+		return nil
+	})
+	if err != nil {
+		return sparseArray{}, err
+	}
+
+	result := sparseArray{Len: arr.Len(), Elems: make(map[int]blob.Ref, len(indexes))}
+	for j, i := range indexes {
+		result.Elems[i] = refs[j]
+	}
+	return result, nil
+}
+
+// Like buildArray,
+// elements beyond the length of arr are ignored
+// (unless the Decoder requires lengths to match).
+func (d *Decoder) buildSparseArray(ctx context.Context, arr reflect.Value, sparse sparseArray) error {
+	if err := d.checkRefCount(len(sparse.Elems)); err != nil {
+		return err
+	}
+	if err := d.checkArrayLen(arr, sparse.Len); err != nil {
+		return err
+	}
+	arr.Set(reflect.Zero(arr.Type()))
+	for i, ref := range sparse.Elems {
+		if i < 0 || i >= arr.Len() {
+			continue
+		}
+		elCtx := withPathIndex(ctx, i)
+		err := d.Decode(elCtx, ref, arr.Index(i).Addr().Interface())
+		if err != nil {
+			if skipElement(elCtx, err) {
+				arr.Index(i).Set(reflect.Zero(arr.Type().Elem()))
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func sparseFromJSON(raw json.RawMessage) sparseArray {
+	var sparse sparseArray
+	json.Unmarshal(raw, &sparse)
+	return sparse
+}
@@ -0,0 +1,99 @@
+package pk
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ErrUnknownTagOption is the error for a pk struct tag containing an unrecognized option,
+// reported by ValidateType and in strict mode
+// (see Encoder.SetStrictTags and Decoder.SetStrictTags).
+type ErrUnknownTagOption struct {
+	Type   string // the struct type
+	Field  string // the Go name of the field
+	Option string
+}
+
+// Error implements the error interface.
+func (e ErrUnknownTagOption) Error() string {
+	return fmt.Sprintf("unknown pk tag option \"%s\" on field %s of %s", e.Option, e.Field, e.Type)
+}
+
+// SetStrictTags tells whether encoding a struct type
+// whose pk tags contain unrecognized options
+// (such as a misspelled "omitempty")
+// should fail with ErrUnknownTagOption.
+// Each struct type is checked once, when it is first encountered.
+// By default unrecognized options are ignored.
+// See also ValidateType.
+func (e *Encoder) SetStrictTags(val bool) {
+	e.strictTags = val
+}
+
+// SetStrictTags tells whether decoding into a struct type
+// whose pk tags contain unrecognized options
+// should fail with ErrUnknownTagOption.
+// See Encoder.SetStrictTags.
+func (d *Decoder) SetStrictTags(val bool) {
+	d.strictTags = val
+}
+
+// ValidateType checks the pk tags of t,
+// and of every struct type reachable from it
+// through fields, pointers, and the elements of slices, arrays, and maps,
+// returning an ErrUnknownTagOption for the first unrecognized tag option it finds.
+// It is useful in tests and at startup,
+// to catch tag typos before anything is marshaled.
+func ValidateType(t reflect.Type) error {
+	return validateType(t, make(map[reflect.Type]bool))
+}
+
+func validateType(t reflect.Type, seen map[reflect.Type]bool) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return validateType(t.Elem(), seen)
+
+	case reflect.Map:
+		return validateType(t.Elem(), seen)
+
+	case reflect.Struct:
+		if err := checkTags(t); err != nil {
+			return err
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if err := validateType(t.Field(i).Type, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Caches the result of checkTags by struct type.
+var checkedTags sync.Map // reflect.Type -> error
+
+// Checks the pk tags of the fields of struct type t (but not of nested types).
+func checkTags(t reflect.Type) error {
+	if err, ok := checkedTags.Load(t); ok {
+		if err == nil {
+			return nil
+		}
+		return err.(error)
+	}
+	var err error
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		if _, o := parseTag(tf); len(o.Unknown) > 0 {
+			err = ErrUnknownTagOption{Type: t.String(), Field: tf.Name, Option: o.Unknown[0]}
+			break
+		}
+	}
+	checkedTags.Store(t, err)
+	return err
+}
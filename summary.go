@@ -0,0 +1,63 @@
+package pk
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// summaryKey is the key under which a root struct's JSON refers to its summary blob.
+// It cannot collide with a Go field name.
+const summaryKey = "pk:summary"
+
+// rootKey is the context key marking the value being encoded as the root
+// when SetReadableRoot or SetSigner is in effect.
+type rootKey struct{}
+
+// SetReadableRoot tells whether Encode should write a human-readable summary
+// of a root struct value,
+// for browsing in the Perkeep UI and other debugging.
+// The summary is a separate, indented JSON blob
+// naming the struct's type and listing its fields and their types,
+// and the root blob refers to it under the key "pk:summary".
+// This adds a blob and changes the root's ref
+// (but not the refs of anything beneath the root).
+// The summary is ignored when unmarshaling.
+// It is written only for structs, and only at the root.
+// By default no summary is written.
+func (e *Encoder) SetReadableRoot(val bool) {
+	e.readableRoot = val
+}
+
+type summary struct {
+	Type   string         `json:"type"`
+	Fields []summaryField `json:"fields"`
+}
+
+type summaryField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Stores the summary of struct type t,
+// returning its ref.
+func (e *Encoder) storeSummary(ctx context.Context, t reflect.Type) (blob.Ref, error) {
+	sum := summary{Type: t.String()}
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		name, o := parseTag(tf)
+		if o.Omit {
+			continue
+		}
+		sum.Fields = append(sum.Fields, summaryField{Name: name, Type: tf.Type.String()})
+	}
+
+	// Always indented, regardless of SetIndent.
+	ee := *e
+	ee.prefix, ee.indent = "", "  "
+	ee.compressStructure = false
+	sref, err := ee.receiveJSON(ctx, sum)
+	return sref.Ref, errors.Wrapf(err, "storing summary of %s", t)
+}
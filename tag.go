@@ -5,13 +5,36 @@ import (
 	"strings"
 )
 
-type options struct {
-	inline    bool
-	external  bool
-	omitEmpty bool
-	omit      bool
+// Options holds the options in a pk struct tag.
+// See ParseTag.
+type Options struct {
+	Inline    bool   // inline
+	External  bool   // external
+	OmitEmpty bool   // omitempty
+	Omit      bool   // the whole tag is "-"
+	Uintptr   bool   // uintptr
+	Compact   bool   // compact
+	Sparse    bool   // sparse
+	Compute   bool   // compute
+	Encrypt   bool   // encrypt
+	TZName    bool   // tzname
+	Packed    bool   // packed
+	Bitset    bool   // bitset
+	Money     bool   // money
+	Self      bool   // self
+	ChunkAt   int64  // from chunkat=size
+	RefOf     string // from refof=field
+
+	HasDefault bool   // whether there is a default=value option
+	Default    string // the value from default=value
+
+	// Unknown holds any unrecognized options, in order.
+	// They are reported in strict mode (see ValidateType).
+	Unknown []string
 }
 
+type options = Options
+
 // tag syntax, inspired by encoding/json:
 //  `pk:"-"` means omit the field
 //  `pk:"name"` means use this name
@@ -23,16 +46,39 @@ type options struct {
 //  external: store blob for containers (slices, arrays, and maps)
 //    (by default, the container is inlined and the elements are blobrefs)
 //  omitEmpty: skip the field if it has a zero value
+//  uintptr: store a uintptr field as an unsigned integer (not portable!)
+//  compact: store a []time.Time field as a single blob of timestamps
+//  sparse: store an array field as a length plus refs of only its non-zero elements
+//  compute: when encoding, get the field's value by calling the method ComputeField
+//  encrypt: pass the blobs of the field's value through the field cipher
+//  tzname: store a time.Time field with the name of its location
+//  packed: store a slice of numbers as a single blob of little-endian binary values
+//  bitset: store a []bool field as a single blob of bits
+//  money: store a struct with Amount and Currency fields as a single string like "USD 12.34"
+//  chunkat=size: store a string or []byte field above size bytes as a file schema
+//  refof=field: store in a blob.Ref field the ref of the named sibling field's blob
+//  self: set a blob.Ref field to the ref of its own struct's blob, without storing it
+//  default=value: when decoding, use value if the field is absent (value cannot contain commas)
+//
+// unrecognized options are ignored, except in strict mode (see ValidateType)
 func parseTag(f reflect.StructField) (string, options) {
-	var (
-		name = f.Name
-		o    options
-	)
+	return ParseTag(f)
+}
+
+// ParseTag parses the pk tag of struct field f
+// (see the package documentation for the syntax),
+// returning the name under which the field is stored
+// (f.Name unless the tag gives another)
+// and the tag's options.
+// Unrecognized options are returned in opts.Unknown.
+func ParseTag(f reflect.StructField) (name string, opts Options) {
+	var o Options
+	name = f.Name
 	if t, ok := f.Tag.Lookup("pk"); ok {
 		switch t {
 		case "": // ok
 		case "-":
-			o.omit = true
+			o.Omit = true
 		default:
 			items := strings.Split(t, ",")
 			if items[0] != "" {
@@ -41,11 +87,50 @@ func parseTag(f reflect.StructField) (string, options) {
 			for _, item := range items[1:] {
 				switch item {
 				case "inline":
-					o.inline = true
+					o.Inline = true
 				case "external": // xxx need a better name than external
-					o.external = true
+					o.External = true
 				case "omitempty":
-					o.omitEmpty = true
+					o.OmitEmpty = true
+				case "uintptr":
+					o.Uintptr = true
+				case "compact":
+					o.Compact = true
+				case "sparse":
+					o.Sparse = true
+				case "compute":
+					o.Compute = true
+				case "encrypt":
+					o.Encrypt = true
+				case "tzname":
+					o.TZName = true
+				case "packed":
+					o.Packed = true
+				case "bitset":
+					o.Bitset = true
+				case "money":
+					o.Money = true
+				case "self":
+					o.Self = true
+				case "":
+					// ignore
+				default:
+					if strings.HasPrefix(item, "chunkat=") {
+						if n, ok := parseSize(strings.TrimPrefix(item, "chunkat=")); ok {
+							o.ChunkAt = n
+							continue
+						}
+					}
+					if strings.HasPrefix(item, "refof=") {
+						o.RefOf = strings.TrimPrefix(item, "refof=")
+						continue
+					}
+					if strings.HasPrefix(item, "default=") {
+						o.HasDefault = true
+						o.Default = strings.TrimPrefix(item, "default=")
+						continue
+					}
+					o.Unknown = append(o.Unknown, item)
 				}
 			}
 		}
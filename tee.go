@@ -0,0 +1,91 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// Tee is a BlobReceiver that writes every blob to several destinations,
+// e.g. for replication without marshaling twice.
+// Create one with TeeReceiver and pass it to NewEncoder.
+type Tee struct {
+	dsts    []blobserver.BlobReceiver
+	onError func(dst int, ref blob.Ref, err error)
+}
+
+// TeeReceiver produces a Tee writing to each of dsts.
+func TeeReceiver(dsts ...blobserver.BlobReceiver) *Tee {
+	return &Tee{dsts: dsts}
+}
+
+// SetOnError makes the Tee tolerate failures in some of its destinations.
+// When a write to one destination fails,
+// f is called with the destination's index in the list given to TeeReceiver,
+// the ref of the blob,
+// and the error,
+// and the write succeeds as long as at least one destination succeeded.
+// By default (and with a nil f), any failure is an error.
+//
+// A destination reporting a different ref from the others
+// always causes an error.
+func (t *Tee) SetOnError(f func(dst int, ref blob.Ref, err error)) {
+	t.onError = f
+}
+
+// ReceiveBlob implements blobserver.BlobReceiver.
+// It reads source fully
+// and then writes it to all destinations concurrently.
+func (t *Tee) ReceiveBlob(ctx context.Context, ref blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	if len(t.dsts) == 0 {
+		return blob.SizedRef{}, errors.New("tee has no destinations")
+	}
+
+	b, err := ioutil.ReadAll(source)
+	if err != nil {
+		return blob.SizedRef{}, errors.Wrapf(err, "reading %s", ref)
+	}
+
+	var (
+		srefs = make([]blob.SizedRef, len(t.dsts))
+		errs  = make([]error, len(t.dsts))
+		wg    sync.WaitGroup
+	)
+	for i, dst := range t.dsts {
+		i, dst := i, dst
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srefs[i], errs[i] = dst.ReceiveBlob(ctx, ref, bytes.NewReader(b))
+		}()
+	}
+	wg.Wait()
+
+	var (
+		result blob.SizedRef
+		ok     bool
+	)
+	for i, err := range errs {
+		if err != nil {
+			if t.onError == nil {
+				return blob.SizedRef{}, errors.Wrapf(err, "writing %s to tee destination %d", ref, i)
+			}
+			t.onError(i, ref, err)
+			continue
+		}
+		if srefs[i].Ref != ref {
+			return blob.SizedRef{}, errors.Errorf("tee destination %d stored %s as %s", i, ref, srefs[i].Ref)
+		}
+		result, ok = srefs[i], true
+	}
+	if !ok {
+		return blob.SizedRef{}, errors.Errorf("writing %s failed in all tee destinations", ref)
+	}
+	return result, nil
+}
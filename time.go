@@ -0,0 +1,104 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	timeSliceType = reflect.TypeOf([]time.Time(nil))
+)
+
+// Tells whether a field with type t and tag options o
+// is a []time.Time to be stored compactly.
+func isCompactTimes(t reflect.Type, o options) bool {
+	return o.Compact && t == timeSliceType
+}
+
+// Stores times as a single blob of newline-separated RFC 3339 timestamps.
+func (e *Encoder) encodeCompactTimes(ctx context.Context, times []time.Time) (blob.Ref, error) {
+	lines := make([]string, 0, len(times))
+	for _, t := range times {
+		lines = append(lines, t.Format(time.RFC3339Nano))
+	}
+	sref, err := e.receiveString(ctx, strings.Join(lines, "\n"))
+	return sref.Ref, errors.Wrap(err, "storing compact times")
+}
+
+// zonedTime is how a time.Time field with the "tzname" option is stored:
+// the time in RFC 3339 form,
+// and the name of its location.
+type zonedTime struct {
+	Time string `json:"time"`
+	Zone string `json:"zone,omitempty"`
+}
+
+// Tells whether a field with type t and tag options o
+// is a time.Time to be stored with its location name.
+func isZonedTime(t reflect.Type, o options) bool {
+	return o.TZName && t == timeType
+}
+
+// Stores tm as a zonedTime.
+func (e *Encoder) encodeZonedTime(ctx context.Context, tm time.Time) (blob.Ref, error) {
+	zt := zonedTime{Time: tm.Format(time.RFC3339Nano), Zone: tm.Location().String()}
+	buf := new(bytes.Buffer)
+	err := e.newJSONEncoder(buf).Encode(zt)
+	if err != nil {
+		return blob.Ref{}, errors.Wrap(err, "encoding zoned time")
+	}
+	sref, err := e.receiveString(ctx, buf.String())
+	return sref.Ref, errors.Wrap(err, "storing zoned time")
+}
+
+// Parses a zonedTime,
+// or a plain RFC 3339 time
+// (as stored for a field before it had the "tzname" option).
+// If the zone name is not known to time.LoadLocation,
+// the time keeps the fixed offset it was stored with.
+func parseZonedTime(s []byte) (time.Time, error) {
+	if len(s) == 0 || s[0] != '{' {
+		tm, err := time.Parse(time.RFC3339Nano, string(s))
+		return tm, errors.Wrapf(err, "parsing time from %s", string(s))
+	}
+	var zt zonedTime
+	if err := json.Unmarshal(s, &zt); err != nil {
+		return time.Time{}, errors.Wrap(err, "JSON-decoding zoned time")
+	}
+	tm, err := time.Parse(time.RFC3339Nano, zt.Time)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "parsing time from %s", zt.Time)
+	}
+	if zt.Zone == "" {
+		return tm, nil
+	}
+	loc, err := time.LoadLocation(zt.Zone)
+	if err != nil {
+		return tm, nil
+	}
+	return tm.In(loc), nil
+}
+
+func parseCompactTimes(s []byte) ([]time.Time, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	lines := strings.Split(string(s), "\n")
+	result := make([]time.Time, 0, len(lines))
+	for _, line := range lines {
+		t, err := time.Parse(time.RFC3339Nano, line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing time from %s", line)
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
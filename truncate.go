@@ -0,0 +1,79 @@
+package pk
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// ErrTruncated is the error recorded for a blobref array
+// that was cut off before its end
+// and only partly decoded.
+// See Decoder.SetTolerateTruncation.
+var ErrTruncated = errors.New("truncated ref array")
+
+// SetTolerateTruncation tells whether the Decoder should salvage
+// what it can from a blob holding a JSON array of blobrefs
+// (as for a slice or array stored as a blob of its own)
+// that ends prematurely,
+// as after a partial write.
+// Such an array is decoded as the complete refs that precede the break,
+// and decoding continues.
+// If anything was salvaged this way,
+// Decode then returns an ErrCollected
+// listing each truncated array with the path of its value
+// and an error whose Cause is ErrTruncated,
+// while obj holds everything that could be decoded.
+// (In Collect mode, see SetErrorMode,
+// the same ErrCollected lists the skipped elements too.)
+//
+// This is a best-effort mode for data recovery.
+// It cannot repair other kinds of damage,
+// such as a truncated struct blob, chunk index, or map,
+// or an array cut off in a way that leaves it valid JSON,
+// and the elements it drops are gone without a trace.
+// By default a truncated array is an error.
+func (d *Decoder) SetTolerateTruncation(val bool) {
+	d.tolerateTruncation = val
+}
+
+// Reads the complete refs at the start of s,
+// a JSON array of blobrefs that ends prematurely.
+// An error other than premature end of input
+// (such as malformed JSON or an invalid ref)
+// is reported.
+func salvageRefs(s []byte) ([]blob.Ref, error) {
+	dec := json.NewDecoder(bytes.NewReader(s))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading start of blobref array")
+	}
+	if tok != json.Delim('[') {
+		return nil, errors.Errorf("got %v, want start of blobref array", tok)
+	}
+	var refs []blob.Ref
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return refs, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading blobref array")
+		}
+		if tok == json.Delim(']') {
+			return nil, errors.New("blobref array is not truncated")
+		}
+		str, ok := tok.(string)
+		if !ok {
+			return nil, errors.Errorf("got %v in blobref array, want a string", tok)
+		}
+		ref, ok := blob.Parse(str)
+		if !ok {
+			return nil, errors.Errorf("invalid blobref %q", str)
+		}
+		refs = append(refs, ref)
+	}
+}
@@ -0,0 +1,82 @@
+package pk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// ErrRefMismatch is the error for a fetched blob
+// whose content does not hash to the ref it was fetched by.
+// See Decoder.SetVerifyRefs.
+var ErrRefMismatch = errors.New("blob content does not match its ref")
+
+// SetVerifyRefs tells whether the Decoder should check
+// that each blob it fetches from its source hashes to the ref it asked for,
+// with the hash function named in the ref,
+// failing with ErrRefMismatch if not.
+// This guards against corruption or tampering
+// by an untrusted source or transport.
+// It covers everything the Decoder fetches,
+// including the blobs read by Unmarshaler implementations
+// and the chunks of file schemas,
+// at the cost of hashing each blob as it arrives.
+// (Blobs served from the fetch cache, see SetFetchCache, were checked when first fetched.)
+// A mismatch is retried (see SetRetry)
+// only if the function given to SetIsTransient accepts it;
+// the default, IsTransient, does not.
+// By default refs are not verified.
+func (d *Decoder) SetVerifyRefs(val bool) {
+	d.verifyRefs = val
+}
+
+// Checks that s hashes to ref, if the Decoder verifies refs.
+func (d *Decoder) checkRef(ref blob.Ref, s []byte) error {
+	if !d.verifyRefs {
+		return nil
+	}
+	h := ref.Hash()
+	if h == nil {
+		return errors.Wrapf(ErrRefMismatch, "unknown hash for %s", ref)
+	}
+	h.Write(s)
+	if !ref.HashMatches(h) {
+		return errors.Wrapf(ErrRefMismatch, "fetching %s", ref)
+	}
+	return nil
+}
+
+// Returns the Decoder's source,
+// wrapped to verify the blobs fetched from it if the Decoder verifies refs,
+// for callers that fetch other than with Decoder.fetch.
+func (d *Decoder) source() blob.Fetcher {
+	if !d.verifyRefs {
+		return d.src
+	}
+	return verifyingFetcher{d: d}
+}
+
+// verifyingFetcher checks the blobs it fetches from a Decoder's source.
+type verifyingFetcher struct {
+	d *Decoder
+}
+
+func (f verifyingFetcher) Fetch(ctx context.Context, ref blob.Ref) (io.ReadCloser, uint32, error) {
+	r, size, err := f.d.src.Fetch(ctx, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	s, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := f.d.checkRef(ref, s); err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(s)), size, nil
+}
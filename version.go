@@ -0,0 +1,122 @@
+package pk
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// versionSet records the shapes registered with RegisterVersion for one struct type.
+type versionSet struct {
+	field  int    // the index of the version field
+	key    string // the version field's key in the struct's JSON
+	protos map[int64]reflect.Type
+}
+
+// RegisterVersion lets d decode values of the struct type typ
+// whose stored layout depends on a version number in one of their fields.
+// When decoding into typ,
+// d first reads the field named versionField (a Go field name),
+// which must have an integer type;
+// then, if its value is v,
+// it decodes the blob as if it had been written from a value of proto's type
+// and converts the result to typ.
+//
+// The type of proto must be a struct type convertible to typ,
+// i.e. one with the same fields but possibly different tags,
+// so that each version can give its fields the names
+// (and other options) it was written with.
+// A blob with no version field has version 0,
+// so registering version 0 covers blobs written before versioning began.
+// A blob whose version has no registered shape is decoded into typ as usual.
+//
+// RegisterVersion panics if typ has no integer field named versionField,
+// or if proto's type is not convertible to typ.
+// Registering a second shape for the same version replaces the first.
+func (d *Decoder) RegisterVersion(typ reflect.Type, versionField string, v int, proto interface{}) {
+	if typ.Kind() != reflect.Struct {
+		panic("pk: RegisterVersion of non-struct type " + typ.String())
+	}
+	sf, ok := typ.FieldByName(versionField)
+	if !ok || len(sf.Index) != 1 {
+		panic("pk: no field " + versionField + " in " + typ.String())
+	}
+	switch sf.Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+	default:
+		panic("pk: version field " + versionField + " of " + typ.String() + " is not an integer")
+	}
+	pt := reflect.TypeOf(proto)
+	if pt == nil {
+		panic("pk: nil version shape for " + typ.String())
+	}
+	if pt.Kind() != reflect.Struct || !pt.ConvertibleTo(typ) {
+		panic("pk: version shape " + pt.String() + " is not convertible to " + typ.String())
+	}
+
+	if d.versions == nil {
+		d.versions = make(map[reflect.Type]*versionSet)
+	}
+	vs := d.versions[typ]
+	if vs == nil {
+		key, _ := parseTag(sf)
+		vs = &versionSet{field: sf.Index[0], key: key, protos: make(map[int64]reflect.Type)}
+		d.versions[typ] = vs
+	}
+	vs.protos[int64(v)] = pt
+}
+
+// Decodes s, the JSON of a struct with registered versions, into structVal.
+// The link argument is as for decodeStruct.
+func (d *Decoder) decodeVersioned(ctx context.Context, s []byte, structVal reflect.Value, vs *versionSet, link *chainLink) error {
+	t := structVal.Type()
+	version, err := d.readVersion(ctx, s, t.Field(vs.field).Type, vs.key)
+	if err != nil {
+		return errors.Wrapf(err, "reading version of struct type %s", t)
+	}
+	pt, ok := vs.protos[version]
+	if !ok {
+		return d.decodeStruct(ctx, s, structVal, link)
+	}
+	pv, err := newValue(pt)
+	if err != nil {
+		return err
+	}
+	pv.Elem().Set(structVal.Convert(pt))
+	if err := d.decodeStruct(ctx, s, pv.Elem(), link); err != nil {
+		return errors.Wrapf(err, "decoding version %d of struct type %s", version, t)
+	}
+	structVal.Set(pv.Elem().Convert(t))
+	return nil
+}
+
+// Reads the version number, of type ft, under key in s.
+// An absent version is 0.
+func (d *Decoder) readVersion(ctx context.Context, s []byte, ft reflect.Type, key string) (int64, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(s, &m); err != nil {
+		return 0, errors.Wrap(err, "JSON-decoding struct")
+	}
+	raw, ok := m[key]
+	if !ok {
+		return 0, nil
+	}
+	p := reflect.New(ft)
+	var refStr string
+	if json.Unmarshal(raw, &refStr) == nil {
+		ref, ok := blob.Parse(refStr)
+		if !ok {
+			return 0, errors.Errorf("invalid blobref %q", refStr)
+		}
+		if err := d.Decode(withPathField(ctx, key), ref, p.Interface()); err != nil {
+			return 0, err
+		}
+	} else if err := json.Unmarshal(raw, p.Interface()); err != nil {
+		// An inline field.
+		return 0, err
+	}
+	return p.Elem().Int(), nil
+}